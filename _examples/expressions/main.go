@@ -98,13 +98,16 @@ func main() {
 	}
 
 	// Convert to formula
-	formula := ddqp.NewMetricExpressionFormula(formulaParsed)
+	formula, err := ddqp.ExtractFormula(formulaParsed, ddqp.LetterNaming)
+	if err != nil {
+		panic(err)
+	}
 
 	fmt.Printf("Expression: %s\n", formulaExpr)
 	fmt.Printf("Formula: %s\n", formula.Formula)
 	fmt.Println("Expressions Map:")
-	for k, v := range formula.Expressions {
-		fmt.Printf("  %s = %s\n", k, v)
+	for _, name := range formula.Names {
+		fmt.Printf("  %s = %s\n", name, formula.Expressions[name])
 	}
 
 	// Example 6: Percentage calculation
@@ -107,8 +107,7 @@ func main() {
 		Aggregation:      "max",
 		EvaluationWindow: "last_15m",
 		MetricQuery:      metricQuery,
-		Comparator:       ">",
-		Threshold:        95,
+		Condition:        ddqp.Condition{Comparator: ">", Threshold: 95},
 	}
 
 	fmt.Printf("Programmatically Created Monitor: %s\n", newMonitor.String())
@@ -0,0 +1,291 @@
+package ddqp
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Node is implemented by every type in the parsed AST so that queries can be
+// traversed without knowing the concrete shape of each node.
+type Node interface {
+	// Position returns where the node started in the parsed input. Nodes that
+	// were built by hand have a zero Position.
+	Position() lexer.Position
+	// Children returns the direct child nodes in source order.
+	Children() []Node
+	// Kind identifies the concrete node type.
+	Kind() NodeKind
+	// String renders the node back into query syntax.
+	String() string
+}
+
+// NodeKind identifies the concrete type of a Node.
+type NodeKind int
+
+const (
+	KindMetricQuery NodeKind = iota
+	KindAggregatorFuction
+	KindQuery
+	KindAggregator
+	KindFunction
+	KindMetricFilter
+	KindParam
+	KindSimpleFilter
+	KindGroupedFilter
+	KindFilterSeparator
+	KindFilterKey
+	KindFilterValue
+	KindValue
+	KindFilterValueSeparator
+	KindMetricExpression
+	KindExpressionAggregatorFuction
+	KindGroupedExpression
+	KindOpTerm
+	KindTerm
+	KindOpFactor
+	KindFactor
+	KindExprValue
+	KindMetricMonitor
+	KindGenericQuery
+	KindTemplateVariable
+	KindAnomalies
+	KindForecast
+	KindOutliers
+	KindNamedArg
+	KindLogMonitor
+	KindSearchQuery
+	KindSearchOr
+	KindSearchAnd
+	KindSearchAndOperand
+	KindSearchUnary
+	KindSearchTerm
+	KindSearchAttribute
+	KindSearchValue
+	KindSearchRange
+	KindSearchValueGroup
+	KindSearchValueOp
+	KindServiceCheckMonitor
+	KindCompositeMonitor
+	KindCompositeOr
+	KindCompositeAnd
+	KindCompositeUnary
+	KindCompositeTerm
+	KindEventMonitor
+	KindProcessMonitor
+	KindFormulaMonitor
+	KindUnaryExpr
+)
+
+var nodeKindNames = map[NodeKind]string{
+	KindMetricQuery:                 "MetricQuery",
+	KindAggregatorFuction:           "AggregatorFuction",
+	KindQuery:                       "Query",
+	KindAggregator:                  "Aggregator",
+	KindFunction:                    "Function",
+	KindMetricFilter:                "MetricFilter",
+	KindParam:                       "Param",
+	KindSimpleFilter:                "SimpleFilter",
+	KindGroupedFilter:               "GroupedFilter",
+	KindFilterSeparator:             "FilterSeparator",
+	KindFilterKey:                   "FilterKey",
+	KindFilterValue:                 "FilterValue",
+	KindValue:                       "Value",
+	KindFilterValueSeparator:        "FilterValueSeparator",
+	KindMetricExpression:            "MetricExpression",
+	KindExpressionAggregatorFuction: "ExpressionAggregatorFuction",
+	KindGroupedExpression:           "GroupedExpression",
+	KindOpTerm:                      "OpTerm",
+	KindTerm:                        "Term",
+	KindOpFactor:                    "OpFactor",
+	KindFactor:                      "Factor",
+	KindExprValue:                   "ExprValue",
+	KindMetricMonitor:               "MetricMonitor",
+	KindGenericQuery:                "GenericQuery",
+	KindTemplateVariable:            "TemplateVariable",
+	KindAnomalies:                   "Anomalies",
+	KindForecast:                    "Forecast",
+	KindOutliers:                    "Outliers",
+	KindNamedArg:                    "NamedArg",
+	KindLogMonitor:                  "LogMonitor",
+	KindSearchQuery:                 "SearchQuery",
+	KindSearchOr:                    "SearchOr",
+	KindSearchAnd:                   "SearchAnd",
+	KindSearchAndOperand:            "SearchAndOperand",
+	KindSearchUnary:                 "SearchUnary",
+	KindSearchTerm:                  "SearchTerm",
+	KindSearchAttribute:             "SearchAttribute",
+	KindSearchValue:                 "SearchValue",
+	KindSearchRange:                 "SearchRange",
+	KindSearchValueGroup:            "SearchValueGroup",
+	KindSearchValueOp:               "SearchValueOp",
+	KindServiceCheckMonitor:         "ServiceCheckMonitor",
+	KindCompositeMonitor:            "CompositeMonitor",
+	KindCompositeOr:                 "CompositeOr",
+	KindCompositeAnd:                "CompositeAnd",
+	KindCompositeUnary:              "CompositeUnary",
+	KindCompositeTerm:               "CompositeTerm",
+	KindEventMonitor:                "EventMonitor",
+	KindProcessMonitor:              "ProcessMonitor",
+	KindFormulaMonitor:              "FormulaMonitor",
+	KindUnaryExpr:                   "UnaryExpr",
+}
+
+func (k NodeKind) String() string {
+	if name, ok := nodeKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("NodeKind(%d)", int(k))
+}
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order, mirroring go/ast.Walk.
+func Walk(v Visitor, node Node) {
+	if node == nil {
+		return
+	}
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	for _, child := range node.Children() {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order. It calls f(node) for each
+// node; if f returns true, Inspect descends into the node's children and then
+// calls f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// Cursor describes the node currently being visited by Traverse.
+type Cursor struct {
+	stack []Node
+}
+
+// Node returns the current node.
+func (c *Cursor) Node() Node {
+	return c.stack[len(c.stack)-1]
+}
+
+// Parent returns the parent of the current node, or nil for the root.
+func (c *Cursor) Parent() Node {
+	if len(c.stack) < 2 {
+		return nil
+	}
+	return c.stack[len(c.stack)-2]
+}
+
+// Depth returns the number of ancestors of the current node.
+func (c *Cursor) Depth() int {
+	return len(c.stack) - 1
+}
+
+// Ancestors returns the ancestors of the current node, starting at the root.
+func (c *Cursor) Ancestors() []Node {
+	out := make([]Node, len(c.stack)-1)
+	copy(out, c.stack)
+	return out
+}
+
+// Traverse walks the AST rooted at root, calling pre before a node's children
+// are visited and post afterwards. Either function may be nil.
+//
+// If pre returns false, the children of the node and the post call for it are
+// skipped. If post returns false, the traversal stops.
+func Traverse(root Node, pre, post func(*Cursor) bool) {
+	if root == nil {
+		return
+	}
+	c := &Cursor{}
+	traverse(c, root, pre, post)
+}
+
+func traverse(c *Cursor, node Node, pre, post func(*Cursor) bool) bool {
+	c.stack = append(c.stack, node)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+
+	if pre != nil && !pre(c) {
+		return true
+	}
+	for _, child := range node.Children() {
+		if !traverse(c, child, pre, post) {
+			return false
+		}
+	}
+	if post != nil && !post(c) {
+		return false
+	}
+	return true
+}
+
+var (
+	_ Node = (*MetricQuery)(nil)
+	_ Node = (*AggregatorFuction)(nil)
+	_ Node = (*Query)(nil)
+	_ Node = (*Aggregator)(nil)
+	_ Node = (*Function)(nil)
+	_ Node = (*MetricFilter)(nil)
+	_ Node = (*Param)(nil)
+	_ Node = (*SimpleFilter)(nil)
+	_ Node = (*GroupedFilter)(nil)
+	_ Node = (*FilterSeparator)(nil)
+	_ Node = (*FilterKey)(nil)
+	_ Node = (*FilterValue)(nil)
+	_ Node = (*Value)(nil)
+	_ Node = (*FilterValueSeparator)(nil)
+	_ Node = (*MetricExpression)(nil)
+	_ Node = (*ExpressionAggregatorFuction)(nil)
+	_ Node = (*GroupedExpression)(nil)
+	_ Node = (*OpTerm)(nil)
+	_ Node = (*Term)(nil)
+	_ Node = (*OpFactor)(nil)
+	_ Node = (*Factor)(nil)
+	_ Node = (*ExprValue)(nil)
+	_ Node = (*MetricMonitor)(nil)
+	_ Node = (*GenericQuery)(nil)
+	_ Node = (*TemplateVariable)(nil)
+	_ Node = (*Anomalies)(nil)
+	_ Node = (*Forecast)(nil)
+	_ Node = (*Outliers)(nil)
+	_ Node = (*NamedArg)(nil)
+	_ Node = (*LogMonitor)(nil)
+	_ Node = (*SearchQuery)(nil)
+	_ Node = (*SearchOr)(nil)
+	_ Node = (*SearchAnd)(nil)
+	_ Node = (*SearchAndOperand)(nil)
+	_ Node = (*SearchUnary)(nil)
+	_ Node = (*SearchTerm)(nil)
+	_ Node = (*SearchAttribute)(nil)
+	_ Node = (*SearchValue)(nil)
+	_ Node = (*SearchRange)(nil)
+	_ Node = (*SearchValueGroup)(nil)
+	_ Node = (*SearchValueOp)(nil)
+	_ Node = (*ServiceCheckMonitor)(nil)
+	_ Node = (*CompositeMonitor)(nil)
+	_ Node = (*CompositeOr)(nil)
+	_ Node = (*CompositeAnd)(nil)
+	_ Node = (*CompositeUnary)(nil)
+	_ Node = (*CompositeTerm)(nil)
+	_ Node = (*EventMonitor)(nil)
+	_ Node = (*ProcessMonitor)(nil)
+	_ Node = (*FormulaMonitor)(nil)
+	_ Node = (*UnaryExpr)(nil)
+)
@@ -0,0 +1,179 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func kindsOf(node Node) []NodeKind {
+	kinds := []NodeKind{}
+	Inspect(node, func(n Node) bool {
+		if n != nil {
+			kinds = append(kinds, n.Kind())
+		}
+		return true
+	})
+	return kinds
+}
+
+func Test_Inspect(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []NodeKind
+	}{
+		{
+			name:  "simple query",
+			query: "sum:metric.name{foo:bar}",
+			want: []NodeKind{
+				KindGenericQuery, KindMetricQuery, KindQuery, KindAggregator, KindMetricFilter,
+				KindParam, KindSimpleFilter, KindFilterSeparator, KindFilterValue, KindValue,
+			},
+		},
+		{
+			name:  "grouped filter and function",
+			query: "sum:metric.name{a:b, (c:d)}.rollup(avg,60)",
+			want: []NodeKind{
+				KindGenericQuery, KindMetricQuery, KindQuery, KindAggregator, KindMetricFilter,
+				KindParam, KindSimpleFilter, KindFilterSeparator, KindFilterValue, KindValue,
+				KindParam, KindFilterValueSeparator,
+				KindParam, KindGroupedFilter, KindParam, KindSimpleFilter, KindFilterSeparator, KindFilterValue, KindValue,
+				KindFunction, KindValue, KindValue,
+			},
+		},
+		{
+			name:  "wrapped query",
+			query: "default_zero(sum:metric.name{*})",
+			want: []NodeKind{
+				KindGenericQuery, KindMetricQuery, KindAggregatorFuction, KindMetricQuery, KindQuery,
+				KindAggregator, KindMetricFilter, KindParam,
+			},
+		},
+		{
+			name:  "expression",
+			query: "default_zero(sum:a{*} + 1) / (sum:b{*})",
+			want: []NodeKind{
+				KindGenericQuery, KindMetricExpression, KindGroupedExpression, KindTerm, KindFactor, KindExprValue,
+				KindExpressionAggregatorFuction, KindGroupedExpression, KindTerm, KindFactor, KindExprValue,
+				KindMetricQuery, KindQuery, KindAggregator, KindMetricFilter, KindParam,
+				KindOpTerm, KindTerm, KindFactor, KindExprValue,
+				KindOpFactor, KindFactor, KindExprValue, KindMetricExpression, KindGroupedExpression, KindTerm,
+				KindFactor, KindExprValue, KindMetricQuery, KindQuery, KindAggregator, KindMetricFilter, KindParam,
+			},
+		},
+	}
+	parser := NewGenericParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, kindsOf(ast))
+		})
+	}
+}
+
+func Test_InspectMonitor(t *testing.T) {
+	ast, err := NewMetricMonitorParser().Parse("avg(last_5m):max:system.disk.in_use{*} by {host} > 1")
+	require.NoError(t, err)
+	assert.Equal(t, []NodeKind{
+		KindMetricMonitor, KindMetricQuery, KindQuery, KindAggregator, KindMetricFilter, KindParam,
+	}, kindsOf(ast))
+}
+
+func Test_NodePosition(t *testing.T) {
+	ast, err := NewMetricQueryParser().Parse("sum:metric.name{foo:bar, baz:bang}")
+	require.NoError(t, err)
+
+	columns := map[string]int{}
+	Inspect(ast, func(n Node) bool {
+		if sf, ok := n.(*SimpleFilter); ok {
+			columns[sf.String()] = sf.Position().Column
+		}
+		return true
+	})
+	assert.Equal(t, map[string]int{"foo:bar": 17, "baz:bang": 26}, columns)
+}
+
+type countingVisitor struct {
+	enter, leave *int
+}
+
+func (v countingVisitor) Visit(node Node) Visitor {
+	if node == nil {
+		*v.leave++
+	} else {
+		*v.enter++
+	}
+	return v
+}
+
+func Test_Walk(t *testing.T) {
+	ast, err := NewMetricQueryParser().Parse("sum:metric.name{foo:bar}")
+	require.NoError(t, err)
+
+	enter, leave := 0, 0
+	Walk(countingVisitor{enter: &enter, leave: &leave}, ast)
+	assert.Equal(t, 9, enter)
+	assert.Equal(t, enter, leave)
+}
+
+func Test_Traverse(t *testing.T) {
+	ast, err := NewMetricExpressionParser().Parse("sum:a{x:y} / sum:b{*}")
+	require.NoError(t, err)
+
+	t.Run("parent tracking", func(t *testing.T) {
+		parents := map[string]NodeKind{}
+		Traverse(ast, func(c *Cursor) bool {
+			if q, ok := c.Node().(*Query); ok {
+				parents[q.MetricName] = c.Parent().Kind()
+				assert.Len(t, c.Ancestors(), c.Depth())
+				assert.Equal(t, Node(ast), c.Ancestors()[0])
+			}
+			return true
+		}, nil)
+		assert.Equal(t, map[string]NodeKind{"a": KindMetricQuery, "b": KindMetricQuery}, parents)
+	})
+
+	t.Run("skip subtree", func(t *testing.T) {
+		visited := []NodeKind{}
+		Traverse(ast, func(c *Cursor) bool {
+			visited = append(visited, c.Node().Kind())
+			return c.Node().Kind() != KindMetricFilter
+		}, nil)
+		assert.NotContains(t, visited, KindParam)
+		assert.Contains(t, visited, KindMetricFilter)
+	})
+
+	t.Run("post order", func(t *testing.T) {
+		order := []string{}
+		Traverse(ast, nil, func(c *Cursor) bool {
+			if q, ok := c.Node().(*Query); ok {
+				order = append(order, q.MetricName)
+			}
+			if c.Node().Kind() == KindOpFactor {
+				order = append(order, "op")
+			}
+			return true
+		})
+		assert.Equal(t, []string{"a", "b", "op"}, order)
+	})
+
+	t.Run("stop traversal", func(t *testing.T) {
+		queries := 0
+		Traverse(ast, nil, func(c *Cursor) bool {
+			if c.Node().Kind() == KindQuery {
+				queries++
+				return false
+			}
+			return true
+		})
+		assert.Equal(t, 1, queries)
+	})
+}
+
+func Test_NodeKindString(t *testing.T) {
+	assert.Equal(t, "SimpleFilter", KindSimpleFilter.String())
+	assert.Equal(t, "NodeKind(999)", NodeKind(999).String())
+}
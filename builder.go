@@ -0,0 +1,668 @@
+package ddqp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// QueryBuilder incrementally constructs a MetricQuery. Builders are mutable:
+// every method modifies the receiver and returns it so calls can be chained.
+//
+//	q, err := ddqp.Metric("system.cpu.user").Sum().
+//		Where(ddqp.Tag("env").Eq("prod")).
+//		And(ddqp.Tag("service").In("web", "api")).
+//		By("host").
+//		AsRate().
+//		Build()
+type QueryBuilder struct {
+	query    *Query
+	wrappers []*AggregatorFuction
+	err      error
+}
+
+// Metric starts a new query for the given metric name. Without a filter the
+// query is scoped to every tag ("{*}").
+func Metric(name string) *QueryBuilder {
+	b := &QueryBuilder{query: &Query{MetricName: name}}
+	if tokenType(name) != "Ident" {
+		b.err = fmt.Errorf("invalid metric name %q", name)
+	}
+	return b
+}
+
+// Aggregate sets the space aggregator, e.g. "sum" or "avg".
+func (b *QueryBuilder) Aggregate(name string) *QueryBuilder {
+	if tokenType(name) != "Ident" {
+		b.setErr(fmt.Errorf("invalid aggregator %q", name))
+	}
+	b.query.Aggregator = &Aggregator{Name: name, Separator: ":"}
+	return b
+}
+
+func (b *QueryBuilder) Sum() *QueryBuilder   { return b.Aggregate("sum") }
+func (b *QueryBuilder) Avg() *QueryBuilder   { return b.Aggregate("avg") }
+func (b *QueryBuilder) Min() *QueryBuilder   { return b.Aggregate("min") }
+func (b *QueryBuilder) Max() *QueryBuilder   { return b.Aggregate("max") }
+func (b *QueryBuilder) Count() *QueryBuilder { return b.Aggregate("count") }
+
+// Where replaces the filter of the query.
+func (b *QueryBuilder) Where(f *FilterBuilder) *QueryBuilder {
+	b.setErr(f.err)
+	b.query.Filters = nil
+	if f.filter != nil {
+		b.query.Filters = f.copyFilter()
+	}
+	return b
+}
+
+// And combines the current filter with f using AND.
+func (b *QueryBuilder) And(f *FilterBuilder) *QueryBuilder {
+	return b.combine(f, (*FilterBuilder).And)
+}
+
+// Or combines the current filter with f using OR.
+func (b *QueryBuilder) Or(f *FilterBuilder) *QueryBuilder {
+	return b.combine(f, (*FilterBuilder).Or)
+}
+
+// AndNot combines the current filter with f using AND NOT.
+func (b *QueryBuilder) AndNot(f *FilterBuilder) *QueryBuilder {
+	return b.combine(f, (*FilterBuilder).AndNot)
+}
+
+// OrNot combines the current filter with f using OR NOT.
+func (b *QueryBuilder) OrNot(f *FilterBuilder) *QueryBuilder {
+	return b.combine(f, (*FilterBuilder).OrNot)
+}
+
+func (b *QueryBuilder) combine(f *FilterBuilder, op func(*FilterBuilder, *FilterBuilder) *FilterBuilder) *QueryBuilder {
+	if b.query.Filters == nil {
+		return b.Where(f)
+	}
+	current := &FilterBuilder{filter: b.query.Filters, joined: filterJoinOf(b.query.Filters)}
+	return b.Where(op(current, f))
+}
+
+// By sets the group-by keys of the query.
+func (b *QueryBuilder) By(keys ...string) *QueryBuilder {
+	for _, k := range keys {
+		if k != "*" && tokenType(k) != "Ident" && tokenType(k) != "TemplateVariable" {
+			b.setErr(fmt.Errorf("invalid group-by key %q", k))
+		}
+	}
+	b.query.Grouping = append(b.query.Grouping, keys...)
+	return b
+}
+
+// Func appends a function call such as ".rollup(avg, 60)" to the query.
+// Arguments may be strings, booleans, or any integer or float type.
+func (b *QueryBuilder) Func(name string, args ...interface{}) *QueryBuilder {
+	if tokenType(name) != "Ident" {
+		b.setErr(fmt.Errorf("invalid function name %q", name))
+	}
+	values, err := valuesFromArgs(args)
+	b.setErr(err)
+	b.query.Function = append(b.query.Function, &Function{Name: name, Args: values})
+	return b
+}
+
+func (b *QueryBuilder) AsRate() *QueryBuilder  { return b.Func("as_rate") }
+func (b *QueryBuilder) AsCount() *QueryBuilder { return b.Func("as_count") }
+
+// Rollup appends ".rollup(method, seconds)".
+func (b *QueryBuilder) Rollup(method string, seconds int) *QueryBuilder {
+	return b.Func("rollup", method, seconds)
+}
+
+// Fill appends ".fill(method)" or ".fill(method, limit)".
+func (b *QueryBuilder) Fill(method string, limit ...int) *QueryBuilder {
+	args := []interface{}{method}
+	for _, l := range limit {
+		args = append(args, l)
+	}
+	return b.Func("fill", args...)
+}
+
+// Wrap wraps the query in a function such as default_zero(...) or
+// moving_rollup(..., 60, 'avg'). Wrappers nest in the order they are added.
+func (b *QueryBuilder) Wrap(name string, args ...interface{}) *QueryBuilder {
+	if tokenType(name) != "Ident" {
+		b.setErr(fmt.Errorf("invalid function name %q", name))
+	}
+	values, err := valuesFromArgs(args)
+	b.setErr(err)
+	b.wrappers = append(b.wrappers, &AggregatorFuction{Name: name, Args: values})
+	return b
+}
+
+// Build returns the constructed query. The returned query is guaranteed to
+// re-parse with NewMetricQueryParser into an identical string.
+func (b *QueryBuilder) Build() (*MetricQuery, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	mq := b.metricQuery()
+	if err := checkRoundTrip(mq, func(s string) (Node, error) { return metricQueryParser.Parse(s) }); err != nil {
+		return nil, err
+	}
+	return mq, nil
+}
+
+// MustBuild is like Build but panics on error.
+func (b *QueryBuilder) MustBuild() *MetricQuery {
+	mq, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return mq
+}
+
+func (b *QueryBuilder) metricQuery() *MetricQuery {
+	q := *b.query
+	q.Grouping = append([]string{}, b.query.Grouping...)
+	q.Function = append([]*Function{}, b.query.Function...)
+	if q.Filters == nil {
+		q.Filters = &MetricFilter{Left: &Param{Asterisk: true}}
+	}
+	if len(q.Grouping) > 0 {
+		q.By = "by"
+	}
+
+	mq := &MetricQuery{Query: &q}
+	for _, w := range b.wrappers {
+		wrapped := *w
+		wrapped.Body = mq
+		mq = &MetricQuery{AggregatorFuction: &wrapped}
+	}
+	return mq
+}
+
+func (b *QueryBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+type filterJoin int
+
+const (
+	joinNone filterJoin = iota
+	joinAnd
+	joinOr
+)
+
+// FilterBuilder constructs the contents of a query's "{...}" filter. Filters
+// are combined with And, Or, AndNot and OrNot; operands are parenthesized as
+// needed so the result keeps the meaning of the calls that produced it.
+type FilterBuilder struct {
+	filter *MetricFilter
+	joined filterJoin
+	err    error
+}
+
+// TagBuilder produces filters on a single tag key.
+type TagBuilder struct {
+	key string
+	err error
+}
+
+// Tag starts a filter on the given tag key.
+func Tag(key string) *TagBuilder {
+	t := &TagBuilder{key: key}
+	if tokenType(key) != "Ident" {
+		t.err = fmt.Errorf("invalid tag key %q", key)
+	}
+	return t
+}
+
+// AnyTag matches every timeseries ("*").
+func AnyTag() *FilterBuilder {
+	return &FilterBuilder{filter: &MetricFilter{Left: &Param{Asterisk: true}}}
+}
+
+// Eq matches key:value. The value may contain wildcards such as "web-*".
+func (t *TagBuilder) Eq(value string) *FilterBuilder {
+	return t.simple(false, &FilterSeparator{Colon: true}, value)
+}
+
+// NotEq matches !key:value.
+func (t *TagBuilder) NotEq(value string) *FilterBuilder {
+	return t.simple(true, &FilterSeparator{Colon: true}, value)
+}
+
+// Gt matches key:>value.
+func (t *TagBuilder) Gt(value float64) *FilterBuilder {
+	return t.simple(false, &FilterSeparator{GreaterThan: true}, formatFloatNoExp(value))
+}
+
+// Gte matches key:>=value.
+func (t *TagBuilder) Gte(value float64) *FilterBuilder {
+	return t.simple(false, &FilterSeparator{GreaterEqual: true}, formatFloatNoExp(value))
+}
+
+// Lt matches key:<value.
+func (t *TagBuilder) Lt(value float64) *FilterBuilder {
+	return t.simple(false, &FilterSeparator{LessThan: true}, formatFloatNoExp(value))
+}
+
+// Lte matches key:<=value.
+func (t *TagBuilder) Lte(value float64) *FilterBuilder {
+	return t.simple(false, &FilterSeparator{LessEqual: true}, formatFloatNoExp(value))
+}
+
+// Regex matches key:~"pattern".
+func (t *TagBuilder) Regex(pattern string) *FilterBuilder {
+	return t.simple(false, &FilterSeparator{Regex: true}, `"`+strings.ReplaceAll(pattern, `"`, `\"`)+`"`)
+}
+
+// In matches key IN (values...).
+func (t *TagBuilder) In(values ...string) *FilterBuilder {
+	return t.list(&FilterSeparator{In: true}, values)
+}
+
+// NotIn matches key NOT IN (values...).
+func (t *TagBuilder) NotIn(values ...string) *FilterBuilder {
+	return t.list(&FilterSeparator{NotIn: true}, values)
+}
+
+func (t *TagBuilder) simple(negative bool, sep *FilterSeparator, value string) *FilterBuilder {
+	v, err := valueFromString(value)
+	if t.err != nil {
+		err = t.err
+	}
+	return &FilterBuilder{
+		err: err,
+		filter: &MetricFilter{Left: &Param{SimpleFilter: &SimpleFilter{
+			Negative:        negative,
+			FilterKey:       t.key,
+			FilterSeparator: sep,
+			FilterValue:     &FilterValue{SimpleValue: v},
+		}}},
+	}
+}
+
+func (t *TagBuilder) list(sep *FilterSeparator, values []string) *FilterBuilder {
+	err := t.err
+	if len(values) == 0 {
+		err = fmt.Errorf("tag %q: list filter requires at least one value", t.key)
+	}
+	list := []*Value{}
+	for i, s := range values {
+		if i > 0 {
+			list = append(list, &Value{Separator: &FilterValueSeparator{Comma: true}})
+		}
+		v, verr := valueFromString(s)
+		if err == nil {
+			err = verr
+		}
+		list = append(list, v)
+	}
+	return &FilterBuilder{
+		err: err,
+		filter: &MetricFilter{Left: &Param{SimpleFilter: &SimpleFilter{
+			FilterKey:       t.key,
+			FilterSeparator: sep,
+			FilterValue:     &FilterValue{ListValue: list},
+		}}},
+	}
+}
+
+// TemplateVar matches a dashboard template variable used as a whole filter,
+// as in "{$env}". The name is given without the leading "$".
+func TemplateVar(name string) *FilterBuilder {
+	f := &FilterBuilder{filter: &MetricFilter{Left: &Param{TemplateVariable: newTemplateVariable("$" + name)}}}
+	if tokenType("$"+name) != "TemplateVariable" {
+		f.err = fmt.Errorf("invalid template variable name %q", name)
+	}
+	return f
+}
+
+// Group parenthesizes f.
+func Group(f *FilterBuilder) *FilterBuilder {
+	return &FilterBuilder{
+		err:    f.err,
+		filter: &MetricFilter{Left: &Param{GroupedFilter: &GroupedFilter{Parameters: f.params()}}},
+	}
+}
+
+// And returns "f AND other".
+func (f *FilterBuilder) And(other *FilterBuilder) *FilterBuilder {
+	return f.join(other, &FilterValueSeparator{And: true}, joinAnd, false)
+}
+
+// Or returns "f OR other".
+func (f *FilterBuilder) Or(other *FilterBuilder) *FilterBuilder {
+	return f.join(other, &FilterValueSeparator{Or: true}, joinOr, false)
+}
+
+// AndNot returns "f AND NOT other".
+func (f *FilterBuilder) AndNot(other *FilterBuilder) *FilterBuilder {
+	return f.join(other, &FilterValueSeparator{AndNot: true}, joinAnd, true)
+}
+
+// OrNot returns "f OR NOT other".
+func (f *FilterBuilder) OrNot(other *FilterBuilder) *FilterBuilder {
+	return f.join(other, &FilterValueSeparator{OrNot: true}, joinOr, true)
+}
+
+// String renders the filter without the surrounding braces.
+func (f *FilterBuilder) String() string {
+	if f.filter == nil {
+		return ""
+	}
+	return f.filter.String()
+}
+
+func (f *FilterBuilder) join(other *FilterBuilder, sep *FilterValueSeparator, join filterJoin, negated bool) *FilterBuilder {
+	left := f
+	if left.joined != joinNone && left.joined != join {
+		left = Group(left)
+	}
+	right := other
+	if right.joined != joinNone && (negated || right.joined != join) {
+		right = Group(right)
+	}
+
+	params := append(left.params(), &Param{Separator: sep})
+	params = append(params, right.params()...)
+
+	err := f.err
+	if err == nil {
+		err = other.err
+	}
+	return &FilterBuilder{
+		err:    err,
+		joined: join,
+		filter: &MetricFilter{Left: params[0], Parameters: params[1:]},
+	}
+}
+
+func (f *FilterBuilder) params() []*Param {
+	if f.filter == nil {
+		return nil
+	}
+	return append([]*Param{f.filter.Left}, f.filter.Parameters...)
+}
+
+func (f *FilterBuilder) copyFilter() *MetricFilter {
+	params := f.params()
+	return &MetricFilter{Left: params[0], Parameters: params[1:]}
+}
+
+// filterJoinOf reports how the top level of an existing filter is joined.
+func filterJoinOf(mf *MetricFilter) filterJoin {
+	join := joinNone
+	for _, p := range mf.Parameters {
+		if p.Separator == nil {
+			continue
+		}
+		if p.Separator.Or || p.Separator.OrNot {
+			return joinOr
+		}
+		join = joinAnd
+	}
+	return join
+}
+
+// Operand is anything that can appear in an arithmetic expression: a
+// *QueryBuilder, an *ExpressionBuilder, or a number created with Num.
+type Operand interface {
+	exprValue() (*ExprValue, error)
+}
+
+func (b *QueryBuilder) exprValue() (*ExprValue, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return &ExprValue{MetricQuery: b.metricQuery()}, nil
+}
+
+type number float64
+
+// Num returns a numeric constant operand.
+func Num(v float64) Operand {
+	return number(v)
+}
+
+func (n number) exprValue() (*ExprValue, error) {
+	f := float64(n)
+	return &ExprValue{Number: &f}, nil
+}
+
+type reference string
+
+// Ref returns an operand referring to a formula sub-query by name.
+func Ref(name string) Operand {
+	return reference(name)
+}
+
+func (r reference) exprValue() (*ExprValue, error) {
+	ref := QueryReference(r)
+	if !ref.valid() {
+		return nil, fmt.Errorf("invalid query reference %q", string(r))
+	}
+	return &ExprValue{Reference: &ref}, nil
+}
+
+// ExpressionBuilder constructs a MetricExpression combining several queries
+// and constants with arithmetic. Operator precedence is handled by adding
+// parentheses so that, for example, Expr(a).Add(b).Div(c) yields "(a + b) / c".
+// A builder may be changed after it was used as an operand or built; the
+// expressions it is part of are left as they were.
+type ExpressionBuilder struct {
+	expr *GroupedExpression
+	err  error
+}
+
+// Expr starts an expression from a single operand.
+func Expr(operand Operand) *ExpressionBuilder {
+	e := &ExpressionBuilder{}
+	v, err := operand.exprValue()
+	if err != nil {
+		e.err = err
+		return e
+	}
+	e.expr = &GroupedExpression{Left: &Term{Left: &Factor{Base: v}}}
+	return e
+}
+
+func (e *ExpressionBuilder) Add(operand Operand) *ExpressionBuilder { return e.addTerm(OpAdd, operand) }
+func (e *ExpressionBuilder) Sub(operand Operand) *ExpressionBuilder { return e.addTerm(OpSub, operand) }
+func (e *ExpressionBuilder) Mul(operand Operand) *ExpressionBuilder {
+	return e.addFactor(OpMul, operand)
+}
+func (e *ExpressionBuilder) Div(operand Operand) *ExpressionBuilder {
+	return e.addFactor(OpDiv, operand)
+}
+
+// Wrap wraps the whole expression in a function such as default_zero(...).
+func (e *ExpressionBuilder) Wrap(name string, args ...interface{}) *ExpressionBuilder {
+	if e.err != nil {
+		return e
+	}
+	if tokenType(name) != "Ident" {
+		e.err = fmt.Errorf("invalid function name %q", name)
+		return e
+	}
+	values, err := valuesFromArgs(args)
+	if err != nil {
+		e.err = err
+		return e
+	}
+	fn := &ExpressionAggregatorFuction{Name: name, Body: e.expr, Args: values}
+	e.expr = &GroupedExpression{Left: &Term{Left: &Factor{Base: &ExprValue{ExprAggregatorFuction: fn}}}}
+	return e
+}
+
+// Build returns the constructed expression. The returned expression is
+// guaranteed to re-parse with NewMetricExpressionParser or, if it uses Ref,
+// as a formula.
+func (e *ExpressionBuilder) Build() (*MetricExpression, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	me := &MetricExpression{GroupedExpression: e.expr}
+	if err := checkRoundTrip(me, func(s string) (Node, error) { return formulaParser.Parse(s) }); err != nil {
+		return nil, err
+	}
+	return me, nil
+}
+
+// MustBuild is like Build but panics on error.
+func (e *ExpressionBuilder) MustBuild() *MetricExpression {
+	me, err := e.Build()
+	if err != nil {
+		panic(err)
+	}
+	return me
+}
+
+func (e *ExpressionBuilder) exprValue() (*ExprValue, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	if len(e.expr.Right) == 0 && len(e.expr.Left.Right) == 0 {
+		return e.expr.Left.Left.Base, nil
+	}
+	return &ExprValue{Subexpression: &MetricExpression{GroupedExpression: e.expr}}, nil
+}
+
+func (e *ExpressionBuilder) addTerm(op Operator, operand Operand) *ExpressionBuilder {
+	if e.err != nil {
+		return e
+	}
+	e.own()
+	if other, ok := operand.(*ExpressionBuilder); ok && other.err == nil && (op == OpAdd || len(other.expr.Right) == 0) {
+		// a + (b - c) and a - (b * c) need no parentheses
+		e.expr.Right = append(e.expr.Right, &OpTerm{Operator: op, Term: other.expr.Left})
+		e.expr.Right = append(e.expr.Right, other.expr.Right...)
+		return e
+	}
+	v, err := operand.exprValue()
+	if err != nil {
+		e.err = err
+		return e
+	}
+	e.expr.Right = append(e.expr.Right, &OpTerm{Operator: op, Term: &Term{Left: &Factor{Base: v}}})
+	return e
+}
+
+func (e *ExpressionBuilder) addFactor(op Operator, operand Operand) *ExpressionBuilder {
+	if e.err != nil {
+		return e
+	}
+	v, err := operand.exprValue()
+	if err != nil {
+		e.err = err
+		return e
+	}
+	if len(e.expr.Right) > 0 {
+		e.expr = &GroupedExpression{Left: &Term{Left: &Factor{Base: &ExprValue{
+			Subexpression: &MetricExpression{GroupedExpression: e.expr},
+		}}}}
+	}
+	e.own()
+	e.expr.Left.Right = append(e.expr.Left.Right, &OpFactor{Operator: op, Factor: &Factor{Base: v}})
+	return e
+}
+
+// own copies the nodes that Add, Sub, Mul and Div change, so that the
+// expressions e.expr was used in or built into keep their operands. Nodes
+// below them are shared, as the builder never changes them.
+func (e *ExpressionBuilder) own() {
+	expr := *e.expr
+	left := *expr.Left
+	left.Right = append([]*OpFactor{}, left.Right...)
+	expr.Left = &left
+	expr.Right = append([]*OpTerm{}, expr.Right...)
+	e.expr = &expr
+}
+
+// checkRoundTrip verifies that a built node re-parses into the same string.
+func checkRoundTrip(n Node, parse func(string) (Node, error)) error {
+	s := n.String()
+	parsed, err := parse(s)
+	if err != nil {
+		return fmt.Errorf("built query %q does not parse: %w", s, err)
+	}
+	if parsed.String() != s {
+		return fmt.Errorf("built query %q re-parses as %q", s, parsed.String())
+	}
+	return nil
+}
+
+var lexSymbols = lexer.SymbolsByRune(lex)
+
+// tokenType returns the lexer rule that matches the whole of s, or "" when s
+// does not lex as exactly one token.
+func tokenType(s string) string {
+	l, err := lex.LexString("", s)
+	if err != nil {
+		return ""
+	}
+	tokens, err := lexer.ConsumeAll(l)
+	if err != nil || len(tokens) != 2 {
+		return ""
+	}
+	return lexSymbols[tokens[0].Type]
+}
+
+// valueFromString builds the Value the parser would produce for s.
+func valueFromString(s string) (*Value, error) {
+	v := s
+	switch tokenType(s) {
+	case "Ident":
+		if s == "true" || s == "false" {
+			b := Bool(s == "true")
+			return &Value{Boolean: &b}, nil
+		}
+		return &Value{Identifier: &v}, nil
+	case "FilterIdent":
+		return &Value{Wildcard: &v}, nil
+	case "TemplateVariable":
+		return &Value{TemplateVariable: newTemplateVariable(s)}, nil
+	case "String":
+		return &Value{Str: &v}, nil
+	case "Float", "Int":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{Number: &f}, nil
+	case "Punct":
+		if s == "*" {
+			return &Value{Wildcard: &v}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q", s)
+}
+
+func valuesFromArgs(args []interface{}) ([]*Value, error) {
+	values := []*Value{}
+	for _, arg := range args {
+		var s string
+		switch a := arg.(type) {
+		case string:
+			s = a
+		case bool:
+			s = fmt.Sprintf("%v", a)
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			s = fmt.Sprintf("%d", a)
+		case float32:
+			s = formatFloatNoExp(float64(a))
+		case float64:
+			s = formatFloatNoExp(a)
+		default:
+			return nil, fmt.Errorf("unsupported argument type %T", arg)
+		}
+		v, err := valueFromString(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,228 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_QueryBuilder(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *QueryBuilder
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "metric only",
+			builder: Metric("system.cpu.user"),
+			want:    "system.cpu.user{*}",
+		},
+		{
+			name:    "aggregator and simple filter",
+			builder: Metric("system.cpu.user").Sum().Where(Tag("env").Eq("prod")),
+			want:    "sum:system.cpu.user{env:prod}",
+		},
+		{
+			name: "full chain",
+			builder: Metric("system.cpu.user").Sum().
+				Where(Tag("env").Eq("prod")).
+				And(Tag("host").Eq("web-*")).
+				By("host", "env").
+				AsRate().
+				Rollup("avg", 60),
+			want: "sum:system.cpu.user{env:prod AND host:web-*} by {host,env}.as_rate().rollup(avg,60)",
+		},
+		{
+			name: "or of and is grouped",
+			builder: Metric("m").Avg().
+				Where(Tag("a").Eq("b")).
+				And(Tag("c").Eq("d")).
+				Or(Tag("e").Eq("f")),
+			want: "avg:m{(a:b AND c:d) OR e:f}",
+		},
+		{
+			name: "and of or operand is grouped",
+			builder: Metric("m").Avg().
+				Where(Tag("a").Eq("b").And(Tag("c").Eq("d").Or(Tag("e").Eq("f")))),
+			want: "avg:m{a:b AND (c:d OR e:f)}",
+		},
+		{
+			name: "negations and comparisons",
+			builder: Metric("m").Max().
+				Where(Tag("env").NotEq("dev")).
+				AndNot(Tag("region").In("us-east-1", "us-west-2")).
+				Or(Tag("duration").Gte(100)).
+				And(Tag("errors").Lt(0.5)),
+			want: "max:m{((!env:dev AND NOT region IN (us-east-1, us-west-2)) OR duration:>=100) AND errors:<0.5}",
+		},
+		{
+			name:    "not in and regex",
+			builder: Metric("m").Sum().Where(Tag("region").NotIn("a", "b").And(Tag("host").Regex("web-.*"))),
+			want:    `sum:m{region NOT IN (a, b) AND host:~"web-.*"}`,
+		},
+		{
+			name:    "any tag and functions",
+			builder: Metric("m").Count().Where(AnyTag()).AsCount().Fill("zero").Func("label", `"requests"`),
+			want:    `count:m{*}.as_count().fill(zero).label("requests")`,
+		},
+		{
+			name:    "wrappers",
+			builder: Metric("m").Sum().AsRate().Wrap("default_zero").Wrap("moving_rollup", 60, "'avg'"),
+			want:    "moving_rollup(default_zero(sum:m{*}.as_rate()), 60, 'avg')",
+		},
+		{
+			name:    "invalid metric name",
+			builder: Metric("bad metric"),
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag value",
+			builder: Metric("m").Where(Tag("env").Eq("two words")),
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag key",
+			builder: Metric("m").Where(Tag("!env").Eq("prod")),
+			wantErr: true,
+		},
+		{
+			name:    "invalid group key",
+			builder: Metric("m").By("a b"),
+			wantErr: true,
+		},
+		{
+			name:    "empty list",
+			builder: Metric("m").Where(Tag("env").In()),
+			wantErr: true,
+		},
+	}
+	parser := NewMetricQueryParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mq, err := tt.builder.Build()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, mq.String())
+
+			parsed, err := parser.Parse(mq.String())
+			require.NoError(t, err)
+			assert.Equal(t, mq.String(), parsed.String())
+		})
+	}
+}
+
+func Test_ExpressionBuilder(t *testing.T) {
+	a := func() *QueryBuilder { return Metric("a").Sum() }
+	b := func() *QueryBuilder { return Metric("b").Sum() }
+	c := func() *QueryBuilder { return Metric("c").Sum() }
+
+	tests := []struct {
+		name    string
+		builder *ExpressionBuilder
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "single operand",
+			builder: Expr(a()),
+			want:    "sum:a{*}",
+		},
+		{
+			name:    "addition",
+			builder: Expr(a()).Add(b()),
+			want:    "sum:a{*} + sum:b{*}",
+		},
+		{
+			name:    "percentage",
+			builder: Expr(a()).Div(b()).Mul(Num(100)),
+			want:    "sum:a{*} / sum:b{*} * 100",
+		},
+		{
+			name:    "sum then divide is parenthesized",
+			builder: Expr(a()).Add(b()).Div(c()),
+			want:    "(sum:a{*} + sum:b{*}) / sum:c{*}",
+		},
+		{
+			name:    "divide by compound expression",
+			builder: Expr(a()).Div(Expr(b()).Sub(c())),
+			want:    "sum:a{*} / (sum:b{*} - sum:c{*})",
+		},
+		{
+			name:    "subtract compound expression",
+			builder: Expr(a()).Sub(Expr(b()).Add(c())),
+			want:    "sum:a{*} - (sum:b{*} + sum:c{*})",
+		},
+		{
+			name:    "add compound expression",
+			builder: Expr(a()).Add(Expr(b()).Sub(c())),
+			want:    "sum:a{*} + sum:b{*} - sum:c{*}",
+		},
+		{
+			name:    "wrapped expression",
+			builder: Expr(a()).Add(b()).Wrap("default_zero").Mul(Num(0.5)),
+			want:    "default_zero(sum:a{*} + sum:b{*}) * 0.5",
+		},
+		{
+			name:    "formula over named queries",
+			builder: Expr(Ref("errors")).Div(Ref("hits")).Mul(Num(100)),
+			want:    "errors / hits * 100",
+		},
+		{
+			name:    "invalid query reference",
+			builder: Expr(Ref("2xx")).Div(a()),
+			wantErr: true,
+		},
+		{
+			name:    "query builder errors propagate",
+			builder: Expr(a()).Add(Metric("bad name")),
+			wantErr: true,
+		},
+	}
+	parser := NewMetricExpressionParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me, err := tt.builder.Build()
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, me.String())
+
+			p := parser
+			if len(queryReferences(me)) > 0 {
+				p = newFormulaParser()
+			}
+			parsed, err := p.Parse(me.String())
+			require.NoError(t, err)
+			assert.Equal(t, me.String(), parsed.String())
+		})
+	}
+}
+
+func Test_ExpressionBuilderOperandsAreCopied(t *testing.T) {
+	b := Expr(Metric("b").Sum())
+	e := Expr(Metric("a").Sum()).Sub(b)
+	c := Expr(Metric("c").Sum()).Add(Expr(Metric("d").Sum()).Sub(Num(1)))
+	f := Expr(Metric("f").Sum()).Div(b)
+	built := c.MustBuild()
+
+	b.Mul(Num(2)).Add(Num(3))
+	c.Mul(Num(4))
+
+	assert.Equal(t, "sum:a{*} - sum:b{*}", e.MustBuild().String())
+	assert.Equal(t, "sum:f{*} / sum:b{*}", f.MustBuild().String())
+	assert.Equal(t, "sum:c{*} + sum:d{*} - 1", built.String())
+	assert.Equal(t, "sum:b{*} * 2 + 3", b.MustBuild().String())
+	assert.Equal(t, "(sum:c{*} + sum:d{*} - 1) * 4", c.MustBuild().String())
+}
+
+func Test_QueryBuilderMustBuildPanics(t *testing.T) {
+	assert.Panics(t, func() { Metric("bad name").MustBuild() })
+	assert.NotPanics(t, func() { Metric("m").MustBuild() })
+}
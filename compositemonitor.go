@@ -0,0 +1,346 @@
+package ddqp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// compositeLex is the lexer for composite monitor expressions.
+var compositeLex = lexer.MustSimple([]lexer.SimpleRule{
+	{Name: "MonitorID", Pattern: `\d+`},
+	{Name: "Operator", Pattern: `&&|\|\|`},
+	{Name: "Punct", Pattern: `[!()]`},
+	{Name: "whitespace", Pattern: `\s+`},
+})
+
+// CompositeMonitor is a boolean expression over monitor IDs, such as
+// "12345 && (67890 || !13579)". && binds tighter than ||.
+type CompositeMonitor struct {
+	Pos lexer.Position
+
+	Expression *CompositeOr `parser:"@@"`
+}
+
+// CompositeOr is a list of alternatives separated by ||.
+type CompositeOr struct {
+	Pos lexer.Position
+
+	Left  *CompositeAnd   `parser:"@@"`
+	Right []*CompositeAnd `parser:"( '||' @@ )*"`
+}
+
+// CompositeAnd is a list of operands separated by &&.
+type CompositeAnd struct {
+	Pos lexer.Position
+
+	Left  *CompositeUnary   `parser:"@@"`
+	Right []*CompositeUnary `parser:"( '&&' @@ )*"`
+}
+
+// CompositeUnary is an operand, possibly negated with "!".
+type CompositeUnary struct {
+	Pos lexer.Position
+
+	Negated bool           `parser:"@'!'?"`
+	Term    *CompositeTerm `parser:"@@"`
+}
+
+// CompositeTerm is a monitor reference or a parenthesized expression.
+type CompositeTerm struct {
+	Pos lexer.Position
+
+	Group     *CompositeOr `parser:"  '(' @@ ')'"`
+	MonitorID int64        `parser:"| @MonitorID"`
+}
+
+func (cm *CompositeMonitor) String() string {
+	return cm.Expression.String()
+}
+
+func (co *CompositeOr) String() string {
+	out := []string{co.Left.String()}
+	for _, r := range co.Right {
+		out = append(out, r.String())
+	}
+	return strings.Join(out, " || ")
+}
+
+func (ca *CompositeAnd) String() string {
+	out := []string{ca.Left.String()}
+	for _, r := range ca.Right {
+		out = append(out, r.String())
+	}
+	return strings.Join(out, " && ")
+}
+
+func (cu *CompositeUnary) String() string {
+	if cu.Negated {
+		return "!" + cu.Term.String()
+	}
+	return cu.Term.String()
+}
+
+func (ct *CompositeTerm) String() string {
+	if ct.Group != nil {
+		return "(" + ct.Group.String() + ")"
+	}
+	return strconv.FormatInt(ct.MonitorID, 10)
+}
+
+// MonitorIDs returns the referenced monitor IDs in the order they first
+// appear.
+func (cm *CompositeMonitor) MonitorIDs() []int64 {
+	ids := []int64{}
+	seen := map[int64]bool{}
+	Inspect(cm, func(n Node) bool {
+		if ct, ok := n.(*CompositeTerm); ok && ct.Group == nil && !seen[ct.MonitorID] {
+			seen[ct.MonitorID] = true
+			ids = append(ids, ct.MonitorID)
+		}
+		return true
+	})
+	return ids
+}
+
+func (cm *CompositeMonitor) Position() lexer.Position { return cm.Pos }
+func (cm *CompositeMonitor) Kind() NodeKind           { return KindCompositeMonitor }
+
+func (cm *CompositeMonitor) Children() []Node {
+	if cm.Expression != nil {
+		return []Node{cm.Expression}
+	}
+	return nil
+}
+
+func (co *CompositeOr) Position() lexer.Position { return co.Pos }
+func (co *CompositeOr) Kind() NodeKind           { return KindCompositeOr }
+
+func (co *CompositeOr) Children() []Node {
+	nodes := []Node{}
+	if co.Left != nil {
+		nodes = append(nodes, co.Left)
+	}
+	for _, r := range co.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (ca *CompositeAnd) Position() lexer.Position { return ca.Pos }
+func (ca *CompositeAnd) Kind() NodeKind           { return KindCompositeAnd }
+
+func (ca *CompositeAnd) Children() []Node {
+	nodes := []Node{}
+	if ca.Left != nil {
+		nodes = append(nodes, ca.Left)
+	}
+	for _, r := range ca.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (cu *CompositeUnary) Position() lexer.Position { return cu.Pos }
+func (cu *CompositeUnary) Kind() NodeKind           { return KindCompositeUnary }
+
+func (cu *CompositeUnary) Children() []Node {
+	if cu.Term != nil {
+		return []Node{cu.Term}
+	}
+	return nil
+}
+
+func (ct *CompositeTerm) Position() lexer.Position { return ct.Pos }
+func (ct *CompositeTerm) Kind() NodeKind           { return KindCompositeTerm }
+
+func (ct *CompositeTerm) Children() []Node {
+	if ct.Group != nil {
+		return []Node{ct.Group}
+	}
+	return nil
+}
+
+// NewCompositeMonitorParser returns a Parser which is capable of
+// interpretting a composite monitor expression.
+func NewCompositeMonitorParser() *CompositeMonitorParser {
+	cmp := &CompositeMonitorParser{
+		parser: participle.MustBuild[CompositeMonitor](
+			participle.Lexer(compositeLex),
+		),
+	}
+
+	return cmp
+}
+
+var compositeMonitorParser = NewCompositeMonitorParser()
+
+// CompositeMonitorParser is parser returned when calling
+// NewCompositeMonitorParser.
+type CompositeMonitorParser struct {
+	parser *participle.Parser[CompositeMonitor]
+}
+
+// Parse returns the AST of a composite monitor expression. Newlines are
+// treated as whitespace. Invalid input is reported as a *ParseError.
+func (cmp *CompositeMonitorParser) Parse(query string) (*CompositeMonitor, error) {
+	ast, err := cmp.parser.ParseString("", query)
+	if err != nil {
+		return nil, newParseErrorAt(query, err, inputPosition)
+	}
+	return ast, nil
+}
+
+// MonitorLookup returns the query of the monitor with the given ID.
+type MonitorLookup func(id int64) (string, error)
+
+// ResolvedMonitor is a monitor referenced by a composite monitor.
+type ResolvedMonitor struct {
+	ID    int64
+	Query string
+	// Monitor is the parsed query, e.g. a *MetricMonitor, *LogMonitor,
+	// *EventMonitor, *ProcessMonitor, *ServiceCheckMonitor or
+	// *CompositeMonitor.
+	Monitor Node
+}
+
+// UnresolvedMonitor is a reference that could not be looked up or parsed.
+type UnresolvedMonitor struct {
+	ID  int64
+	Err error
+}
+
+// CompositeResolution is the result of ResolveComposite.
+type CompositeResolution struct {
+	// Monitors holds every monitor that was looked up and parsed, including
+	// those referenced by nested composite monitors.
+	Monitors map[int64]*ResolvedMonitor
+	// Unresolved lists the references that failed, in the order they were
+	// visited.
+	Unresolved []*UnresolvedMonitor
+	// Cycles lists loops between composite monitors. Each cycle is the IDs
+	// along the loop, ending with the ID it started from.
+	Cycles [][]int64
+}
+
+// Err summarizes the unresolved references and cycles, or returns nil when
+// there are none.
+func (cr *CompositeResolution) Err() error {
+	problems := []string{}
+	for _, u := range cr.Unresolved {
+		problems = append(problems, fmt.Sprintf("monitor %d: %v", u.ID, u.Err))
+	}
+	for _, cycle := range cr.Cycles {
+		ids := []string{}
+		for _, id := range cycle {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		problems = append(problems, "cycle: "+strings.Join(ids, " -> "))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("composite monitor cannot be resolved: %s", strings.Join(problems, "; "))
+}
+
+// ResolveComposite looks up every monitor referenced by cm, directly or
+// through nested composite monitors, and parses it with the matching parser.
+func ResolveComposite(cm *CompositeMonitor, lookup MonitorLookup) *CompositeResolution {
+	r := &compositeResolver{
+		lookup: lookup,
+		result: &CompositeResolution{Monitors: map[int64]*ResolvedMonitor{}},
+		state:  map[int64]int{},
+	}
+	for _, id := range cm.MonitorIDs() {
+		r.visit(id)
+	}
+	return r.result
+}
+
+// states of a monitor during resolution
+const (
+	resolveUnvisited = iota
+	resolveVisiting
+	resolveDone
+)
+
+type compositeResolver struct {
+	lookup MonitorLookup
+	result *CompositeResolution
+	state  map[int64]int
+	path   []int64
+}
+
+func (r *compositeResolver) visit(id int64) {
+	switch r.state[id] {
+	case resolveDone:
+		return
+	case resolveVisiting:
+		for i, p := range r.path {
+			if p == id {
+				cycle := append(append([]int64{}, r.path[i:]...), id)
+				r.result.Cycles = append(r.result.Cycles, cycle)
+				return
+			}
+		}
+		return
+	}
+
+	r.state[id] = resolveVisiting
+	r.path = append(r.path, id)
+	defer func() {
+		r.state[id] = resolveDone
+		r.path = r.path[:len(r.path)-1]
+	}()
+
+	query, err := r.lookup(id)
+	if err != nil {
+		r.result.Unresolved = append(r.result.Unresolved, &UnresolvedMonitor{ID: id, Err: err})
+		return
+	}
+	monitor, err := parseMonitorQuery(query)
+	if err != nil {
+		r.result.Unresolved = append(r.result.Unresolved, &UnresolvedMonitor{ID: id, Err: err})
+		return
+	}
+	r.result.Monitors[id] = &ResolvedMonitor{ID: id, Query: query, Monitor: monitor}
+
+	if nested, ok := monitor.(*CompositeMonitor); ok {
+		for _, ref := range nested.MonitorIDs() {
+			r.visit(ref)
+		}
+	}
+}
+
+var compositeQueryPattern = regexp.MustCompile(`^[\d\s()!&|]+$`)
+
+// parseMonitorQuery parses a monitor query with the parser matching its
+// form.
+func parseMonitorQuery(query string) (Node, error) {
+	trimmed := strings.TrimSpace(query)
+	switch {
+	case compositeQueryPattern.MatchString(trimmed):
+		return nodeOrError(compositeMonitorParser.Parse(query))
+	case strings.HasPrefix(trimmed, "logs("):
+		return nodeOrError(logMonitorParser.Parse(query))
+	case strings.HasPrefix(trimmed, "events("):
+		return nodeOrError(eventMonitorParser.Parse(query))
+	case strings.HasPrefix(trimmed, "processes("):
+		return nodeOrError(processMonitorParser.Parse(query))
+	case strings.HasPrefix(trimmed, `"`):
+		return nodeOrError(serviceCheckMonitorParser.Parse(query))
+	}
+	return nodeOrError(metricMonitorParser.Parse(query))
+}
+
+// nodeOrError keeps a failed parse from returning a typed nil Node.
+func nodeOrError[T Node](node T, err error) (Node, error) {
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
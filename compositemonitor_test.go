@@ -0,0 +1,108 @@
+package ddqp
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CompositeMonitor(t *testing.T) {
+	parser := NewCompositeMonitorParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "single monitor", query: "12345"},
+		{name: "and", query: "12345 && 67890"},
+		{name: "request example", query: "12345 && (67890 || !13579)"},
+		{name: "negated group", query: "!(1 || 2) && 3"},
+		{name: "dangling operator", query: "12345 &&", wantErr: true},
+		{name: "single ampersand", query: "12345 & 67890", wantErr: true},
+		{name: "unbalanced parenthesis", query: "(12345 || 67890", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, ast.String())
+		})
+	}
+}
+
+func Test_CompositeMonitorStructure(t *testing.T) {
+	cm, err := NewCompositeMonitorParser().Parse("12345 && (67890 || !13579) && 12345")
+	require.NoError(t, err)
+	assert.Equal(t, []int64{12345, 67890, 13579}, cm.MonitorIDs())
+
+	and := cm.Expression.Left
+	require.Len(t, and.Right, 2)
+	assert.Equal(t, int64(12345), and.Left.Term.MonitorID)
+
+	group := and.Right[0].Term.Group
+	require.NotNil(t, group)
+	require.Len(t, group.Right, 1)
+	assert.True(t, group.Right[0].Left.Negated)
+	assert.Equal(t, int64(13579), group.Right[0].Left.Term.MonitorID)
+}
+
+func Test_ResolveComposite(t *testing.T) {
+	monitors := map[int64]string{
+		1: "avg(last_5m):sum:errors{*} > 10",
+		2: `logs("status:error").last("5m") > 100`,
+		3: `"http.can_connect".over("*").last(3).count_by_status()`,
+		4: "1 && 5",
+		5: "4 || 2",
+		6: "avg(last_5m):sum:errors{ > 10",
+	}
+	lookup := func(id int64) (string, error) {
+		if q, ok := monitors[id]; ok {
+			return q, nil
+		}
+		return "", fmt.Errorf("monitor not found")
+	}
+
+	t.Run("resolved", func(t *testing.T) {
+		cm, err := NewCompositeMonitorParser().Parse("1 && (2 || !3)")
+		require.NoError(t, err)
+
+		res := ResolveComposite(cm, lookup)
+		require.NoError(t, res.Err())
+		require.Len(t, res.Monitors, 3)
+		assert.IsType(t, &MetricMonitor{}, res.Monitors[1].Monitor)
+		assert.IsType(t, &LogMonitor{}, res.Monitors[2].Monitor)
+		assert.IsType(t, &ServiceCheckMonitor{}, res.Monitors[3].Monitor)
+		assert.Equal(t, monitors[2], res.Monitors[2].Query)
+	})
+
+	t.Run("unresolved", func(t *testing.T) {
+		cm, err := NewCompositeMonitorParser().Parse("1 && 99 && 6")
+		require.NoError(t, err)
+
+		res := ResolveComposite(cm, lookup)
+		require.Len(t, res.Unresolved, 2)
+		assert.Equal(t, int64(99), res.Unresolved[0].ID)
+		assert.EqualError(t, res.Unresolved[0].Err, "monitor not found")
+		assert.Equal(t, int64(6), res.Unresolved[1].ID)
+		assert.IsType(t, &ParseError{}, res.Unresolved[1].Err)
+		assert.Contains(t, res.Err().Error(), "monitor 99: monitor not found")
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		cm, err := NewCompositeMonitorParser().Parse("4 && 3")
+		require.NoError(t, err)
+
+		res := ResolveComposite(cm, lookup)
+		assert.Empty(t, res.Unresolved)
+		assert.Equal(t, [][]int64{{4, 5, 4}}, res.Cycles)
+		assert.IsType(t, &CompositeMonitor{}, res.Monitors[5].Monitor)
+		assert.Contains(t, res.Err().Error(), "cycle: 4 -> 5 -> 4")
+	})
+}
@@ -0,0 +1,54 @@
+package ddqp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Condition is the comparison a monitor alerts on, such as "> 5" or
+// ">= 1e6". It is embedded in every monitor type that ends with one, so
+// monitor.Comparator and monitor.Threshold work as before.
+type Condition struct {
+	// Comparator is one of ">", ">=", "<", "<=", "==" or "!=".
+	Comparator string `parser:"@( '>' '=' | '<' '=' | '=' '=' | '!' '=' | '>' | '<' )"`
+	// ThresholdLiteral is the threshold as written, e.g. "1e6" or "-5". It is
+	// kept so that String round-trips.
+	ThresholdLiteral string `parser:"@( ('+' | '-')? (Ident | FilterIdent | Float | Int) Float? )"`
+	// Threshold is the numeric value of ThresholdLiteral. It is filled in by
+	// Parse; monitors built by hand only need to set Threshold.
+	Threshold float64
+}
+
+// String returns the comparator and threshold, e.g. "> 5".
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %s", c.Comparator, literalString(c.ThresholdLiteral, c.Threshold))
+}
+
+// resolve fills in Threshold from ThresholdLiteral, reporting an invalid
+// literal as a *ParseError for query.
+func (c *Condition) resolve(query, sanitized string) error {
+	value, err := parseThreshold(c.ThresholdLiteral)
+	if err != nil {
+		pos := lexer.Position{Offset: strings.LastIndex(sanitized, c.ThresholdLiteral)}
+		return newParseError(query, participle.Errorf(pos, "invalid threshold %q", c.ThresholdLiteral))
+	}
+	c.Threshold = value
+	return nil
+}
+
+// literalString returns literal unless value was changed after parsing, in
+// which case value is written without an exponent.
+func literalString(literal string, value float64) string {
+	if v, err := parseThreshold(literal); err == nil && v == value {
+		return literal
+	}
+	return formatFloatNoExp(value)
+}
+
+func parseThreshold(literal string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimPrefix(literal, "+"), 64)
+}
@@ -0,0 +1,1129 @@
+package ddqp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaVersion is the version of the JSON/YAML schema written by the
+// MarshalJSON and MarshalYAML methods of the parsed query types. Documents
+// with a newer version are rejected when unmarshalling.
+//
+// A document is an envelope holding exactly one of "metric_query",
+// "metric_expression" or "metric_monitor" next to the schema version and the
+// informational "source" text:
+//
+//	{
+//	  "version": 1,
+//	  "source": "sum:system.cpu.user{env:prod} by {host}",
+//	  "metric_query": {
+//	    "aggregator": {"name": "sum"},
+//	    "metric": "system.cpu.user",
+//	    "filter": [{"tag": {"key": "env", "op": ":", "value": {"identifier": "prod"}}}],
+//	    "group_by": ["host"]
+//	  }
+//	}
+//
+// When the body is omitted, the source text is parsed instead. Positions are
+// not serialized; unmarshalled ASTs carry the positions of their String form.
+const SchemaVersion = 1
+
+type document struct {
+	Version          int               `json:"version" yaml:"version"`
+	Source           string            `json:"source,omitempty" yaml:"source,omitempty"`
+	MetricQuery      *metricQueryDoc   `json:"metric_query,omitempty" yaml:"metric_query,omitempty"`
+	MetricExpression *expressionDoc    `json:"metric_expression,omitempty" yaml:"metric_expression,omitempty"`
+	MetricMonitor    *metricMonitorDoc `json:"metric_monitor,omitempty" yaml:"metric_monitor,omitempty"`
+}
+
+// metricQueryDoc is either a plain query or a wrapper function such as
+// "top(query, 10, 'mean', 'desc')".
+type metricQueryDoc struct {
+	Wrapper    *wrapperDoc    `json:"wrapper,omitempty" yaml:"wrapper,omitempty"`
+	Aggregator *aggregatorDoc `json:"aggregator,omitempty" yaml:"aggregator,omitempty"`
+	Metric     string         `json:"metric,omitempty" yaml:"metric,omitempty"`
+	Filter     []filterDoc    `json:"filter,omitempty" yaml:"filter,omitempty"`
+	GroupBy    []string       `json:"group_by,omitempty" yaml:"group_by,omitempty"`
+	Functions  []functionDoc  `json:"functions,omitempty" yaml:"functions,omitempty"`
+}
+
+type wrapperDoc struct {
+	Name  string          `json:"name" yaml:"name"`
+	Query *metricQueryDoc `json:"query" yaml:"query"`
+	Args  []valueDoc      `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+type aggregatorDoc struct {
+	Name      string `json:"name" yaml:"name"`
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+type functionDoc struct {
+	Name string     `json:"name" yaml:"name"`
+	Args []valueDoc `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// filterDoc is one entry of a filter's token stream: a tag filter, a
+// parenthesized group, a boolean operator, "*" or a template variable.
+type filterDoc struct {
+	Tag              *tagDoc   `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Group            *groupDoc `json:"group,omitempty" yaml:"group,omitempty"`
+	Operator         string    `json:"operator,omitempty" yaml:"operator,omitempty"`
+	All              bool      `json:"all,omitempty" yaml:"all,omitempty"`
+	TemplateVariable string    `json:"template_variable,omitempty" yaml:"template_variable,omitempty"`
+}
+
+type groupDoc struct {
+	Filter []filterDoc `json:"filter" yaml:"filter"`
+}
+
+type tagDoc struct {
+	Negated bool   `json:"negated,omitempty" yaml:"negated,omitempty"`
+	Key     string `json:"key" yaml:"key"`
+	// Op is empty for a bare tag.
+	Op     string     `json:"op,omitempty" yaml:"op,omitempty"`
+	Value  *valueDoc  `json:"value,omitempty" yaml:"value,omitempty"`
+	Values []valueDoc `json:"values,omitempty" yaml:"values,omitempty"`
+}
+
+// valueDoc holds exactly one of its fields. Operator is only used between the
+// entries of an IN list.
+type valueDoc struct {
+	Operator         string   `json:"operator,omitempty" yaml:"operator,omitempty"`
+	Boolean          *bool    `json:"boolean,omitempty" yaml:"boolean,omitempty"`
+	Identifier       *string  `json:"identifier,omitempty" yaml:"identifier,omitempty"`
+	String           *string  `json:"string,omitempty" yaml:"string,omitempty"`
+	TemplateVariable string   `json:"template_variable,omitempty" yaml:"template_variable,omitempty"`
+	Number           *float64 `json:"number,omitempty" yaml:"number,omitempty"`
+	Wildcard         *string  `json:"wildcard,omitempty" yaml:"wildcard,omitempty"`
+}
+
+// expressionDoc is a sum of terms; every term but the first carries its "+" or
+// "-" operator.
+type expressionDoc struct {
+	Terms []termDoc `json:"terms" yaml:"terms"`
+}
+
+// termDoc is a product of factors; every factor but the first carries its "*"
+// or "/" operator.
+type termDoc struct {
+	Operator string      `json:"operator,omitempty" yaml:"operator,omitempty"`
+	Factors  []factorDoc `json:"factors" yaml:"factors"`
+}
+
+type factorDoc struct {
+	Operator string           `json:"operator,omitempty" yaml:"operator,omitempty"`
+	Group    *expressionDoc   `json:"group,omitempty" yaml:"group,omitempty"`
+	Function *exprFunctionDoc `json:"function,omitempty" yaml:"function,omitempty"`
+	Query    *metricQueryDoc  `json:"query,omitempty" yaml:"query,omitempty"`
+	Number   *float64         `json:"number,omitempty" yaml:"number,omitempty"`
+	// NumberLiteral is the number as written, when it differs from Number's
+	// plain decimal form, e.g. "1e6".
+	NumberLiteral string    `json:"number_literal,omitempty" yaml:"number_literal,omitempty"`
+	Unary         *unaryDoc `json:"unary,omitempty" yaml:"unary,omitempty"`
+	// Reference is the name of a formula sub-query.
+	Reference string `json:"reference,omitempty" yaml:"reference,omitempty"`
+
+	Anomalies *monitorFunctionDoc `json:"anomalies,omitempty" yaml:"anomalies,omitempty"`
+	Forecast  *monitorFunctionDoc `json:"forecast,omitempty" yaml:"forecast,omitempty"`
+	Outliers  *monitorFunctionDoc `json:"outliers,omitempty" yaml:"outliers,omitempty"`
+}
+
+// unaryDoc is a factor preceded by a "-" or "+" sign.
+type unaryDoc struct {
+	Sign   string    `json:"sign" yaml:"sign"`
+	Factor factorDoc `json:"factor" yaml:"factor"`
+}
+
+// monitorFunctionDoc encodes anomalies(), forecast() and outliers(). Only the
+// numeric arguments of the function at hand are set.
+type monitorFunctionDoc struct {
+	Expression *expressionDoc `json:"expression" yaml:"expression"`
+	Algorithm  string         `json:"algorithm" yaml:"algorithm"`
+	// AlgorithmLiteral keeps the algorithm as written, e.g. "\"agile\"".
+	AlgorithmLiteral string   `json:"algorithm_literal,omitempty" yaml:"algorithm_literal,omitempty"`
+	Bounds           *float64 `json:"bounds,omitempty" yaml:"bounds,omitempty"`
+	Deviations       *float64 `json:"deviations,omitempty" yaml:"deviations,omitempty"`
+	Tolerance        *float64 `json:"tolerance,omitempty" yaml:"tolerance,omitempty"`
+	Percentage       *float64 `json:"percentage,omitempty" yaml:"percentage,omitempty"`
+	// NumberLiterals keeps the numeric arguments as written, in order, when
+	// one of them differs from its plain decimal form, e.g. "2.0".
+	NumberLiterals []string    `json:"number_literals,omitempty" yaml:"number_literals,omitempty"`
+	Options        []optionDoc `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+type optionDoc struct {
+	Name  string   `json:"name" yaml:"name"`
+	Value valueDoc `json:"value" yaml:"value"`
+}
+
+type exprFunctionDoc struct {
+	Name       string         `json:"name" yaml:"name"`
+	Expression *expressionDoc `json:"expression" yaml:"expression"`
+	Args       []valueDoc     `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+type metricMonitorDoc struct {
+	ChangeType       string `json:"change_type,omitempty" yaml:"change_type,omitempty"`
+	Aggregation      string `json:"aggregation" yaml:"aggregation"`
+	EvaluationWindow string `json:"evaluation_window" yaml:"evaluation_window"`
+	ShiftWindow      string `json:"shift_window,omitempty" yaml:"shift_window,omitempty"`
+	// exactly one of Query and Expression is set
+	Query      *metricQueryDoc `json:"query,omitempty" yaml:"query,omitempty"`
+	Expression *expressionDoc  `json:"expression,omitempty" yaml:"expression,omitempty"`
+	Comparator string          `json:"comparator" yaml:"comparator"`
+	Threshold  float64         `json:"threshold" yaml:"threshold"`
+	// ThresholdLiteral keeps the threshold as written, e.g. "1e6".
+	ThresholdLiteral string `json:"threshold_literal,omitempty" yaml:"threshold_literal,omitempty"`
+}
+
+// MarshalJSON encodes the query using the versioned schema described by
+// SchemaVersion.
+func (mq *MetricQuery) MarshalJSON() ([]byte, error) {
+	doc, err := mq.document()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a document written by MarshalJSON.
+func (mq *MetricQuery) UnmarshalJSON(data []byte) error {
+	doc := &document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return err
+	}
+	return mq.fromDocument(doc)
+}
+
+// MarshalYAML encodes the query using the versioned schema described by
+// SchemaVersion.
+func (mq *MetricQuery) MarshalYAML() (interface{}, error) {
+	return mq.document()
+}
+
+// UnmarshalYAML decodes a document written by MarshalYAML.
+func (mq *MetricQuery) UnmarshalYAML(value *yaml.Node) error {
+	doc := &document{}
+	if err := value.Decode(doc); err != nil {
+		return err
+	}
+	return mq.fromDocument(doc)
+}
+
+func (mq *MetricQuery) document() (*document, error) {
+	body, err := encodeMetricQuery(mq)
+	if err != nil {
+		return nil, err
+	}
+	return &document{Version: SchemaVersion, Source: mq.String(), MetricQuery: body}, nil
+}
+
+func (mq *MetricQuery) fromDocument(doc *document) error {
+	if err := doc.check("metric_query"); err != nil {
+		return err
+	}
+	if doc.MetricQuery == nil {
+		return parseInto(mq, doc.Source, metricQueryParser.Parse)
+	}
+	built, err := decodeMetricQuery(doc.MetricQuery)
+	if err != nil {
+		return err
+	}
+	return parseInto(mq, built.String(), metricQueryParser.Parse)
+}
+
+// MarshalJSON encodes the expression using the versioned schema described by
+// SchemaVersion.
+func (me *MetricExpression) MarshalJSON() ([]byte, error) {
+	doc, err := me.document()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a document written by MarshalJSON.
+func (me *MetricExpression) UnmarshalJSON(data []byte) error {
+	doc := &document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return err
+	}
+	return me.fromDocument(doc)
+}
+
+// MarshalYAML encodes the expression using the versioned schema described by
+// SchemaVersion.
+func (me *MetricExpression) MarshalYAML() (interface{}, error) {
+	return me.document()
+}
+
+// UnmarshalYAML decodes a document written by MarshalYAML.
+func (me *MetricExpression) UnmarshalYAML(value *yaml.Node) error {
+	doc := &document{}
+	if err := value.Decode(doc); err != nil {
+		return err
+	}
+	return me.fromDocument(doc)
+}
+
+func (me *MetricExpression) document() (*document, error) {
+	body, err := encodeGroupedExpression(me.GroupedExpression)
+	if err != nil {
+		return nil, err
+	}
+	return &document{Version: SchemaVersion, Source: me.String(), MetricExpression: body}, nil
+}
+
+func (me *MetricExpression) fromDocument(doc *document) error {
+	if err := doc.check("metric_expression"); err != nil {
+		return err
+	}
+	if doc.MetricExpression == nil {
+		return parseInto(me, doc.Source, formulaParser.Parse)
+	}
+	built, err := decodeGroupedExpression(doc.MetricExpression)
+	if err != nil {
+		return err
+	}
+	return parseInto(me, built.String(), formulaParser.Parse)
+}
+
+// MarshalJSON encodes the monitor using the versioned schema described by
+// SchemaVersion.
+func (mm *MetricMonitor) MarshalJSON() ([]byte, error) {
+	doc, err := mm.document()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a document written by MarshalJSON.
+func (mm *MetricMonitor) UnmarshalJSON(data []byte) error {
+	doc := &document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return err
+	}
+	return mm.fromDocument(doc)
+}
+
+// MarshalYAML encodes the monitor using the versioned schema described by
+// SchemaVersion.
+func (mm *MetricMonitor) MarshalYAML() (interface{}, error) {
+	return mm.document()
+}
+
+// UnmarshalYAML decodes a document written by MarshalYAML.
+func (mm *MetricMonitor) UnmarshalYAML(value *yaml.Node) error {
+	doc := &document{}
+	if err := value.Decode(doc); err != nil {
+		return err
+	}
+	return mm.fromDocument(doc)
+}
+
+func (mm *MetricMonitor) document() (*document, error) {
+	body := &metricMonitorDoc{
+		ChangeType:       mm.ChangeType,
+		Aggregation:      mm.Aggregation,
+		EvaluationWindow: mm.EvaluationWindow,
+		ShiftWindow:      mm.ShiftWindow,
+		Comparator:       mm.Comparator,
+		Threshold:        mm.Threshold,
+	}
+	var err error
+	if mm.MetricExpression != nil {
+		body.Expression, err = encodeGroupedExpression(mm.MetricExpression.GroupedExpression)
+	} else {
+		body.Query, err = encodeMetricQuery(mm.MetricQuery)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if literal := literalString(mm.ThresholdLiteral, mm.Threshold); literal != formatFloatNoExp(mm.Threshold) {
+		body.ThresholdLiteral = literal
+	}
+	return &document{Version: SchemaVersion, Source: mm.String(), MetricMonitor: body}, nil
+}
+
+func (mm *MetricMonitor) fromDocument(doc *document) error {
+	if err := doc.check("metric_monitor"); err != nil {
+		return err
+	}
+	if doc.MetricMonitor == nil {
+		return parseInto(mm, doc.Source, metricMonitorParser.Parse)
+	}
+	built := &MetricMonitor{
+		ChangeType:       doc.MetricMonitor.ChangeType,
+		Aggregation:      doc.MetricMonitor.Aggregation,
+		EvaluationWindow: doc.MetricMonitor.EvaluationWindow,
+		ShiftWindow:      doc.MetricMonitor.ShiftWindow,
+		Condition: Condition{
+			Comparator:       doc.MetricMonitor.Comparator,
+			ThresholdLiteral: doc.MetricMonitor.ThresholdLiteral,
+			Threshold:        doc.MetricMonitor.Threshold,
+		},
+	}
+	if doc.MetricMonitor.Expression != nil {
+		ge, err := decodeGroupedExpression(doc.MetricMonitor.Expression)
+		if err != nil {
+			return err
+		}
+		built.MetricExpression = &MetricExpression{GroupedExpression: ge}
+	} else {
+		query, err := decodeMetricQuery(doc.MetricMonitor.Query)
+		if err != nil {
+			return err
+		}
+		built.MetricQuery = query
+	}
+	return parseInto(mm, built.String(), metricMonitorParser.Parse)
+}
+
+// MarshalJSON encodes the query using the versioned schema described by
+// SchemaVersion.
+func (gq *GenericQuery) MarshalJSON() ([]byte, error) {
+	doc, err := gq.document()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a document holding either a metric query or a metric
+// expression.
+func (gq *GenericQuery) UnmarshalJSON(data []byte) error {
+	doc := &document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return err
+	}
+	return gq.fromDocument(doc)
+}
+
+// MarshalYAML encodes the query using the versioned schema described by
+// SchemaVersion.
+func (gq *GenericQuery) MarshalYAML() (interface{}, error) {
+	return gq.document()
+}
+
+// UnmarshalYAML decodes a document holding either a metric query or a metric
+// expression.
+func (gq *GenericQuery) UnmarshalYAML(value *yaml.Node) error {
+	doc := &document{}
+	if err := value.Decode(doc); err != nil {
+		return err
+	}
+	return gq.fromDocument(doc)
+}
+
+func (gq *GenericQuery) document() (*document, error) {
+	if gq.MetricExpression != nil {
+		return gq.MetricExpression.document()
+	} else if gq.MetricQuery != nil {
+		return gq.MetricQuery.document()
+	}
+	return nil, fmt.Errorf("empty query")
+}
+
+func (gq *GenericQuery) fromDocument(doc *document) error {
+	switch {
+	case doc.MetricQuery != nil:
+		mq := &MetricQuery{}
+		if err := mq.fromDocument(doc); err != nil {
+			return err
+		}
+		*gq = GenericQuery{MetricQuery: mq}
+		return nil
+	case doc.MetricExpression != nil:
+		me := &MetricExpression{}
+		if err := me.fromDocument(doc); err != nil {
+			return err
+		}
+		*gq = GenericQuery{MetricExpression: me}
+		return nil
+	case doc.MetricMonitor != nil:
+		return fmt.Errorf("document holds a metric_monitor, not a query")
+	}
+	if err := doc.check(""); err != nil {
+		return err
+	}
+	parsed, err := genericParser.Parse(doc.Source)
+	if err != nil {
+		return err
+	}
+	*gq = *parsed
+	return nil
+}
+
+// check validates the version and that the document holds the wanted body (or
+// only a source text).
+func (doc *document) check(want string) error {
+	if doc.Version < 1 || doc.Version > SchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", doc.Version)
+	}
+	bodies := map[string]bool{
+		"metric_query":      doc.MetricQuery != nil,
+		"metric_expression": doc.MetricExpression != nil,
+		"metric_monitor":    doc.MetricMonitor != nil,
+	}
+	found := []string{}
+	for _, name := range []string{"metric_query", "metric_expression", "metric_monitor"} {
+		if bodies[name] {
+			found = append(found, name)
+		}
+	}
+	switch {
+	case len(found) > 1:
+		return fmt.Errorf("document holds more than one body: %s", strings.Join(found, ", "))
+	case len(found) == 1 && found[0] != want && want != "":
+		return fmt.Errorf("document holds a %s, not a %s", found[0], want)
+	case len(found) == 0 && doc.Source == "":
+		return fmt.Errorf("document has neither a body nor a source")
+	}
+	return nil
+}
+
+// parseInto parses s and stores the result in dst so that unmarshalled ASTs
+// are identical to parsed ones.
+func parseInto[T any](dst *T, s string, parse func(string) (*T, error)) error {
+	parsed, err := parse(s)
+	if err != nil {
+		return fmt.Errorf("decoded query %q does not parse: %w", s, err)
+	}
+	*dst = *parsed
+	return nil
+}
+
+// Encoding
+
+func encodeMetricQuery(mq *MetricQuery) (*metricQueryDoc, error) {
+	if mq == nil {
+		return nil, fmt.Errorf("empty metric query")
+	}
+	if af := mq.AggregatorFuction; af != nil {
+		body, err := encodeMetricQuery(af.Body)
+		if err != nil {
+			return nil, err
+		}
+		args, err := encodeValues(af.Args)
+		if err != nil {
+			return nil, err
+		}
+		return &metricQueryDoc{Wrapper: &wrapperDoc{Name: af.Name, Query: body, Args: args}}, nil
+	}
+
+	q := mq.Query
+	if q == nil {
+		return nil, fmt.Errorf("empty metric query")
+	}
+	doc := &metricQueryDoc{Metric: q.MetricName, GroupBy: q.Grouping}
+	if q.Aggregator != nil {
+		doc.Aggregator = &aggregatorDoc{Name: q.Aggregator.Name, Condition: q.Aggregator.SpaceAggregationCondition}
+	}
+	if q.Filters != nil {
+		filter, err := encodeParams(append([]*Param{q.Filters.Left}, q.Filters.Parameters...))
+		if err != nil {
+			return nil, err
+		}
+		doc.Filter = filter
+	}
+	for _, fn := range q.Function {
+		args, err := encodeValues(fn.Args)
+		if err != nil {
+			return nil, err
+		}
+		doc.Functions = append(doc.Functions, functionDoc{Name: fn.Name, Args: args})
+	}
+	return doc, nil
+}
+
+func encodeParams(params []*Param) ([]filterDoc, error) {
+	out := []filterDoc{}
+	for _, p := range params {
+		switch {
+		case p == nil:
+			continue
+		case p.GroupedFilter != nil:
+			inner, err := encodeParams(p.GroupedFilter.Parameters)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, filterDoc{Group: &groupDoc{Filter: inner}})
+		case p.Separator != nil:
+			out = append(out, filterDoc{Operator: strings.TrimSpace(p.Separator.String())})
+		case p.Asterisk:
+			out = append(out, filterDoc{All: true})
+		case p.TemplateVariable != nil:
+			out = append(out, filterDoc{TemplateVariable: p.TemplateVariable.String()})
+		case p.SimpleFilter != nil:
+			tag, err := encodeSimpleFilter(p.SimpleFilter)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, filterDoc{Tag: tag})
+		default:
+			return nil, fmt.Errorf("empty filter parameter")
+		}
+	}
+	return out, nil
+}
+
+func encodeSimpleFilter(sf *SimpleFilter) (*tagDoc, error) {
+	if sf.FilterSeparator == nil && sf.FilterValue == nil {
+		return &tagDoc{Negated: sf.Negative, Key: sf.FilterKey}, nil
+	}
+	if sf.FilterSeparator == nil || sf.FilterValue == nil {
+		return nil, fmt.Errorf("incomplete filter %q", sf.FilterKey)
+	}
+	tag := &tagDoc{
+		Negated: sf.Negative,
+		Key:     sf.FilterKey,
+		Op:      strings.TrimSpace(sf.FilterSeparator.String()),
+	}
+	if len(sf.FilterValue.ListValue) > 0 {
+		values, err := encodeValues(sf.FilterValue.ListValue)
+		if err != nil {
+			return nil, err
+		}
+		tag.Values = values
+		return tag, nil
+	}
+	if sf.FilterValue.SimpleValue != nil {
+		value, err := encodeValue(sf.FilterValue.SimpleValue)
+		if err != nil {
+			return nil, err
+		}
+		tag.Value = &value
+	}
+	return tag, nil
+}
+
+func encodeValues(values []*Value) ([]valueDoc, error) {
+	out := []valueDoc{}
+	for _, v := range values {
+		doc, err := encodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, doc)
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func encodeValue(v *Value) (valueDoc, error) {
+	switch {
+	case v.Separator != nil:
+		return valueDoc{Operator: strings.TrimSpace(v.Separator.String())}, nil
+	case v.Boolean != nil:
+		b := bool(*v.Boolean)
+		return valueDoc{Boolean: &b}, nil
+	case v.Identifier != nil:
+		return valueDoc{Identifier: v.Identifier}, nil
+	case v.Str != nil:
+		return valueDoc{String: v.Str}, nil
+	case v.TemplateVariable != nil:
+		return valueDoc{TemplateVariable: v.TemplateVariable.String()}, nil
+	case v.Number != nil:
+		return valueDoc{Number: v.Number}, nil
+	case v.Wildcard != nil:
+		return valueDoc{Wildcard: v.Wildcard}, nil
+	}
+	return valueDoc{}, fmt.Errorf("empty value")
+}
+
+func encodeGroupedExpression(ge *GroupedExpression) (*expressionDoc, error) {
+	if ge == nil {
+		return nil, fmt.Errorf("empty expression")
+	}
+	left, err := encodeTerm(ge.Left)
+	if err != nil {
+		return nil, err
+	}
+	doc := &expressionDoc{Terms: []termDoc{left}}
+	for _, r := range ge.Right {
+		term, err := encodeTerm(r.Term)
+		if err != nil {
+			return nil, err
+		}
+		term.Operator = r.Operator.String()
+		doc.Terms = append(doc.Terms, term)
+	}
+	return doc, nil
+}
+
+func encodeTerm(t *Term) (termDoc, error) {
+	if t == nil {
+		return termDoc{}, fmt.Errorf("empty expression term")
+	}
+	left, err := encodeFactor(t.Left)
+	if err != nil {
+		return termDoc{}, err
+	}
+	doc := termDoc{Factors: []factorDoc{left}}
+	for _, r := range t.Right {
+		factor, err := encodeFactor(r.Factor)
+		if err != nil {
+			return termDoc{}, err
+		}
+		factor.Operator = r.Operator.String()
+		doc.Factors = append(doc.Factors, factor)
+	}
+	return doc, nil
+}
+
+func encodeFactor(f *Factor) (factorDoc, error) {
+	if f == nil || f.Base == nil {
+		return factorDoc{}, fmt.Errorf("empty expression factor")
+	}
+	base := f.Base
+	switch {
+	case base.Subexpression != nil:
+		group, err := encodeGroupedExpression(base.Subexpression.GroupedExpression)
+		if err != nil {
+			return factorDoc{}, err
+		}
+		return factorDoc{Group: group}, nil
+	case base.ExprAggregatorFuction != nil:
+		fn := base.ExprAggregatorFuction
+		body, err := encodeGroupedExpression(fn.Body)
+		if err != nil {
+			return factorDoc{}, err
+		}
+		args, err := encodeValues(fn.Args)
+		if err != nil {
+			return factorDoc{}, err
+		}
+		return factorDoc{Function: &exprFunctionDoc{Name: fn.Name, Expression: body, Args: args}}, nil
+	case base.MetricQuery != nil:
+		query, err := encodeMetricQuery(base.MetricQuery)
+		if err != nil {
+			return factorDoc{}, err
+		}
+		return factorDoc{Query: query}, nil
+	case base.Number != nil:
+		doc := factorDoc{Number: base.Number}
+		if text := base.numberString(); text != formatFloatNoExp(*base.Number) {
+			doc.NumberLiteral = text
+		}
+		return doc, nil
+	case base.Unary != nil:
+		operand, err := encodeFactor(&Factor{Base: base.Unary.Operand})
+		if err != nil {
+			return factorDoc{}, err
+		}
+		return factorDoc{Unary: &unaryDoc{Sign: base.Unary.Operator.String(), Factor: operand}}, nil
+	case base.Reference != nil:
+		return factorDoc{Reference: string(*base.Reference)}, nil
+	case base.Anomalies != nil:
+		doc, err := encodeMonitorFunction(base.Anomalies)
+		doc.Bounds = &base.Anomalies.Bounds
+		return factorDoc{Anomalies: doc}, err
+	case base.Forecast != nil:
+		doc, err := encodeMonitorFunction(base.Forecast)
+		doc.Deviations = &base.Forecast.Deviations
+		return factorDoc{Forecast: doc}, err
+	case base.Outliers != nil:
+		doc, err := encodeMonitorFunction(base.Outliers)
+		doc.Tolerance, doc.Percentage = &base.Outliers.Tolerance, base.Outliers.Percentage
+		return factorDoc{Outliers: doc}, err
+	}
+	return factorDoc{}, fmt.Errorf("empty expression factor")
+}
+
+// encodeMonitorFunction encodes the parts shared by the monitor functions;
+// the caller adds the numeric arguments.
+func encodeMonitorFunction(fn monitorFunction) (*monitorFunctionDoc, error) {
+	c := fn.call()
+	doc := &monitorFunctionDoc{Algorithm: *c.algorithm}
+	if literal := c.algorithmString(); literal != "'"+*c.algorithm+"'" {
+		doc.AlgorithmLiteral = literal
+	}
+	body, err := encodeGroupedExpression(c.body)
+	if err != nil {
+		return doc, err
+	}
+	doc.Expression = body
+	literals, plain := []string{}, true
+	for _, n := range c.numbers {
+		literals = append(literals, n.String())
+		plain = plain && n.String() == formatFloatNoExp(*n.value)
+	}
+	if !plain {
+		doc.NumberLiterals = literals
+	}
+	for _, opt := range c.options {
+		value, err := encodeValue(opt.Value)
+		if err != nil {
+			return doc, err
+		}
+		doc.Options = append(doc.Options, optionDoc{Name: opt.Name, Value: value})
+	}
+	return doc, nil
+}
+
+// Decoding
+
+func decodeMetricQuery(doc *metricQueryDoc) (*MetricQuery, error) {
+	if doc == nil {
+		return nil, fmt.Errorf("missing metric query")
+	}
+	if w := doc.Wrapper; w != nil {
+		body, err := decodeMetricQuery(w.Query)
+		if err != nil {
+			return nil, err
+		}
+		args, err := decodeValues(w.Args)
+		if err != nil {
+			return nil, err
+		}
+		return &MetricQuery{AggregatorFuction: &AggregatorFuction{Name: w.Name, Body: body, Args: args}}, nil
+	}
+
+	if doc.Metric == "" {
+		return nil, fmt.Errorf("metric query has no metric name")
+	}
+	q := &Query{MetricName: doc.Metric, Grouping: doc.GroupBy}
+	if doc.Aggregator != nil {
+		q.Aggregator = &Aggregator{Name: doc.Aggregator.Name, SpaceAggregationCondition: doc.Aggregator.Condition}
+	}
+	params, err := decodeParams(doc.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) == 0 {
+		params = []*Param{{Asterisk: true}}
+	}
+	q.Filters = &MetricFilter{Left: params[0], Parameters: params[1:]}
+	for _, fn := range doc.Functions {
+		args, err := decodeValues(fn.Args)
+		if err != nil {
+			return nil, err
+		}
+		q.Function = append(q.Function, &Function{Name: fn.Name, Args: args})
+	}
+	return &MetricQuery{Query: q}, nil
+}
+
+func decodeParams(docs []filterDoc) ([]*Param, error) {
+	params := []*Param{}
+	for _, d := range docs {
+		switch {
+		case d.Tag != nil:
+			sf, err := decodeTag(d.Tag)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, &Param{SimpleFilter: sf})
+		case d.Group != nil:
+			inner, err := decodeParams(d.Group.Filter)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, &Param{GroupedFilter: &GroupedFilter{Parameters: inner}})
+		case d.Operator != "":
+			sep, err := decodeFilterValueSeparator(d.Operator)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, &Param{Separator: sep})
+		case d.All:
+			params = append(params, &Param{Asterisk: true})
+		case d.TemplateVariable != "":
+			if !isTemplateVariable(d.TemplateVariable) {
+				return nil, fmt.Errorf("invalid template variable %q", d.TemplateVariable)
+			}
+			params = append(params, &Param{TemplateVariable: newTemplateVariable(d.TemplateVariable)})
+		default:
+			return nil, fmt.Errorf("empty filter entry")
+		}
+	}
+	return params, nil
+}
+
+func decodeTag(doc *tagDoc) (*SimpleFilter, error) {
+	if doc.Op == "" && doc.Value == nil && len(doc.Values) == 0 {
+		return &SimpleFilter{Negative: doc.Negated, FilterKey: doc.Key}, nil
+	}
+	sep, err := decodeFilterSeparator(doc.Op)
+	if err != nil {
+		return nil, err
+	}
+	sf := &SimpleFilter{Negative: doc.Negated, FilterKey: doc.Key, FilterSeparator: sep}
+	switch {
+	case len(doc.Values) > 0:
+		values, err := decodeValues(doc.Values)
+		if err != nil {
+			return nil, err
+		}
+		sf.FilterValue = &FilterValue{ListValue: values}
+	case doc.Value != nil:
+		value, err := decodeValue(*doc.Value)
+		if err != nil {
+			return nil, err
+		}
+		sf.FilterValue = &FilterValue{SimpleValue: value}
+	default:
+		return nil, fmt.Errorf("tag %q has no value", doc.Key)
+	}
+	return sf, nil
+}
+
+func decodeFilterSeparator(op string) (*FilterSeparator, error) {
+	switch strings.ToUpper(op) {
+	case ":":
+		return &FilterSeparator{Colon: true}, nil
+	case ":>":
+		return &FilterSeparator{GreaterThan: true}, nil
+	case ":<":
+		return &FilterSeparator{LessThan: true}, nil
+	case ":>=":
+		return &FilterSeparator{GreaterEqual: true}, nil
+	case ":<=":
+		return &FilterSeparator{LessEqual: true}, nil
+	case ":~":
+		return &FilterSeparator{Regex: true}, nil
+	case "IN":
+		return &FilterSeparator{In: true}, nil
+	case "NOT IN":
+		return &FilterSeparator{NotIn: true}, nil
+	case "NOT":
+		return &FilterSeparator{Not: true}, nil
+	case "AND NOT":
+		return &FilterSeparator{AndNot: true}, nil
+	case "OR NOT":
+		return &FilterSeparator{OrNot: true}, nil
+	}
+	return nil, fmt.Errorf("unknown filter operator %q", op)
+}
+
+func decodeFilterValueSeparator(op string) (*FilterValueSeparator, error) {
+	switch strings.ToUpper(op) {
+	case ",":
+		return &FilterValueSeparator{Comma: true}, nil
+	case "AND":
+		return &FilterValueSeparator{And: true}, nil
+	case "OR":
+		return &FilterValueSeparator{Or: true}, nil
+	case "AND NOT":
+		return &FilterValueSeparator{AndNot: true}, nil
+	case "OR NOT":
+		return &FilterValueSeparator{OrNot: true}, nil
+	case "IN":
+		return &FilterValueSeparator{In: true}, nil
+	case "NOT":
+		return &FilterValueSeparator{Not: true}, nil
+	}
+	return nil, fmt.Errorf("unknown filter operator %q", op)
+}
+
+func decodeValues(docs []valueDoc) ([]*Value, error) {
+	values := []*Value{}
+	for _, d := range docs {
+		v, err := decodeValue(d)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values, nil
+}
+
+func decodeValue(doc valueDoc) (*Value, error) {
+	switch {
+	case doc.Operator != "":
+		sep, err := decodeFilterValueSeparator(doc.Operator)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{Separator: sep}, nil
+	case doc.Boolean != nil:
+		b := Bool(*doc.Boolean)
+		return &Value{Boolean: &b}, nil
+	case doc.Identifier != nil:
+		return &Value{Identifier: doc.Identifier}, nil
+	case doc.String != nil:
+		return &Value{Str: doc.String}, nil
+	case doc.TemplateVariable != "":
+		if !isTemplateVariable(doc.TemplateVariable) {
+			return nil, fmt.Errorf("invalid template variable %q", doc.TemplateVariable)
+		}
+		return &Value{TemplateVariable: newTemplateVariable(doc.TemplateVariable)}, nil
+	case doc.Number != nil:
+		return &Value{Number: doc.Number}, nil
+	case doc.Wildcard != nil:
+		return &Value{Wildcard: doc.Wildcard}, nil
+	}
+	return nil, fmt.Errorf("empty value")
+}
+
+func decodeGroupedExpression(doc *expressionDoc) (*GroupedExpression, error) {
+	if doc == nil || len(doc.Terms) == 0 {
+		return nil, fmt.Errorf("expression has no terms")
+	}
+	ge := &GroupedExpression{}
+	for i, td := range doc.Terms {
+		term, err := decodeTerm(td)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			ge.Left = term
+			continue
+		}
+		op, ok := operatorMap[td.Operator]
+		if !ok || (op != OpAdd && op != OpSub) {
+			return nil, fmt.Errorf("invalid term operator %q", td.Operator)
+		}
+		ge.Right = append(ge.Right, &OpTerm{Operator: op, Term: term})
+	}
+	return ge, nil
+}
+
+func decodeTerm(doc termDoc) (*Term, error) {
+	if len(doc.Factors) == 0 {
+		return nil, fmt.Errorf("expression term has no factors")
+	}
+	t := &Term{}
+	for i, fd := range doc.Factors {
+		factor, err := decodeFactor(fd)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			t.Left = factor
+			continue
+		}
+		op, ok := operatorMap[fd.Operator]
+		if !ok || (op != OpMul && op != OpDiv) {
+			return nil, fmt.Errorf("invalid factor operator %q", fd.Operator)
+		}
+		t.Right = append(t.Right, &OpFactor{Operator: op, Factor: factor})
+	}
+	return t, nil
+}
+
+func decodeFactor(doc factorDoc) (*Factor, error) {
+	switch {
+	case doc.Group != nil:
+		ge, err := decodeGroupedExpression(doc.Group)
+		if err != nil {
+			return nil, err
+		}
+		return &Factor{Base: &ExprValue{Subexpression: &MetricExpression{GroupedExpression: ge}}}, nil
+	case doc.Function != nil:
+		body, err := decodeGroupedExpression(doc.Function.Expression)
+		if err != nil {
+			return nil, err
+		}
+		args, err := decodeValues(doc.Function.Args)
+		if err != nil {
+			return nil, err
+		}
+		fn := &ExpressionAggregatorFuction{Name: doc.Function.Name, Body: body, Args: args}
+		return &Factor{Base: &ExprValue{ExprAggregatorFuction: fn}}, nil
+	case doc.Query != nil:
+		mq, err := decodeMetricQuery(doc.Query)
+		if err != nil {
+			return nil, err
+		}
+		return &Factor{Base: &ExprValue{MetricQuery: mq}}, nil
+	case doc.Number != nil:
+		ev := &ExprValue{Number: doc.Number}
+		if doc.NumberLiteral != "" {
+			literal := NumberLiteral(doc.NumberLiteral)
+			ev.Literal = &literal
+		}
+		return &Factor{Base: ev}, nil
+	case doc.Unary != nil:
+		op, ok := operatorMap[doc.Unary.Sign]
+		if !ok || (op != OpSub && op != OpAdd) {
+			return nil, fmt.Errorf("unknown sign %q", doc.Unary.Sign)
+		}
+		operand, err := decodeFactor(doc.Unary.Factor)
+		if err != nil {
+			return nil, err
+		}
+		return &Factor{Base: &ExprValue{Unary: &UnaryExpr{Operator: op, Operand: operand.Base}}}, nil
+	case doc.Reference != "":
+		ref := QueryReference(doc.Reference)
+		return &Factor{Base: &ExprValue{Reference: &ref}}, nil
+	case doc.Anomalies != nil:
+		body, options, err := decodeMonitorFunction(doc.Anomalies)
+		if err != nil {
+			return nil, err
+		}
+		fn := &Anomalies{Query: body, AlgorithmLiteral: doc.Anomalies.AlgorithmLiteral, Algorithm: doc.Anomalies.Algorithm, Options: options}
+		if doc.Anomalies.Bounds != nil {
+			fn.Bounds = *doc.Anomalies.Bounds
+		}
+		if err := decodeNumberLiterals(fn, doc.Anomalies.NumberLiterals); err != nil {
+			return nil, err
+		}
+		return &Factor{Base: &ExprValue{Anomalies: fn}}, nil
+	case doc.Forecast != nil:
+		body, options, err := decodeMonitorFunction(doc.Forecast)
+		if err != nil {
+			return nil, err
+		}
+		fn := &Forecast{Query: body, AlgorithmLiteral: doc.Forecast.AlgorithmLiteral, Algorithm: doc.Forecast.Algorithm, Options: options}
+		if doc.Forecast.Deviations != nil {
+			fn.Deviations = *doc.Forecast.Deviations
+		}
+		if err := decodeNumberLiterals(fn, doc.Forecast.NumberLiterals); err != nil {
+			return nil, err
+		}
+		return &Factor{Base: &ExprValue{Forecast: fn}}, nil
+	case doc.Outliers != nil:
+		body, options, err := decodeMonitorFunction(doc.Outliers)
+		if err != nil {
+			return nil, err
+		}
+		fn := &Outliers{Query: body, AlgorithmLiteral: doc.Outliers.AlgorithmLiteral, Algorithm: doc.Outliers.Algorithm, Percentage: doc.Outliers.Percentage, Options: options}
+		if doc.Outliers.Tolerance != nil {
+			fn.Tolerance = *doc.Outliers.Tolerance
+		}
+		if err := decodeNumberLiterals(fn, doc.Outliers.NumberLiterals); err != nil {
+			return nil, err
+		}
+		return &Factor{Base: &ExprValue{Outliers: fn}}, nil
+	}
+	return nil, fmt.Errorf("empty expression factor")
+}
+
+// decodeNumberLiterals sets the literals of the numeric arguments of fn.
+func decodeNumberLiterals(fn monitorFunction, literals []string) error {
+	c := fn.call()
+	if len(literals) > 0 && len(literals) != len(c.numbers) {
+		return fmt.Errorf("%s has %d number literals for %d arguments", c.name, len(literals), len(c.numbers))
+	}
+	for i, literal := range literals {
+		*c.numbers[i].literal = literal
+	}
+	return nil
+}
+
+func decodeMonitorFunction(doc *monitorFunctionDoc) (*GroupedExpression, []*NamedArg, error) {
+	body, err := decodeGroupedExpression(doc.Expression)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := []*NamedArg{}
+	for _, od := range doc.Options {
+		value, err := decodeValue(od.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		options = append(options, &NamedArg{Name: od.Name, Value: value})
+	}
+	return body, options, nil
+}
@@ -0,0 +1,287 @@
+package ddqp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_MetricQueryJSON(t *testing.T) {
+	q, err := NewMetricQueryParser().Parse("sum:system.cpu.user{env:prod, !host:web-1} by {host}.rollup(avg,60)")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(q)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"source": "sum:system.cpu.user{env:prod, !host:web-1} by {host}.rollup(avg,60)",
+		"metric_query": {
+			"aggregator": {"name": "sum"},
+			"metric": "system.cpu.user",
+			"filter": [
+				{"tag": {"key": "env", "op": ":", "value": {"identifier": "prod"}}},
+				{"operator": ","},
+				{"tag": {"negated": true, "key": "host", "op": ":", "value": {"identifier": "web-1"}}}
+			],
+			"group_by": ["host"],
+			"functions": [{"name": "rollup", "args": [{"identifier": "avg"}, {"identifier": "60"}]}]
+		}
+	}`, string(data))
+
+	decoded := &MetricQuery{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, q, decoded)
+}
+
+func Test_MetricMonitorJSON(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("avg(last_5m):sum:system.cpu.user{env:prod} by {host} > 90")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"version": 1,
+		"source": "avg(last_5m):sum:system.cpu.user{env:prod} by {host} > 90",
+		"metric_monitor": {
+			"aggregation": "avg",
+			"evaluation_window": "last_5m",
+			"query": {
+				"aggregator": {"name": "sum"},
+				"metric": "system.cpu.user",
+				"filter": [{"tag": {"key": "env", "op": ":", "value": {"identifier": "prod"}}}],
+				"group_by": ["host"]
+			},
+			"comparator": ">",
+			"threshold": 90
+		}
+	}`, string(data))
+
+	decoded := &MetricMonitor{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, m, decoded)
+
+	out, err := yaml.Marshal(m)
+	require.NoError(t, err)
+	decoded = &MetricMonitor{}
+	require.NoError(t, yaml.Unmarshal(out, decoded))
+	assert.Equal(t, m, decoded)
+}
+
+func Test_MetricMonitorThresholdLiteralJSON(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("avg(last_5m):sum:m{*} != 1e6")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"threshold":1000000,"threshold_literal":"1e6"`)
+
+	decoded := &MetricMonitor{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, m, decoded)
+}
+
+func Test_MetricMonitorChangeJSON(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("pct_change(avg(last_5m),last_1h):avg:system.load.1{*} by {host} > 20")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"change_type":"pct_change","aggregation":"avg","evaluation_window":"last_5m","shift_window":"last_1h"`)
+
+	decoded := &MetricMonitor{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, m, decoded)
+}
+
+func Test_MetricMonitorExpressionJSON(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("avg(last_5m):sum:errors{*}.as_count() / sum:hits{*}.as_count() * 100 > 5")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"expression":{"terms":`)
+	assert.NotContains(t, string(data), `"query":{"metric"`)
+
+	decoded := &MetricMonitor{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, m, decoded)
+}
+
+func Test_MetricExpressionYAML(t *testing.T) {
+	e, err := NewMetricExpressionParser().Parse("(sum:a{*} + sum:b{*}) / sum:c{*} * 100")
+	require.NoError(t, err)
+
+	out, err := yaml.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, `version: 1
+source: (sum:a{*} + sum:b{*}) / sum:c{*} * 100
+metric_expression:
+    terms:
+        - factors:
+            - group:
+                terms:
+                    - factors:
+                        - query:
+                            aggregator:
+                                name: sum
+                            metric: a
+                            filter:
+                                - all: true
+                    - operator: +
+                      factors:
+                        - query:
+                            aggregator:
+                                name: sum
+                            metric: b
+                            filter:
+                                - all: true
+            - operator: /
+              query:
+                aggregator:
+                    name: sum
+                metric: c
+                filter:
+                    - all: true
+            - operator: '*'
+              number: 100
+`, string(out))
+
+	decoded := &MetricExpression{}
+	require.NoError(t, yaml.Unmarshal(out, decoded))
+	assert.Equal(t, e, decoded)
+}
+
+func Test_GenericQueryRoundTrip(t *testing.T) {
+	f, err := os.Open("./test_queries.txt")
+	if err != nil {
+		t.Skipf("skipping file-driven tests; could not open test_queries.txt: %v", err)
+		return
+	}
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	parser := NewGenericParser()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		t.Run("line_"+fmt.Sprintf("%d", lineNum), func(t *testing.T) {
+			ast, err := parser.Parse(line)
+			require.NoError(t, err)
+			// decoded ASTs carry the positions of the String form
+			ast, err = parser.Parse(ast.String())
+			require.NoError(t, err)
+
+			data, err := json.Marshal(ast)
+			require.NoError(t, err)
+			fromJSON := &GenericQuery{}
+			require.NoError(t, json.Unmarshal(data, fromJSON))
+			assert.Equal(t, ast, fromJSON)
+
+			out, err := yaml.Marshal(ast)
+			require.NoError(t, err)
+			fromYAML := &GenericQuery{}
+			require.NoError(t, yaml.Unmarshal(out, fromYAML))
+			assert.Equal(t, ast, fromYAML)
+		})
+	}
+	require.NoError(t, scanner.Err())
+}
+
+func Test_UnmarshalSource(t *testing.T) {
+	q := &MetricQuery{}
+	require.NoError(t, json.Unmarshal([]byte(`{"version": 1, "source": "sum:a{b:c} by {d}"}`), q))
+	assert.Equal(t, "sum:a{b:c} by {d}", q.String())
+
+	g := &GenericQuery{}
+	require.NoError(t, yaml.Unmarshal([]byte("version: 1\nsource: sum:a{*} / sum:b{*}\n"), g))
+	require.NotNil(t, g.MetricExpression)
+	assert.Equal(t, "sum:a{*} / sum:b{*}", g.String())
+}
+
+func Test_UnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		target interface{}
+		doc    string
+	}{
+		{
+			name:   "missing version",
+			target: &MetricQuery{},
+			doc:    `{"source": "sum:a{*}"}`,
+		},
+		{
+			name:   "newer version",
+			target: &MetricQuery{},
+			doc:    `{"version": 99, "source": "sum:a{*}"}`,
+		},
+		{
+			name:   "empty document",
+			target: &MetricQuery{},
+			doc:    `{"version": 1}`,
+		},
+		{
+			name:   "wrong body",
+			target: &MetricQuery{},
+			doc:    `{"version": 1, "metric_expression": {"terms": [{"factors": [{"number": 1}]}]}}`,
+		},
+		{
+			name:   "monitor as generic query",
+			target: &GenericQuery{},
+			doc:    `{"version": 1, "metric_monitor": {"aggregation": "avg"}}`,
+		},
+		{
+			name:   "unknown filter operator",
+			target: &MetricQuery{},
+			doc:    `{"version": 1, "metric_query": {"metric": "a", "filter": [{"tag": {"key": "b", "op": "=", "value": {"identifier": "c"}}}]}}`,
+		},
+		{
+			name:   "missing metric",
+			target: &MetricQuery{},
+			doc:    `{"version": 1, "metric_query": {"filter": [{"all": true}]}}`,
+		},
+		{
+			name:   "invalid term operator",
+			target: &MetricExpression{},
+			doc:    `{"version": 1, "metric_expression": {"terms": [{"factors": [{"number": 1}]}, {"operator": "*", "factors": [{"number": 2}]}]}}`,
+		},
+		{
+			name:   "unparseable result",
+			target: &MetricQuery{},
+			doc:    `{"version": 1, "metric_query": {"metric": "a b"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, json.Unmarshal([]byte(tt.doc), tt.target))
+		})
+	}
+}
+
+func Test_MetricExpressionNumbersJSON(t *testing.T) {
+	e, err := NewMetricExpressionParser().Parse("-(sum:a{*} - sum:b{*}) * 1e6 / 100")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(e)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"unary":{"sign":"-","factor":{"group":`)
+	assert.Contains(t, string(data), `"number":1000000,"number_literal":"1e6"`)
+	assert.NotContains(t, string(data), `"number_literal":"100"`)
+
+	decoded := &MetricExpression{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, e.String(), decoded.String())
+}
@@ -0,0 +1,492 @@
+package ddqp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Difference explains why two queries are not equivalent.
+type Difference struct {
+	// Path names the part that differs: "kind", "aggregator", "metric",
+	// "filter", "group_by", "functions", "wrapper" or "expression". Parts of
+	// a monitor's query are prefixed with "query." and parts of a query inside
+	// an expression with "expression.", e.g. "query.filter".
+	Path string
+	// A and B render the differing part of each side in canonical form.
+	A, B string
+	// Reason is a human-readable summary.
+	Reason string
+}
+
+func (d *Difference) String() string {
+	return fmt.Sprintf("%s: %s (%q vs %q)", d.Path, d.Reason, d.A, d.B)
+}
+
+// Equivalent reports whether two queries, expressions or monitors are
+// semantically the same. It ignores whitespace, comma vs AND, the order of
+// AND/OR operands and IN values, duplicate tags, "env:a OR env:b" vs
+// "env IN (a, b)", the order of group-by keys, the order of "+" and "*"
+// operands and redundant parentheses. When the queries differ, the returned
+// Difference describes the first difference found.
+func Equivalent(a, b Node) (bool, *Difference) {
+	d := compareNodes(unwrapGenericQuery(a), unwrapGenericQuery(b))
+	return d == nil, d
+}
+
+func unwrapGenericQuery(n Node) Node {
+	if gq, ok := n.(*GenericQuery); ok {
+		if children := gq.Children(); len(children) == 1 {
+			return children[0]
+		}
+	}
+	return n
+}
+
+func compareNodes(a, b Node) *Difference {
+	if ma, ok := a.(*MetricMonitor); ok {
+		if mb, ok := b.(*MetricMonitor); ok {
+			return compareMonitors(ma, mb)
+		}
+	}
+	ea, okA := expressionOf(a)
+	eb, okB := expressionOf(b)
+	if okA && okB {
+		return compareExpressions("", ea, eb)
+	}
+	if a.Kind() != b.Kind() {
+		return &Difference{Path: "kind", A: a.Kind().String(), B: b.Kind().String(), Reason: "different kinds of node"}
+	}
+	if ca, cb := canonicalString(a), canonicalString(b); ca != cb {
+		return &Difference{Path: a.Kind().String(), A: ca, B: cb, Reason: "nodes differ"}
+	}
+	return nil
+}
+
+// expressionOf normalizes metric queries and expressions so that "sum:a{*}"
+// and "(sum:a{*})" compare equal.
+func expressionOf(n Node) (normSum, bool) {
+	switch v := n.(type) {
+	case *MetricQuery:
+		return normSum{{factors: []normFactor{queryFactor(v)}}}, true
+	case *MetricExpression:
+		return normalizeSum(v.GroupedExpression, false), true
+	case *GroupedExpression:
+		return normalizeSum(v, false), true
+	}
+	return nil, false
+}
+
+func canonicalString(n Node) string {
+	s, err := Format(n, Canonical)
+	if err != nil {
+		return n.String()
+	}
+	return s
+}
+
+func compareMonitors(a, b *MetricMonitor) *Difference {
+	fields := []struct {
+		path, a, b string
+	}{
+		{"change_type", a.ChangeType, b.ChangeType},
+		{"aggregation", a.Aggregation, b.Aggregation},
+		{"evaluation_window", a.EvaluationWindow, b.EvaluationWindow},
+		{"shift_window", a.ShiftWindow, b.ShiftWindow},
+		{"comparator", a.Comparator, b.Comparator},
+		{"threshold", formatFloatNoExp(a.Threshold), formatFloatNoExp(b.Threshold)},
+	}
+	for _, f := range fields {
+		if f.a != f.b {
+			return &Difference{Path: "monitor." + f.path, A: f.a, B: f.b, Reason: strings.ReplaceAll(f.path, "_", " ") + " differs"}
+		}
+	}
+	ea, _ := expressionOf(a.Body())
+	eb, _ := expressionOf(b.Body())
+	return compareExpressions("query.", ea, eb)
+}
+
+func compareMetricQueries(prefix string, a, b *MetricQuery) *Difference {
+	diff := func(path, reason, x, y string) *Difference {
+		return &Difference{Path: prefix + path, A: x, B: y, Reason: reason}
+	}
+
+	wa, wb := a.AggregatorFuction, b.AggregatorFuction
+	switch {
+	case wa != nil && wb != nil:
+		if ha, hb := wrapperHead(wa), wrapperHead(wb); ha != hb {
+			return diff("wrapper", "wrapper functions differ", ha, hb)
+		}
+		return compareMetricQueries(prefix, wa.Body, wb.Body)
+	case wa != nil || wb != nil:
+		return diff("wrapper", "only one query is wrapped", queryKey(a), queryKey(b))
+	}
+
+	qa, qb := a.Query, b.Query
+	if x, y := aggregatorKey(qa), aggregatorKey(qb); x != y {
+		return diff("aggregator", "space aggregation differs", x, y)
+	}
+	if qa.MetricName != qb.MetricName {
+		return diff("metric", "metric names differ", qa.MetricName, qb.MetricName)
+	}
+	if x, y := filterKey(qa.Filters), filterKey(qb.Filters); x != y {
+		return diff("filter", "filters match different tags", x, y)
+	}
+	if x, y := strings.Join(sortedUnique(qa.Grouping), ", "), strings.Join(sortedUnique(qb.Grouping), ", "); x != y {
+		return diff("group_by", "group-by keys differ", x, y)
+	}
+	if x, y := functionsKey(qa.Function), functionsKey(qb.Function); x != y {
+		return diff("functions", "functions differ", x, y)
+	}
+	return nil
+}
+
+func compareExpressions(prefix string, a, b normSum) *Difference {
+	// compare single queries field by field for a precise path
+	if qa, qb := a.singleQuery(), b.singleQuery(); qa != nil && qb != nil {
+		return compareMetricQueries(prefix, qa, qb)
+	}
+	if a.key() == b.key() {
+		return nil
+	}
+
+	onlyA, onlyB := unmatchedTerms(a, b)
+	if len(onlyA) == 1 && len(onlyB) == 1 && onlyA[0].negative == onlyB[0].negative {
+		qa, qb := normSum{onlyA[0]}.singleQuery(), normSum{onlyB[0]}.singleQuery()
+		if qa != nil && qb != nil {
+			return compareMetricQueries(prefix+"expression.", qa, qb)
+		}
+	}
+	return &Difference{
+		Path:   prefix + "expression",
+		A:      normSum(onlyA).key(),
+		B:      normSum(onlyB).key(),
+		Reason: "expressions combine different terms",
+	}
+}
+
+// unmatchedTerms returns the terms of a missing from b and vice versa.
+func unmatchedTerms(a, b normSum) ([]normTerm, []normTerm) {
+	remaining := map[string]int{}
+	for _, t := range b {
+		remaining[t.key()]++
+	}
+	onlyA := []normTerm{}
+	for _, t := range a {
+		if remaining[t.key()] > 0 {
+			remaining[t.key()]--
+			continue
+		}
+		onlyA = append(onlyA, t)
+	}
+	onlyB := []normTerm{}
+	for _, t := range b {
+		if remaining[t.key()] > 0 {
+			remaining[t.key()]--
+			onlyB = append(onlyB, t)
+		}
+	}
+	return onlyA, onlyB
+}
+
+// normSum is an expression flattened into signed terms.
+type normSum []normTerm
+
+// normTerm is a product of factors; negative terms are subtracted.
+type normTerm struct {
+	negative bool
+	factors  []normFactor
+}
+
+// normFactor is a factor of a product; divide marks divisors.
+type normFactor struct {
+	divide bool
+	key    string
+	query  *MetricQuery
+}
+
+func (s normSum) singleQuery() *MetricQuery {
+	if len(s) == 1 && !s[0].negative && len(s[0].factors) == 1 && !s[0].factors[0].divide {
+		return s[0].factors[0].query
+	}
+	return nil
+}
+
+func (s normSum) key() string {
+	terms := []string{}
+	for _, t := range s {
+		terms = append(terms, t.key())
+	}
+	sort.Strings(terms)
+	out := strings.Join(terms, " ")
+	return strings.TrimPrefix(out, "+ ")
+}
+
+func (t normTerm) key() string {
+	factors := []string{}
+	for _, f := range t.factors {
+		op := "*"
+		if f.divide {
+			op = "/"
+		}
+		factors = append(factors, op+" "+f.key)
+	}
+	sort.Strings(factors)
+	sign := "+ "
+	if t.negative {
+		sign = "- "
+	}
+	out := strings.Join(factors, " ")
+	if strings.HasPrefix(out, "* ") {
+		return sign + strings.TrimPrefix(out, "* ")
+	}
+	return sign + "1 " + out
+}
+
+func normalizeSum(ge *GroupedExpression, negative bool) normSum {
+	if ge == nil {
+		return nil
+	}
+	out := normalizeTerm(ge.Left, negative)
+	for _, r := range ge.Right {
+		out = append(out, normalizeTerm(r.Term, negative != (r.Operator == OpSub))...)
+	}
+	return out
+}
+
+func normalizeTerm(t *Term, negative bool) normSum {
+	if t == nil {
+		return nil
+	}
+	left, flip := stripSigns(t.Left)
+	negative = negative != flip
+	// "(a + b)" on its own contributes its terms directly
+	if len(t.Right) == 0 && left != nil && left.Base != nil && left.Base.Subexpression != nil {
+		return normalizeSum(left.Base.Subexpression.GroupedExpression, negative)
+	}
+	factors := normalizeFactor(left, false)
+	for _, r := range t.Right {
+		factor, flip := stripSigns(r.Factor)
+		negative = negative != flip
+		factors = append(factors, normalizeFactor(factor, r.Operator == OpDiv)...)
+	}
+	return normSum{{negative: negative, factors: factors}}
+}
+
+// stripSigns removes unary signs from f, reporting whether they negate it, so
+// that "-a * b" and "-(a * b)" compare equal.
+func stripSigns(f *Factor) (*Factor, bool) {
+	negate := false
+	for f != nil && f.Base != nil && f.Base.Unary != nil {
+		if f.Base.Unary.Operator == OpSub {
+			negate = !negate
+		}
+		f = &Factor{Base: f.Base.Unary.Operand}
+	}
+	return f, negate
+}
+
+func normalizeFactor(f *Factor, divide bool) []normFactor {
+	if f == nil || f.Base == nil {
+		return nil
+	}
+	base := f.Base
+	switch {
+	case base.Number != nil:
+		return []normFactor{{divide: divide, key: formatFloatNoExp(*base.Number)}}
+	case base.Reference != nil:
+		return []normFactor{{divide: divide, key: "ref:" + string(*base.Reference)}}
+	case base.MetricQuery != nil:
+		nf := queryFactor(base.MetricQuery)
+		nf.divide = divide
+		return []normFactor{nf}
+	case base.ExprAggregatorFuction != nil:
+		fn := base.ExprAggregatorFuction
+		parts := []string{normalizeSum(fn.Body, false).key()}
+		for _, v := range fn.Args {
+			parts = append(parts, canonicalString(v))
+		}
+		return []normFactor{{divide: divide, key: fmt.Sprintf("%s(%s)", fn.Name, strings.Join(parts, ", "))}}
+	case base.Subexpression != nil:
+		inner := normalizeSum(base.Subexpression.GroupedExpression, false)
+		// a parenthesized product is flattened into the outer product
+		if len(inner) == 1 && !inner[0].negative {
+			out := []normFactor{}
+			for _, nf := range inner[0].factors {
+				nf.divide = nf.divide != divide
+				out = append(out, nf)
+			}
+			return out
+		}
+		return []normFactor{{divide: divide, key: "(" + inner.key() + ")"}}
+	case base.monitorFunction() != nil:
+		return []normFactor{{divide: divide, key: monitorFunctionKey(base.monitorFunction())}}
+	}
+	return nil
+}
+
+// monitorFunctionKey ignores the quoting and case of the algorithm and the
+// order of named options.
+func monitorFunctionKey(fn monitorFunction) string {
+	c := fn.call()
+	args := []string{normalizeSum(c.body, false).key(), strings.ToLower(*c.algorithm)}
+	for _, n := range c.numbers {
+		args = append(args, formatFloatNoExp(*n.value))
+	}
+	options := []string{}
+	for _, opt := range c.options {
+		options = append(options, opt.Name+"="+unquote(opt.Value.String()))
+	}
+	sort.Strings(options)
+	return fmt.Sprintf("%s(%s)", c.name, strings.Join(append(args, options...), ", "))
+}
+
+func queryFactor(mq *MetricQuery) normFactor {
+	return normFactor{key: queryKey(mq), query: mq}
+}
+
+func queryKey(mq *MetricQuery) string {
+	if w := mq.AggregatorFuction; w != nil {
+		return wrapperHead(w) + "[" + queryKey(w.Body) + "]"
+	}
+	q := mq.Query
+	key := aggregatorKey(q) + q.MetricName + "{" + filterKey(q.Filters) + "}"
+	if len(q.Grouping) > 0 {
+		key += " by {" + strings.Join(sortedUnique(q.Grouping), ", ") + "}"
+	}
+	if len(q.Function) > 0 {
+		key += "." + functionsKey(q.Function)
+	}
+	return key
+}
+
+func wrapperHead(w *AggregatorFuction) string {
+	args := []string{}
+	for _, v := range w.Args {
+		args = append(args, canonicalString(v))
+	}
+	return fmt.Sprintf("%s(%s)", w.Name, strings.Join(args, ", "))
+}
+
+func aggregatorKey(q *Query) string {
+	if q.Aggregator == nil {
+		return ""
+	}
+	return q.Aggregator.String()
+}
+
+func functionsKey(fns []*Function) string {
+	out := []string{}
+	for _, fn := range fns {
+		out = append(out, canonicalString(fn))
+	}
+	return strings.Join(out, ".")
+}
+
+func filterKey(mf *MetricFilter) string {
+	if mf == nil {
+		return "*"
+	}
+	tree, err := mf.Tree()
+	if err != nil {
+		return mf.String()
+	}
+	f := &formatter{opts: Canonical}
+	return printFilterExpr(f.filterExpr(normalizeFilter(tree)), defaultFilterStyle)
+}
+
+// normalizeFilter simplifies a filter tree without changing what it matches:
+// nested groups are flattened, duplicates and "*" operands of AND are
+// dropped, double negations cancel out, ORs of values of one tag become IN
+// lists and single-value IN lists become tag matches.
+func normalizeFilter(expr FilterExpr) FilterExpr {
+	switch e := expr.(type) {
+	case *And:
+		operands := []FilterExpr{}
+		for _, op := range e.Operands {
+			op = normalizeFilter(op)
+			switch inner := op.(type) {
+			case *MatchAll:
+				continue
+			case *And:
+				operands = append(operands, inner.Operands...)
+				continue
+			}
+			operands = append(operands, op)
+		}
+		switch len(operands) {
+		case 0:
+			return &MatchAll{}
+		case 1:
+			return operands[0]
+		}
+		return &And{Operands: operands}
+	case *Or:
+		operands := []FilterExpr{}
+		for _, op := range e.Operands {
+			op = normalizeFilter(op)
+			switch inner := op.(type) {
+			case *MatchAll:
+				return op
+			case *Or:
+				operands = append(operands, inner.Operands...)
+				continue
+			}
+			operands = append(operands, op)
+		}
+		operands = mergeTagValues(operands)
+		if len(operands) == 1 {
+			return operands[0]
+		}
+		return &Or{Operands: operands}
+	case *Not:
+		inner := normalizeFilter(e.Operand)
+		if n, ok := inner.(*Not); ok {
+			return n.Operand
+		}
+		return &Not{Operand: inner}
+	case *TagIn:
+		values := sortedUnique(e.Values)
+		if len(values) == 1 {
+			return &TagMatch{Key: e.Key, Value: values[0]}
+		}
+		return &TagIn{Key: e.Key, Values: values}
+	}
+	return expr
+}
+
+// mergeTagValues joins the operands of an OR that match values of the same
+// tag into one IN list, so "env:a OR env:b" becomes "env IN (a, b)". Values
+// with wildcards are left alone.
+func mergeTagValues(operands []FilterExpr) []FilterExpr {
+	out := []FilterExpr{}
+	lists := map[string]*TagIn{}
+	for _, op := range operands {
+		var key string
+		var values []string
+		switch e := op.(type) {
+		case *TagMatch:
+			if e.Value != "" && !strings.Contains(e.Value, "*") {
+				key, values = e.Key, []string{e.Value}
+			}
+		case *TagIn:
+			key, values = e.Key, e.Values
+		}
+		if key == "" {
+			out = append(out, op)
+			continue
+		}
+		if list, ok := lists[key]; ok {
+			list.Values = append(list.Values, values...)
+			continue
+		}
+		lists[key] = &TagIn{Key: key, Values: append([]string{}, values...)}
+		out = append(out, lists[key])
+	}
+	for i, op := range out {
+		if list, ok := op.(*TagIn); ok && lists[list.Key] == list {
+			out[i] = normalizeFilter(list)
+		}
+	}
+	return out
+}
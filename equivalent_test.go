@@ -0,0 +1,239 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Equivalent(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want *Difference
+	}{
+		{
+			name: "whitespace and separators",
+			a:    "sum:m{env:prod, service:web} by {host}",
+			b:    "sum:m{env:prod AND service:web} by {host}",
+		},
+		{
+			name: "tag order and duplicates",
+			a:    "sum:m{env:prod AND (zone:a OR zone:b)}",
+			b:    "sum:m{(zone:b OR zone:a), env:prod, env:prod}",
+		},
+		{
+			name: "in lists",
+			a:    "sum:m{region IN (b, a, b)}",
+			b:    "sum:m{region in (a,b)}",
+		},
+		{
+			name: "single value in list",
+			a:    "sum:m{region IN (a)}",
+			b:    "sum:m{region:a}",
+		},
+		{
+			name: "or of values of one tag",
+			a:    "sum:m{region:a OR region:b OR zone:c}",
+			b:    "sum:m{zone:c OR region IN (b, a)}",
+		},
+		{
+			name: "redundant parentheses in filters",
+			a:    "sum:m{(env:prod AND (service:web))}",
+			b:    "sum:m{env:prod, service:web}",
+		},
+		{
+			name: "group by order",
+			a:    "sum:m{*} by {host,az}",
+			b:    "sum:m{*} by {az,host,az}",
+		},
+		{
+			name: "commutative addition",
+			a:    "sum:a{*} + sum:b{*} - sum:c{*}",
+			b:    "sum:b{*} - sum:c{*} + sum:a{*}",
+		},
+		{
+			name: "commutative multiplication",
+			a:    "sum:a{*} / sum:b{*} * 100",
+			b:    "100 * sum:a{*} / sum:b{*}",
+		},
+		{
+			name: "unary minus",
+			a:    "-sum:a{*} * sum:b{*} + sum:c{*}",
+			b:    "sum:c{*} - (sum:a{*} * sum:b{*})",
+		},
+		{
+			name: "scientific notation",
+			a:    "sum:a{*} / 1e3",
+			b:    "sum:a{*} / 1000",
+		},
+		{
+			name: "redundant parentheses in expressions",
+			a:    "(sum:a{*} + sum:b{*}) + (sum:c{*})",
+			b:    "sum:a{*} + sum:b{*} + sum:c{*}",
+		},
+		{
+			name: "subtracted group",
+			a:    "sum:a{*} - (sum:b{*} - sum:c{*})",
+			b:    "sum:a{*} + sum:c{*} - sum:b{*}",
+		},
+		{
+			name: "parenthesized query",
+			a:    "(sum:a{env:prod})",
+			b:    "sum:a{env:prod}",
+		},
+		{
+			name: "quote style",
+			a:    "top(sum:a{*} by {host}, 10, 'mean', 'desc')",
+			b:    `top(sum:a{*} by {host},10,"mean","desc")`,
+		},
+		{
+			name: "different filter",
+			a:    "sum:m{env:prod, service:web}",
+			b:    "sum:m{env:prod OR service:web}",
+			want: &Difference{Path: "filter", A: "env:prod AND service:web", B: "env:prod OR service:web", Reason: "filters match different tags"},
+		},
+		{
+			name: "different aggregator",
+			a:    "sum:m{*}",
+			b:    "avg:m{*}",
+			want: &Difference{Path: "aggregator", A: "sum:", B: "avg:", Reason: "space aggregation differs"},
+		},
+		{
+			name: "different metric",
+			a:    "sum:m{*}",
+			b:    "sum:n{*}",
+			want: &Difference{Path: "metric", A: "m", B: "n", Reason: "metric names differ"},
+		},
+		{
+			name: "different grouping",
+			a:    "sum:m{*} by {host}",
+			b:    "sum:m{*} by {host,az}",
+			want: &Difference{Path: "group_by", A: "host", B: "az, host", Reason: "group-by keys differ"},
+		},
+		{
+			name: "function order matters",
+			a:    "sum:m{*}.as_rate().rollup(avg,60)",
+			b:    "sum:m{*}.rollup(avg,60).as_rate()",
+			want: &Difference{Path: "functions", A: "as_rate().rollup(avg, 60)", B: "rollup(avg, 60).as_rate()", Reason: "functions differ"},
+		},
+		{
+			name: "different wrapper",
+			a:    "top(sum:m{*} by {host}, 10, 'mean', 'desc')",
+			b:    "top(sum:m{*} by {host}, 5, 'mean', 'desc')",
+			want: &Difference{Path: "wrapper", A: `top(10, "mean", "desc")`, B: `top(5, "mean", "desc")`, Reason: "wrapper functions differ"},
+		},
+		{
+			name: "subtraction is not commutative",
+			a:    "sum:a{*} - sum:b{*}",
+			b:    "sum:b{*} - sum:a{*}",
+			want: &Difference{Path: "expression", A: "sum:a{*} - sum:b{*}", B: "sum:b{*} - sum:a{*}", Reason: "expressions combine different terms"},
+		},
+		{
+			name: "query inside an expression",
+			a:    "sum:a{env:prod} / sum:b{*}",
+			b:    "sum:a{env:dev} / sum:b{*}",
+			want: &Difference{Path: "expression", A: "sum:a{env:prod} / sum:b{*}", B: "sum:a{env:dev} / sum:b{*}", Reason: "expressions combine different terms"},
+		},
+		{
+			name: "single differing term",
+			a:    "sum:a{*} + sum:b{env:prod}",
+			b:    "sum:b{env:dev} + sum:a{*}",
+			want: &Difference{Path: "expression.filter", A: "env:prod", B: "env:dev", Reason: "filters match different tags"},
+		},
+	}
+	parser := NewGenericParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parser.Parse(tt.a)
+			require.NoError(t, err)
+			b, err := parser.Parse(tt.b)
+			require.NoError(t, err)
+
+			ok, diff := Equivalent(a, b)
+			assert.Equal(t, tt.want == nil, ok)
+			assert.Equal(t, tt.want, diff)
+
+			// equivalence is symmetric
+			ok, _ = Equivalent(b, a)
+			assert.Equal(t, tt.want == nil, ok)
+		})
+	}
+}
+
+func Test_EquivalentMonitors(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want *Difference
+	}{
+		{
+			name: "reformatted",
+			a:    "avg(last_5m):sum:m{service:web,env:prod} by {host,az} > 90",
+			b:    "avg(last_5m):sum:m{env:prod AND service:web} by {az,host} > 90",
+		},
+		{
+			name: "threshold",
+			a:    "avg(last_5m):sum:m{*} > 90",
+			b:    "avg(last_5m):sum:m{*} > 95",
+			want: &Difference{Path: "monitor.threshold", A: "90", B: "95", Reason: "threshold differs"},
+		},
+		{
+			name: "evaluation window",
+			a:    "avg(last_5m):sum:m{*} > 90",
+			b:    "avg(last_10m):sum:m{*} > 90",
+			want: &Difference{Path: "monitor.evaluation_window", A: "last_5m", B: "last_10m", Reason: "evaluation window differs"},
+		},
+		{
+			name: "shift window",
+			a:    "pct_change(avg(last_5m),last_1h):sum:m{*} > 20",
+			b:    "pct_change(avg(last_5m),last_1d):sum:m{*} > 20",
+			want: &Difference{Path: "monitor.shift_window", A: "last_1h", B: "last_1d", Reason: "shift window differs"},
+		},
+		{
+			name: "query filter",
+			a:    "avg(last_5m):sum:m{env:prod} > 90",
+			b:    "avg(last_5m):sum:m{!env:prod} > 90",
+			want: &Difference{Path: "query.filter", A: "env:prod", B: "!env:prod", Reason: "filters match different tags"},
+		},
+		{
+			name: "reordered expression",
+			a:    "avg(last_5m):sum:a{*} + sum:b{*} > 1",
+			b:    "avg(last_5m):sum:b{*} + (sum:a{*}) > 1",
+		},
+		{
+			name: "expression term",
+			a:    "avg(last_5m):sum:a{*} / sum:b{env:prod} > 1",
+			b:    "avg(last_5m):sum:a{*} / sum:b{env:dev} > 1",
+			want: &Difference{Path: "query.expression", A: "sum:a{*} / sum:b{env:prod}", B: "sum:a{*} / sum:b{env:dev}", Reason: "expressions combine different terms"},
+		},
+	}
+	parser := NewMetricMonitorParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := parser.Parse(tt.a)
+			require.NoError(t, err)
+			b, err := parser.Parse(tt.b)
+			require.NoError(t, err)
+
+			ok, diff := Equivalent(a, b)
+			assert.Equal(t, tt.want == nil, ok)
+			assert.Equal(t, tt.want, diff)
+		})
+	}
+}
+
+func Test_EquivalentKinds(t *testing.T) {
+	q, err := NewMetricQueryParser().Parse("sum:m{*}")
+	require.NoError(t, err)
+	m, err := NewMetricMonitorParser().Parse("avg(last_5m):sum:m{*} > 1")
+	require.NoError(t, err)
+
+	ok, diff := Equivalent(q, m)
+	assert.False(t, ok)
+	assert.Equal(t, &Difference{Path: "kind", A: "MetricQuery", B: "MetricMonitor", Reason: "different kinds of node"}, diff)
+	assert.Equal(t, `kind: different kinds of node ("MetricQuery" vs "MetricMonitor")`, diff.String())
+}
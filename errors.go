@@ -0,0 +1,324 @@
+package ddqp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// ParseError is returned by the Parse methods when the input is not a valid
+// query. Positions refer to the original input, before newlines were removed.
+type ParseError struct {
+	// Query is the original input.
+	Query string
+	// Pos is the line, column (in characters, starting at 1) and byte offset
+	// of the offending token in Query.
+	Pos lexer.Position
+	// Unexpected is the text of the offending token, or "" at the end of
+	// the input.
+	Unexpected string
+	// Expected lists what the parser would have accepted instead, e.g. `"}"`
+	// or "identifier". It is empty when nothing more was expected.
+	Expected []string
+	// Hint is a human-readable explanation of the error.
+	Hint string
+
+	err error
+}
+
+func (pe *ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", pe.Pos.Line, pe.Pos.Column, pe.Hint)
+}
+
+// Unwrap returns the underlying participle error.
+func (pe *ParseError) Unwrap() error {
+	return pe.err
+}
+
+// Snippet renders the offending line of the query with a caret under the
+// error position:
+//
+//	sum:metric{env:prod
+//	                   ^ expected "}"
+func (pe *ParseError) Snippet() string {
+	lines := strings.Split(pe.Query, "\n")
+	if pe.Pos.Line < 1 || pe.Pos.Line > len(lines) {
+		return pe.Hint
+	}
+	line := lines[pe.Pos.Line-1]
+
+	// keep tabs so the caret lines up with the rendered source
+	pad := []rune{}
+	for i, r := range []rune(line) {
+		if i >= pe.Pos.Column-1 {
+			break
+		}
+		if r == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	for len(pad) < pe.Pos.Column-1 {
+		pad = append(pad, ' ')
+	}
+	return fmt.Sprintf("%s\n%s^ %s", line, string(pad), pe.Hint)
+}
+
+// newParseError converts an error returned by a participle parser for the
+// sanitized form of query into a *ParseError.
+func newParseError(query string, err error) error {
+	return newParseErrorAt(query, err, originalPosition)
+}
+
+// newParseErrorAt is newParseError for parsers that map offsets in the parsed
+// text back to query with position.
+func newParseErrorAt(query string, err error, position func(query string, offset int) lexer.Position) error {
+	if err == nil {
+		return nil
+	}
+	pe := &ParseError{Query: query, err: err}
+
+	var perr participle.Error
+	if !errors.As(err, &perr) {
+		pe.Hint = err.Error()
+		return pe
+	}
+	pe.Pos = position(query, perr.Position().Offset)
+
+	msg := perr.Message()
+	var unexpected *participle.UnexpectedTokenError
+	if errors.As(err, &unexpected) {
+		if !unexpected.Unexpected.EOF() {
+			pe.Unexpected = unexpected.Unexpected.Value
+		}
+		if m := expectedPattern.FindStringSubmatch(msg); m != nil {
+			pe.Expected = firstTokens(m[1])
+		}
+		pe.Hint = parseErrorHint(pe)
+		return pe
+	}
+	pe.Hint = msg
+	return pe
+}
+
+var expectedPattern = regexp.MustCompile(`\(expected (.*)\)$`)
+
+func parseErrorHint(pe *ParseError) string {
+	expected := strings.Join(pe.Expected, " or ")
+	switch {
+	case pe.Unexpected == "" && expected != "":
+		return fmt.Sprintf("query ends early, expected %s", expected)
+	case pe.Unexpected == "":
+		return "query ends early"
+	case expected != "":
+		return fmt.Sprintf("unexpected %q, expected %s", pe.Unexpected, expected)
+	}
+	return fmt.Sprintf("unexpected %q after the end of the query", pe.Unexpected)
+}
+
+// originalPosition maps a byte offset in the sanitized query (newlines
+// removed) back to a position in the original query.
+func originalPosition(query string, offset int) lexer.Position {
+	pos := lexer.Position{Line: 1, Column: 1}
+	sanitized := 0
+	for i, r := range query {
+		if r != '\n' && sanitized >= offset {
+			pos.Offset = i
+			return pos
+		}
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+			continue
+		}
+		sanitized += utf8.RuneLen(r)
+		pos.Column++
+	}
+	pos.Offset = len(query)
+	return pos
+}
+
+// inputPosition maps a byte offset in query, parsed as is, to a position.
+func inputPosition(query string, offset int) lexer.Position {
+	pos := lexer.Position{Offset: offset, Line: 1, Column: 1}
+	for i, r := range query {
+		if i >= offset {
+			return pos
+		}
+		if r == '\n' {
+			pos.Line++
+			pos.Column = 1
+			continue
+		}
+		pos.Column++
+	}
+	pos.Offset = len(query)
+	return pos
+}
+
+// firstTokens extracts the tokens that may start the grammar fragment
+// participle reports as expected, e.g. `"}" "by"? ("{" ...)?` yields `"}"`.
+func firstTokens(expect string) []string {
+	seq := parseExpectation(tokenizeExpectation(expect))
+	seen := map[string]bool{}
+	out := []string{}
+	for _, tok := range seq.first() {
+		if name := describeExpectedToken(tok); !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// expectation is a tiny model of participle's grammar rendering: a sequence of
+// alternatives, each of which is a sequence of optional or required items.
+type expectation struct {
+	alternatives [][]expectItem
+}
+
+type expectItem struct {
+	token    string
+	group    *expectation
+	optional bool
+}
+
+func (e *expectation) first() []string {
+	out := []string{}
+	for _, alt := range e.alternatives {
+		for _, item := range alt {
+			if item.group != nil {
+				out = append(out, item.group.first()...)
+			} else {
+				out = append(out, item.token)
+			}
+			if !item.optional {
+				break
+			}
+		}
+	}
+	return out
+}
+
+func tokenizeExpectation(s string) []string {
+	tokens := []string{}
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(s) {
+				end++
+			}
+			tokens = append(tokens, s[i:end])
+			i = end
+		case c == '<':
+			end := strings.IndexByte(s[i:], '>')
+			if end < 0 {
+				tokens = append(tokens, s[i:])
+				return tokens
+			}
+			tokens = append(tokens, s[i:i+end+1])
+			i += end + 1
+		case strings.IndexByte("()|?*+", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			end := i
+			for end < len(s) && strings.IndexByte(` "<()|?*+`, s[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, s[i:end])
+			i = end
+		}
+	}
+	return tokens
+}
+
+func parseExpectation(tokens []string) *expectation {
+	e, _ := parseExpectationAt(tokens, 0)
+	return e
+}
+
+func parseExpectationAt(tokens []string, i int) (*expectation, int) {
+	e := &expectation{}
+	alt := []expectItem{}
+	for i < len(tokens) {
+		switch tok := tokens[i]; tok {
+		case ")":
+			e.alternatives = append(e.alternatives, alt)
+			return e, i + 1
+		case "|":
+			e.alternatives = append(e.alternatives, alt)
+			alt = []expectItem{}
+			i++
+		case "?", "*":
+			if len(alt) > 0 {
+				alt[len(alt)-1].optional = true
+			}
+			i++
+		case "+":
+			i++
+		case "(":
+			group, next := parseExpectationAt(tokens, i+1)
+			alt = append(alt, expectItem{group: group})
+			i = next
+		default:
+			alt = append(alt, expectItem{token: tok})
+			i++
+		}
+	}
+	e.alternatives = append(e.alternatives, alt)
+	return e, i
+}
+
+// describeExpectedToken renders a grammar token for humans: literals stay
+// quoted, lexer rules such as <ident> become "identifier" and grammar nodes
+// such as FilterSeparator become "filter separator".
+func describeExpectedToken(tok string) string {
+	if strings.HasPrefix(tok, "<") && strings.HasSuffix(tok, ">") {
+		switch name := strings.Trim(tok, "<>"); name {
+		case "ident":
+			return "identifier"
+		case "templatevariable":
+			return "template variable"
+		case "filterident":
+			return "filter value"
+		case "spaceaggregatorcondition":
+			return "space aggregation condition"
+		case "comparisonoperator":
+			return "comparison operator"
+		default:
+			return name
+		}
+	}
+	if strings.HasPrefix(tok, `"`) {
+		return tok
+	}
+
+	words := []string{}
+	start := 0
+	runes := []rune(tok)
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && !unicode.IsUpper(runes[i-1]) {
+			words = append(words, strings.ToLower(string(runes[start:i])))
+			start = i
+		}
+	}
+	words = append(words, strings.ToLower(string(runes[start:])))
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,173 @@
+package ddqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		parse      func(string) error
+		query      string
+		line       int
+		column     int
+		offset     int
+		unexpected string
+		expected   []string
+		hint       string
+	}{
+		{
+			name:     "unterminated filter",
+			parse:    parseMetricQuery,
+			query:    "sum:metric.name{env:prod",
+			line:     1,
+			column:   25,
+			offset:   24,
+			expected: []string{`"}"`},
+			hint:     `query ends early, expected "}"`,
+		},
+		{
+			name:       "missing filter separator",
+			parse:      parseMetricQuery,
+			query:      "avg:metric.name{env ^ prod}",
+			line:       1,
+			column:     21,
+			offset:     20,
+			unexpected: "^",
+			expected:   []string{"filter separator"},
+			hint:       `unexpected "^", expected filter separator`,
+		},
+		{
+			name:       "trailing token on a later line",
+			parse:      parseMetricQuery,
+			query:      "sum:metric.name{env:prod}\n by {host\n}}",
+			line:       3,
+			column:     2,
+			offset:     37,
+			unexpected: "}",
+			hint:       `unexpected "}" after the end of the query`,
+		},
+		{
+			name:     "unterminated function",
+			parse:    parseMetricQuery,
+			query:    "sum:metric.name{*}.rollup(",
+			line:     1,
+			column:   27,
+			offset:   26,
+			expected: []string{`")"`},
+			hint:     `query ends early, expected ")"`,
+		},
+		{
+			name:       "monitor comparator",
+			parse:      parseMetricMonitor,
+			query:      "avg(last_5m):sum:metric.name{*}\n  % 1",
+			line:       2,
+			column:     3,
+			offset:     34,
+			unexpected: "%",
+			expected:   []string{`">"`, `"<"`, `"="`, `"!"`},
+			hint:       `unexpected "%", expected ">" or "<" or "=" or "!"`,
+		},
+		{
+			name:     "generic reports the furthest error",
+			parse:    parseGeneric,
+			query:    "sum:a{*} +\n sum:b{*",
+			line:     2,
+			column:   9,
+			offset:   19,
+			expected: []string{`"}"`},
+			hint:     `query ends early, expected "}"`,
+		},
+		{
+			name:     "multi-byte characters",
+			parse:    parseMetricQuery,
+			query:    `sum:metric.name{env:"café" `,
+			line:     1,
+			column:   28,
+			offset:   28,
+			expected: []string{`"}"`},
+			hint:     `query ends early, expected "}"`,
+		},
+		{
+			name:   "lexer error",
+			parse:  parseMetricQuery,
+			query:  "sum:metric.name{café:prod}",
+			line:   1,
+			column: 20,
+			offset: 19,
+			hint:   `lexer: invalid input text "é:prod}"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.parse(tt.query)
+			require.Error(t, err)
+
+			var pe *ParseError
+			require.True(t, errors.As(err, &pe), "got %T", err)
+			assert.Equal(t, tt.query, pe.Query)
+			assert.Equal(t, tt.line, pe.Pos.Line)
+			assert.Equal(t, tt.column, pe.Pos.Column)
+			assert.Equal(t, tt.offset, pe.Pos.Offset)
+			assert.Equal(t, tt.unexpected, pe.Unexpected)
+			assert.Equal(t, tt.expected, pe.Expected)
+			assert.Equal(t, tt.hint, pe.Hint)
+
+			var perr participle.Error
+			assert.True(t, errors.As(err, &perr))
+		})
+	}
+}
+
+func Test_ParseErrorSnippet(t *testing.T) {
+	_, err := NewMetricQueryParser().Parse("sum:metric.name{env:prod}\n\tby {host\n}}")
+	require.Error(t, err)
+
+	var pe *ParseError
+	require.True(t, errors.As(err, &pe))
+	assert.Equal(t, "3:2: unexpected \"}\" after the end of the query", pe.Error())
+	assert.Equal(t, "}}\n ^ unexpected \"}\" after the end of the query", pe.Snippet())
+
+	_, err = NewMetricQueryParser().Parse("sum:metric.name{env:prod")
+	require.True(t, errors.As(err, &pe))
+	assert.Equal(t, "sum:metric.name{env:prod\n                        ^ query ends early, expected \"}\"", pe.Snippet())
+}
+
+func Test_FirstTokens(t *testing.T) {
+	tests := []struct {
+		expect string
+		want   []string
+	}{
+		{`"}" "by"? ("{" ((<ident> | "*")) "}")?`, []string{`"}"`}},
+		{`(">" | (">" "=") | "<" | ("<" "=")) <ident>`, []string{`">"`, `"<"`}},
+		{`"by"? ("{" <ident> "}")? ("." Function)*`, []string{`"by"`, `"{"`, `"."`}},
+		{`<ident> ("." <ident>)* "{" MetricFilter "}"`, []string{"identifier"}},
+		{`FilterSeparator FilterValue`, []string{"filter separator"}},
+		{`(<templatevariable> | <ident>)+`, []string{"template variable", "identifier"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expect, func(t *testing.T) {
+			assert.Equal(t, tt.want, firstTokens(tt.expect))
+		})
+	}
+}
+
+func parseMetricQuery(q string) error {
+	_, err := NewMetricQueryParser().Parse(q)
+	return err
+}
+
+func parseMetricMonitor(q string) error {
+	_, err := NewMetricMonitorParser().Parse(q)
+	return err
+}
+
+func parseGeneric(q string) error {
+	_, err := NewGenericParser().Parse(q)
+	return err
+}
@@ -0,0 +1,173 @@
+package ddqp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// EventMonitor is an event monitor query such as
+//
+//	events("sources:kubernetes priority:all").rollup("count").by("host").last("1h") > 0
+//
+// Older monitors chain the methods in other orders; String always writes
+// rollup, by and last in that order. String arguments are stored without
+// their quotes, and String writes the calls whose arguments are unchanged as
+// they were parsed.
+type EventMonitor struct {
+	Pos lexer.Position
+
+	// Search is the event search string.
+	Search string
+	// SearchQuery is Search parsed with a SearchQueryParser. It is filled in
+	// by Parse and is not used by String.
+	SearchQuery *SearchQuery
+	// Rollup is nil when the query counts matching events implicitly.
+	Rollup *LogRollup
+	// GroupBy lists the facets results are grouped by.
+	GroupBy []string
+	// Window is the evaluation window, e.g. "1h".
+	Window string
+	Condition
+
+	written writtenCalls
+}
+
+// eventMonitorGrammar is what the parser reads; the methods are collected in
+// any order and then moved to the typed fields of EventMonitor.
+type eventMonitorGrammar struct {
+	Pos lexer.Position
+
+	Search  *searchArg     `parser:"'events' @@"`
+	Methods []*eventMethod `parser:"@@*"`
+	Condition
+}
+
+// end is the position of the token after the method chain of g, which is
+// the comparator.
+func (g *eventMonitorGrammar) end() lexer.Position {
+	if len(g.Methods) > 0 {
+		return g.Methods[len(g.Methods)-1].EndPos
+	}
+	return g.Search.EndPos
+}
+
+type eventMethod struct {
+	Pos    lexer.Position
+	EndPos lexer.Position
+
+	Rollup  *LogRollup `parser:"  '.' @@"`
+	GroupBy []string   `parser:"| '.' 'by' '(' @String ( ',' @String )* ')'"`
+	Window  *string    `parser:"| '.' 'last' '(' @String ')'"`
+}
+
+func (m *eventMethod) args() []string {
+	switch {
+	case m.Rollup != nil:
+		return m.Rollup.args()
+	case m.Window != nil:
+		return []string{*m.Window}
+	}
+	return m.GroupBy
+}
+
+func (m *eventMethod) name() string {
+	switch {
+	case m.Rollup != nil:
+		return "rollup"
+	case m.Window != nil:
+		return "last"
+	}
+	return "by"
+}
+
+// String returns the string representation of the event monitor.
+func (em *EventMonitor) String() string {
+	var sb strings.Builder
+	writeChain(&sb, em.written, doubleQuoted, "events", em.Search, map[string][]string{
+		"rollup": em.Rollup.args(),
+		"by":     em.GroupBy,
+		"last":   {em.Window},
+	})
+	fmt.Fprintf(&sb, " %s", em.Condition)
+	return sb.String()
+}
+
+func (em *EventMonitor) Position() lexer.Position { return em.Pos }
+func (em *EventMonitor) Kind() NodeKind           { return KindEventMonitor }
+
+func (em *EventMonitor) Children() []Node {
+	if em.SearchQuery != nil {
+		return []Node{em.SearchQuery}
+	}
+	return nil
+}
+
+// NewEventMonitorParser returns a Parser which is capable of interpretting
+// an event monitor query.
+func NewEventMonitorParser() *EventMonitorParser {
+	emp := &EventMonitorParser{
+		parser: participle.MustBuild[eventMonitorGrammar](
+			participle.Lexer(lex),
+			participle.Unquote("String"),
+		),
+	}
+
+	return emp
+}
+
+var eventMonitorParser = NewEventMonitorParser()
+
+// EventMonitorParser is parser returned when calling NewEventMonitorParser.
+type EventMonitorParser struct {
+	parser *participle.Parser[eventMonitorGrammar]
+}
+
+// Parse sanitizes the query string and returns the AST. Invalid input,
+// including a repeated method, a missing last() or an invalid search string,
+// is reported as a *ParseError.
+func (emp *EventMonitorParser) Parse(query string) (*EventMonitor, error) {
+	// the parser doesn't handle queries that are split up across multiple lines
+	sanitized := strings.ReplaceAll(query, "\n", "")
+	g, err := emp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+
+	em := &EventMonitor{
+		Pos:       g.Pos,
+		Search:    g.Search.Value,
+		Condition: g.Condition,
+		written:   writtenCalls{},
+	}
+	em.written.record("events", []string{em.Search}, sanitized, g.Search.Pos, g.Search.EndPos)
+	seen := map[string]bool{}
+	for _, m := range g.Methods {
+		if seen[m.name()] {
+			return nil, newParseError(query, participle.Errorf(m.Pos, "%s() is given more than once", m.name()))
+		}
+		seen[m.name()] = true
+		em.written.record(m.name(), m.args(), sanitized, m.Pos, m.EndPos)
+		switch {
+		case m.Rollup != nil:
+			em.Rollup = m.Rollup
+		case m.Window != nil:
+			em.Window = *m.Window
+		default:
+			em.GroupBy = m.GroupBy
+		}
+	}
+	if !seen["last"] {
+		return nil, newParseError(query, participle.Errorf(g.end(), "event monitor needs an evaluation window, e.g. .last(\"5m\")"))
+	}
+
+	if err := em.Condition.resolve(query, sanitized); err != nil {
+		return nil, err
+	}
+	if em.SearchQuery, err = searchQueryParser.Parse(em.Search); err != nil {
+		return nil, newParseError(query, participle.Errorf(g.Search.valuePos(), "invalid search %q: %v", em.Search, err))
+	}
+	return em, nil
+}
@@ -0,0 +1,115 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EventMonitor(t *testing.T) {
+	parser := NewEventMonitorParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+		// column is where the error is reported, if set
+		column int
+	}{
+		{
+			name:  "request example",
+			query: `events("sources:kubernetes priority:all tags:env:prod").rollup("count").by("host").last("1h") > 0`,
+		},
+		{
+			name:  "only search and window",
+			query: `events("sources:nagios status:error").last("5m") >= 3`,
+		},
+		{
+			name:  "legacy method order",
+			query: `events('priority:all tags:service:web').by('host').rollup('count').last('5m') > 10`,
+			want:  `events('priority:all tags:service:web').rollup('count').by('host').last('5m') > 10`,
+		},
+		{
+			name:  "window first",
+			query: `events("sources:aws").last("15m").by("host", "region").rollup("cardinality", "@evt.id") < 2`,
+			want:  `events("sources:aws").rollup("cardinality", "@evt.id").by("host", "region").last("15m") < 2`,
+		},
+		{
+			name:    "missing window",
+			query:   `events("sources:kubernetes").rollup("count") > 0`,
+			wantErr: true,
+			column:  46,
+		},
+		{
+			name:    "missing window with a comparator in the search",
+			query:   `events("priority:all").by("host") > 0`,
+			wantErr: true,
+			column:  35,
+		},
+		{
+			name:    "repeated method",
+			query:   `events("sources:kubernetes").by("host").by("env").last("5m") > 0`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid search",
+			query:   `events("sources:(kubernetes").last("5m") > 0`,
+			wantErr: true,
+			column:  8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				var pe *ParseError
+				require.ErrorAs(t, err, &pe)
+				if tt.column != 0 {
+					assert.Equal(t, tt.column, pe.Pos.Column)
+				}
+				return
+			}
+			require.NoError(t, err)
+			want := tt.want
+			if want == "" {
+				want = tt.query
+			}
+			assert.Equal(t, want, ast.String())
+		})
+	}
+}
+
+func Test_EventMonitorFields(t *testing.T) {
+	m, err := NewEventMonitorParser().Parse(`events('sources:kubernetes tags:env:prod').by('host', 'env').rollup('count').last('1h') > 0`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "sources:kubernetes tags:env:prod", m.Search)
+	require.NotNil(t, m.Rollup)
+	assert.Equal(t, "count", m.Rollup.Method)
+	assert.Empty(t, m.Rollup.Measure)
+	assert.Equal(t, []string{"host", "env"}, m.GroupBy)
+	assert.Equal(t, "1h", m.Window)
+	assert.Equal(t, ">", m.Comparator)
+	assert.Equal(t, 0.0, m.Threshold)
+
+	keys := []string{}
+	Inspect(m, func(n Node) bool {
+		if attr, ok := n.(*SearchAttribute); ok {
+			keys = append(keys, attr.Key+"="+attr.Value.String())
+		}
+		return true
+	})
+	assert.Equal(t, []string{"sources=kubernetes", "tags=env:prod"}, keys)
+
+	monitor, err := parseMonitorQuery(m.String())
+	require.NoError(t, err)
+	assert.IsType(t, &EventMonitor{}, monitor)
+
+	// a changed argument keeps the quote style of the query
+	m.Window = "5m"
+	m.Rollup.Measure = "@evt.id"
+	assert.Equal(t, `events('sources:kubernetes tags:env:prod').rollup('count', '@evt.id').by('host', 'env').last('5m') > 0`, m.String())
+}
@@ -0,0 +1,165 @@
+package ddqp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches reports whether a timeseries carrying tags would be selected by the
+// filter. tags maps each tag key to its values; a bare tag such as "canary" is
+// represented by its key with an empty value. Matching is case-insensitive,
+// like Datadog's tag normalization.
+//
+// An error is returned when the filter cannot be evaluated, for example when a
+// regex filter has an invalid pattern.
+func (mf *MetricFilter) Matches(tags map[string][]string) (bool, error) {
+	tree, err := mf.Tree()
+	if err != nil {
+		return false, err
+	}
+	return matchFilterExpr(tree, normalizeTags(tags))
+}
+
+// MatchesTags is like Matches but accepts Datadog-style tags such as
+// "env:prod" or "canary".
+func (mf *MetricFilter) MatchesTags(tags []string) (bool, error) {
+	return mf.Matches(TagMap(tags))
+}
+
+// TagMap converts Datadog-style "key:value" tags into the map form used by
+// Matches. Tags without a colon are stored with an empty value.
+func TagMap(tags []string) map[string][]string {
+	out := map[string][]string{}
+	for _, tag := range tags {
+		key, value := tag, ""
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		out[key] = append(out[key], value)
+	}
+	return out
+}
+
+func normalizeTags(tags map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(tags))
+	for k, values := range tags {
+		key := strings.ToLower(k)
+		for _, v := range values {
+			out[key] = append(out[key], strings.ToLower(v))
+		}
+		if len(values) == 0 {
+			out[key] = append(out[key], "")
+		}
+	}
+	return out
+}
+
+func matchFilterExpr(expr FilterExpr, tags map[string][]string) (bool, error) {
+	switch e := expr.(type) {
+	case *MatchAll:
+		return true, nil
+	case *TemplateVariable:
+		return false, fmt.Errorf("unresolved template variable %s", e)
+	case *And:
+		for _, op := range e.Operands {
+			ok, err := matchFilterExpr(op, tags)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case *Or:
+		for _, op := range e.Operands {
+			ok, err := matchFilterExpr(op, tags)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case *Not:
+		ok, err := matchFilterExpr(e.Operand, tags)
+		return !ok, err
+	case *TagMatch:
+		if isTemplateVariable(e.Value) {
+			return false, fmt.Errorf("unresolved template variable %s", e.Value)
+		}
+		values, present := tags[strings.ToLower(e.Key)]
+		if e.Value == "" {
+			return present, nil
+		}
+		return anyValue(values, func(v string) bool { return globMatch(strings.ToLower(e.Value), v) }), nil
+	case *TagIn:
+		values := tags[strings.ToLower(e.Key)]
+		for _, want := range e.Values {
+			if isTemplateVariable(want) {
+				return false, fmt.Errorf("unresolved template variable %s", want)
+			}
+			if anyValue(values, func(v string) bool { return globMatch(strings.ToLower(want), v) }) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case *Compare:
+		threshold, err := strconv.ParseFloat(e.Value, 64)
+		if err != nil {
+			return false, fmt.Errorf("filter %s: %q is not a number", e, e.Value)
+		}
+		return anyValue(tags[strings.ToLower(e.Key)], func(v string) bool {
+			n, err := strconv.ParseFloat(v, 64)
+			return err == nil && compareFloat(n, e.Op, threshold)
+		}), nil
+	case *Regex:
+		re, err := regexp.Compile("(?i)^(?:" + e.Pattern + ")$")
+		if err != nil {
+			return false, fmt.Errorf("filter %s: %w", e, err)
+		}
+		return anyValue(tags[strings.ToLower(e.Key)], re.MatchString), nil
+	}
+	return false, fmt.Errorf("unsupported filter expression %T", expr)
+}
+
+func anyValue(values []string, match func(string) bool) bool {
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareFloat(n float64, op string, threshold float64) bool {
+	switch op {
+	case ">":
+		return n > threshold
+	case ">=":
+		return n >= threshold
+	case "<":
+		return n < threshold
+	case "<=":
+		return n <= threshold
+	}
+	return false
+}
+
+// globMatch matches s against pattern where "*" matches any run of characters.
+func globMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
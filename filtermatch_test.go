@@ -0,0 +1,99 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MetricFilterMatches(t *testing.T) {
+	host := []string{"env:prod", "service:web", "host:web-12", "region:us-east-1", "cpu:85", "canary"}
+
+	tests := []struct {
+		name    string
+		filter  string
+		tags    []string
+		want    bool
+		wantErr bool
+	}{
+		{name: "asterisk", filter: "*", tags: host, want: true},
+		{name: "exact match", filter: "env:prod", tags: host, want: true},
+		{name: "exact mismatch", filter: "env:staging", tags: host, want: false},
+		{name: "case insensitive", filter: "env:PROD", tags: host, want: true},
+		{name: "missing key", filter: "team:core", tags: host, want: false},
+		{name: "wildcard suffix", filter: "host:web-*", tags: host, want: true},
+		{name: "wildcard prefix", filter: "host:*-12", tags: host, want: true},
+		{name: "wildcard middle", filter: "region:us-*-1", tags: host, want: true},
+		{name: "wildcard mismatch", filter: "host:db-*", tags: host, want: false},
+		{name: "any value", filter: "host:*", tags: host, want: true},
+		{name: "comma is and", filter: "env:prod, service:api", tags: host, want: false},
+		{name: "and", filter: "env:prod AND service:web", tags: host, want: true},
+		{name: "or", filter: "env:staging OR service:web", tags: host, want: true},
+		{name: "negation", filter: "!env:prod", tags: host, want: false},
+		{name: "negation of missing key", filter: "!team:core", tags: host, want: true},
+		{name: "and not", filter: "env:prod AND NOT host:web-*", tags: host, want: false},
+		{name: "bare tag", filter: "canary", tags: host, want: true},
+		{name: "negated bare tag", filter: "env:prod AND !canary", tags: host, want: false},
+		{name: "or not", filter: "env:staging OR NOT host:db-*", tags: host, want: true},
+		{name: "grouped", filter: "env:prod AND (service:api OR service:web)", tags: host, want: true},
+		{name: "not group", filter: "env:prod AND NOT (service:api OR service:web)", tags: host, want: false},
+		{name: "in", filter: "region IN (us-west-2, us-east-1)", tags: host, want: true},
+		{name: "in with wildcard", filter: "region IN (us-east-*)", tags: host, want: true},
+		{name: "not in", filter: "region NOT IN (us-west-2, us-east-1)", tags: host, want: false},
+		{name: "greater than", filter: "cpu:>80", tags: host, want: true},
+		{name: "greater equal boundary", filter: "cpu:>=85", tags: host, want: true},
+		{name: "less than", filter: "cpu:<80", tags: host, want: false},
+		{name: "less equal", filter: "cpu:<=85.5", tags: host, want: true},
+		{name: "comparison on non numeric tag", filter: "env:>1", tags: host, want: false},
+		{name: "regex", filter: `host:~"web-[0-9]+"`, tags: host, want: true},
+		{name: "regex is anchored", filter: `host:~"web"`, tags: host, want: false},
+		{name: "invalid regex", filter: `host:~"web-("`, tags: host, wantErr: true},
+		{name: "bare tag", filter: "canary AND NOT prod", tags: host, want: true},
+		{name: "multiple values for a key", filter: "team:b", tags: []string{"team:a", "team:b"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mf, err := metricFilterParser.ParseString("", tt.filter)
+			require.NoError(t, err)
+
+			got, err := mf.MatchesTags(tt.tags)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_MetricFilterMatchesMap(t *testing.T) {
+	q, err := NewMetricQueryParser().Parse("avg:system.cpu.user{env:prod AND host:web-*}")
+	require.NoError(t, err)
+
+	got, err := q.Query.Filters.Matches(map[string][]string{"env": {"prod"}, "host": {"web-1"}})
+	require.NoError(t, err)
+	assert.True(t, got)
+
+	got, err = q.Query.Filters.Matches(map[string][]string{"env": {"prod"}})
+	require.NoError(t, err)
+	assert.False(t, got)
+}
+
+func Test_TagMap(t *testing.T) {
+	assert.Equal(t, map[string][]string{
+		"env":    {"prod"},
+		"team":   {"a", "b"},
+		"canary": {""},
+		"url":    {"http://x"},
+	}, TagMap([]string{"env:prod", "team:a", "team:b", "canary", "url:http://x"}))
+}
+
+func Test_GlobMatch(t *testing.T) {
+	assert.True(t, globMatch("*", ""))
+	assert.True(t, globMatch("a*b*c", "abc"))
+	assert.True(t, globMatch("a*b*c", "a-b-b-c"))
+	assert.False(t, globMatch("a*b*c", "acb"))
+	assert.False(t, globMatch("ab*", "a"))
+}
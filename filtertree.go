@@ -0,0 +1,452 @@
+package ddqp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+)
+
+// FilterExpr is a node in the semantic view of a MetricFilter. Where
+// MetricFilter mirrors the token stream of a filter, a FilterExpr tree
+// captures its boolean structure: commas and AND bind tighter than OR, NOT
+// binds tightest, and parentheses become nested nodes.
+//
+// The concrete types are And, Or, Not, TagMatch, TagIn, Compare, Regex and
+// MatchAll.
+type FilterExpr interface {
+	// String renders the expression as metric filter syntax.
+	String() string
+	filterExpr()
+}
+
+// And matches when every operand matches. Commas in a filter are parsed as
+// And.
+type And struct {
+	Operands []FilterExpr
+}
+
+// Or matches when any operand matches.
+type Or struct {
+	Operands []FilterExpr
+}
+
+// Not inverts its operand. It is produced by "!", "NOT", "AND NOT", "OR NOT"
+// and "NOT IN".
+type Not struct {
+	Operand FilterExpr
+}
+
+// TagMatch matches key:value. Value may contain "*" wildcards. A TagMatch
+// with an empty Value is a bare tag, as in "foo AND NOT bar".
+type TagMatch struct {
+	Key   string
+	Value string
+}
+
+// TagIn matches "key IN (values...)".
+type TagIn struct {
+	Key    string
+	Values []string
+}
+
+// Compare matches a numeric comparison such as "key:>=100". Op is one of
+// ">", ">=", "<" or "<=" and Value holds the literal as written.
+type Compare struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// Regex matches key:~"pattern". Pattern is stored without quotes.
+type Regex struct {
+	Key     string
+	Pattern string
+}
+
+// MatchAll is the "*" filter.
+type MatchAll struct{}
+
+// A *TemplateVariable used as a whole filter, as in "{$env}", is also a
+// FilterExpr.
+
+func (*And) filterExpr()      {}
+func (*Or) filterExpr()       {}
+func (*Not) filterExpr()      {}
+func (*TagMatch) filterExpr() {}
+func (*TagIn) filterExpr()    {}
+func (*Compare) filterExpr()  {}
+func (*Regex) filterExpr()    {}
+func (*MatchAll) filterExpr() {}
+
+func (*TemplateVariable) filterExpr() {}
+
+func (e *And) String() string      { return printFilterExpr(e, defaultFilterStyle) }
+func (e *Or) String() string       { return printFilterExpr(e, defaultFilterStyle) }
+func (e *Not) String() string      { return printFilterExpr(e, defaultFilterStyle) }
+func (e *TagMatch) String() string { return printFilterExpr(e, defaultFilterStyle) }
+func (e *TagIn) String() string    { return printFilterExpr(e, defaultFilterStyle) }
+func (e *Compare) String() string  { return printFilterExpr(e, defaultFilterStyle) }
+func (e *Regex) String() string    { return printFilterExpr(e, defaultFilterStyle) }
+func (e *MatchAll) String() string { return printFilterExpr(e, defaultFilterStyle) }
+
+var metricFilterParser = participle.MustBuild[MetricFilter](
+	participle.Lexer(lex),
+)
+
+// NewMetricFilter converts a FilterExpr back into a MetricFilter. AND is used
+// to join the operands of And nodes and parentheses are only added where
+// precedence requires them.
+func NewMetricFilter(expr FilterExpr) (*MetricFilter, error) {
+	return newMetricFilter(expr, defaultFilterStyle)
+}
+
+func newMetricFilter(expr FilterExpr, style filterStyle) (*MetricFilter, error) {
+	s := printFilterExpr(expr, style)
+	mf, err := metricFilterParser.ParseString("", s)
+	if err != nil {
+		return nil, fmt.Errorf("filter %q cannot be represented: %w", s, err)
+	}
+	return mf, nil
+}
+
+const (
+	precOr = iota
+	precAnd
+	precUnary
+)
+
+func filterPrecedence(expr FilterExpr) int {
+	switch e := expr.(type) {
+	case *Or:
+		if len(e.Operands) == 1 {
+			return filterPrecedence(e.Operands[0])
+		}
+		return precOr
+	case *And:
+		if len(e.Operands) == 1 {
+			return filterPrecedence(e.Operands[0])
+		}
+		return precAnd
+	}
+	return precUnary
+}
+
+// isCompoundNot reports whether expr is a negation that has to be written
+// with the NOT keyword rather than "!" or "NOT IN".
+func isCompoundNot(expr FilterExpr) (FilterExpr, bool) {
+	n, ok := expr.(*Not)
+	if !ok {
+		return nil, false
+	}
+	switch n.Operand.(type) {
+	case *And, *Or, *MatchAll:
+		return n.Operand, true
+	}
+	return nil, false
+}
+
+// filterStyle holds the separators used when printing a FilterExpr.
+type filterStyle struct {
+	// and joins the operands of And nodes, e.g. " AND " or ", ".
+	and string
+	// list joins the values of IN lists.
+	list string
+}
+
+var defaultFilterStyle = filterStyle{and: " AND ", list: ", "}
+
+func printFilterExpr(expr FilterExpr, style filterStyle) string {
+	switch e := expr.(type) {
+	case *And:
+		if len(e.Operands) == 0 {
+			return "*"
+		}
+		return printFilterOperands(e.Operands, precAnd, style.and, " AND NOT ", style)
+	case *Or:
+		return printFilterOperands(e.Operands, precOr, " OR ", " OR NOT ", style)
+	case *Not:
+		switch inner := e.Operand.(type) {
+		case *Not:
+			return printFilterExpr(inner.Operand, style)
+		case *TagIn:
+			return fmt.Sprintf("%s NOT IN (%s)", inner.Key, strings.Join(inner.Values, style.list))
+		case *TagMatch, *Compare, *Regex:
+			return "!" + printFilterExpr(inner, style)
+		}
+		return fmt.Sprintf("NOT (%s)", printFilterExpr(e.Operand, style))
+	case *TagMatch:
+		if e.Value == "" {
+			return e.Key
+		}
+		return fmt.Sprintf("%s:%s", e.Key, e.Value)
+	case *TagIn:
+		return fmt.Sprintf("%s IN (%s)", e.Key, strings.Join(e.Values, style.list))
+	case *Compare:
+		return fmt.Sprintf("%s:%s%s", e.Key, e.Op, e.Value)
+	case *Regex:
+		return fmt.Sprintf(`%s:~"%s"`, e.Key, strings.ReplaceAll(e.Pattern, `"`, `\"`))
+	case *MatchAll:
+		return "*"
+	case *TemplateVariable:
+		return e.String()
+	}
+	return ""
+}
+
+func printFilterOperands(operands []FilterExpr, prec int, sep, notSep string, style filterStyle) string {
+	var sb strings.Builder
+	for i, op := range operands {
+		if inner, ok := isCompoundNot(op); ok && i > 0 {
+			sb.WriteString(notSep)
+			sb.WriteString("(" + printFilterExpr(inner, style) + ")")
+			continue
+		}
+		if n, ok := op.(*Not); ok && i > 0 {
+			// bare tags cannot be negated with "!"
+			if tm, ok := n.Operand.(*TagMatch); ok && tm.Value == "" {
+				sb.WriteString(notSep + tm.Key)
+				continue
+			}
+		}
+		if i > 0 {
+			sb.WriteString(sep)
+		}
+		s := printFilterExpr(op, style)
+		if filterPrecedence(op) < prec {
+			s = "(" + s + ")"
+		}
+		sb.WriteString(s)
+	}
+	return sb.String()
+}
+
+// Tree returns the boolean structure of the filter.
+func (mf *MetricFilter) Tree() (FilterExpr, error) {
+	params := []*Param{}
+	if mf.Left != nil {
+		params = append(params, mf.Left)
+	}
+	params = append(params, mf.Parameters...)
+	return filterTree(params)
+}
+
+// filterToken is either an operator or an operand in the flattened stream.
+type filterToken struct {
+	op      string
+	operand FilterExpr
+}
+
+func filterTree(params []*Param) (FilterExpr, error) {
+	tokens := []filterToken{}
+	for _, p := range params {
+		toks, err := filterTokens(p)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, toks...)
+	}
+	if len(tokens) == 0 {
+		return &MatchAll{}, nil
+	}
+
+	fp := &filterTreeParser{tokens: tokens}
+	expr, err := fp.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if fp.pos < len(fp.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", fp.tokens[fp.pos].op)
+	}
+	return expr, nil
+}
+
+func filterTokens(p *Param) ([]filterToken, error) {
+	switch {
+	case p.Asterisk:
+		return []filterToken{{operand: &MatchAll{}}}, nil
+	case p.TemplateVariable != nil:
+		return []filterToken{{operand: p.TemplateVariable}}, nil
+	case p.Separator != nil:
+		return []filterToken{{op: strings.TrimSpace(p.Separator.String())}}, nil
+	case p.GroupedFilter != nil:
+		expr, err := filterTree(p.GroupedFilter.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		return []filterToken{{operand: expr}}, nil
+	case p.SimpleFilter != nil:
+		return simpleFilterTokens(p.SimpleFilter)
+	}
+	return nil, fmt.Errorf("empty filter parameter")
+}
+
+func negate(expr FilterExpr, negative bool) FilterExpr {
+	if negative {
+		return &Not{Operand: expr}
+	}
+	return expr
+}
+
+func simpleFilterTokens(sf *SimpleFilter) ([]filterToken, error) {
+	sep := sf.FilterSeparator
+	fv := sf.FilterValue
+	if sep == nil && fv == nil {
+		return []filterToken{{operand: negate(&TagMatch{Key: sf.FilterKey}, sf.Negative)}}, nil
+	}
+	if sep == nil || fv == nil {
+		return nil, fmt.Errorf("incomplete filter %q", sf.FilterKey)
+	}
+
+	values := []string{}
+	for _, v := range fv.ListValue {
+		if v.Separator == nil {
+			values = append(values, v.String())
+		}
+	}
+	single := ""
+	if fv.SimpleValue != nil {
+		single = fv.SimpleValue.String()
+	}
+
+	var expr FilterExpr
+	switch {
+	case sep.In:
+		expr = &TagIn{Key: sf.FilterKey, Values: values}
+	case sep.NotIn:
+		expr = &Not{Operand: &TagIn{Key: sf.FilterKey, Values: values}}
+	case sep.Colon && len(fv.ListValue) > 0:
+		expr = &TagIn{Key: sf.FilterKey, Values: values}
+	case sep.Colon:
+		expr = &TagMatch{Key: sf.FilterKey, Value: single}
+	case sep.Regex:
+		expr = &Regex{Key: sf.FilterKey, Pattern: unquote(single)}
+	case sep.GreaterThan, sep.GreaterEqual, sep.LessThan, sep.LessEqual:
+		expr = &Compare{Key: sf.FilterKey, Op: strings.TrimPrefix(sep.String(), ":"), Value: single}
+	default:
+		// "foo NOT bar", "foo AND NOT bar" and "foo OR NOT bar" lex as a
+		// single SimpleFilter but are two bare tags joined by an operator.
+		if fv.SimpleValue == nil {
+			return nil, fmt.Errorf("unsupported filter %q", sf.String())
+		}
+		return []filterToken{
+			{operand: negate(&TagMatch{Key: sf.FilterKey}, sf.Negative)},
+			{op: strings.TrimSpace(sep.String())},
+			{operand: &TagMatch{Key: single}},
+		}, nil
+	}
+	return []filterToken{{operand: negate(expr, sf.Negative)}}, nil
+}
+
+// unquote strips the quotes from a String token.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		inner := s[1 : len(s)-1]
+		if s[0] == '"' {
+			inner = strings.ReplaceAll(inner, `\"`, `"`)
+		}
+		return inner
+	}
+	return s
+}
+
+type filterTreeParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (fp *filterTreeParser) peekOp() string {
+	if fp.pos >= len(fp.tokens) {
+		return ""
+	}
+	return strings.ToUpper(fp.tokens[fp.pos].op)
+}
+
+func (fp *filterTreeParser) parseOr() (FilterExpr, error) {
+	left, err := fp.parseAnd(false)
+	if err != nil {
+		return nil, err
+	}
+	operands := []FilterExpr{left}
+	for {
+		op := fp.peekOp()
+		if op != "OR" && op != "OR NOT" {
+			break
+		}
+		fp.pos++
+		right, err := fp.parseAnd(op == "OR NOT")
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, right)
+	}
+	return flatten(operands, false), nil
+}
+
+func (fp *filterTreeParser) parseAnd(negateFirst bool) (FilterExpr, error) {
+	left, err := fp.parseUnary(negateFirst)
+	if err != nil {
+		return nil, err
+	}
+	operands := []FilterExpr{left}
+	for fp.pos < len(fp.tokens) {
+		op := fp.peekOp()
+		switch op {
+		case "AND", ",", "AND NOT":
+			fp.pos++
+		case "", "NOT":
+			// adjacent operands are implicitly joined by AND
+		default:
+			return flatten(operands, true), nil
+		}
+		right, err := fp.parseUnary(op == "AND NOT")
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, right)
+	}
+	return flatten(operands, true), nil
+}
+
+func (fp *filterTreeParser) parseUnary(negative bool) (FilterExpr, error) {
+	for fp.peekOp() == "NOT" {
+		negative = !negative
+		fp.pos++
+	}
+	if fp.pos >= len(fp.tokens) {
+		return nil, fmt.Errorf("filter ends with an operator")
+	}
+	tok := fp.tokens[fp.pos]
+	if tok.op != "" {
+		return nil, fmt.Errorf("unexpected %q in filter", tok.op)
+	}
+	fp.pos++
+	return negate(tok.operand, negative), nil
+}
+
+// flatten merges nested And (or Or) operands into a single node.
+func flatten(operands []FilterExpr, and bool) FilterExpr {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	out := []FilterExpr{}
+	for _, op := range operands {
+		switch o := op.(type) {
+		case *And:
+			if and {
+				out = append(out, o.Operands...)
+				continue
+			}
+		case *Or:
+			if !and {
+				out = append(out, o.Operands...)
+				continue
+			}
+		}
+		out = append(out, op)
+	}
+	if and {
+		return &And{Operands: out}
+	}
+	return &Or{Operands: out}
+}
@@ -0,0 +1,219 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MetricFilterTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		want   FilterExpr
+		// wantString is the filter rebuilt from the tree; defaults to filter
+		wantString string
+	}{
+		{
+			name:   "asterisk",
+			filter: "*",
+			want:   &MatchAll{},
+		},
+		{
+			name:   "single tag",
+			filter: "env:prod",
+			want:   &TagMatch{Key: "env", Value: "prod"},
+		},
+		{
+			name:       "comma behaves as and",
+			filter:     "env:prod, host:web-*",
+			want:       &And{Operands: []FilterExpr{&TagMatch{Key: "env", Value: "prod"}, &TagMatch{Key: "host", Value: "web-*"}}},
+			wantString: "env:prod AND host:web-*",
+		},
+		{
+			name:   "and binds tighter than or",
+			filter: "a:b OR c:d AND e:f",
+			want: &Or{Operands: []FilterExpr{
+				&TagMatch{Key: "a", Value: "b"},
+				&And{Operands: []FilterExpr{&TagMatch{Key: "c", Value: "d"}, &TagMatch{Key: "e", Value: "f"}}},
+			}},
+		},
+		{
+			name:   "grouping overrides precedence",
+			filter: "env:staging AND (az:us-east-1a OR az:us-east-1c)",
+			want: &And{Operands: []FilterExpr{
+				&TagMatch{Key: "env", Value: "staging"},
+				&Or{Operands: []FilterExpr{&TagMatch{Key: "az", Value: "us-east-1a"}, &TagMatch{Key: "az", Value: "us-east-1c"}}},
+			}},
+		},
+		{
+			name:       "redundant grouping is flattened",
+			filter:     "(a:b AND c:d) AND e:f",
+			want:       &And{Operands: []FilterExpr{&TagMatch{Key: "a", Value: "b"}, &TagMatch{Key: "c", Value: "d"}, &TagMatch{Key: "e", Value: "f"}}},
+			wantString: "a:b AND c:d AND e:f",
+		},
+		{
+			name:   "negation with bang",
+			filter: "!env:prod",
+			want:   &Not{Operand: &TagMatch{Key: "env", Value: "prod"}},
+		},
+		{
+			name:       "bare tags",
+			filter:     "env:prod AND !canary",
+			want:       &And{Operands: []FilterExpr{&TagMatch{Key: "env", Value: "prod"}, &Not{Operand: &TagMatch{Key: "canary"}}}},
+			wantString: "env:prod AND NOT canary",
+		},
+		{
+			name:       "and not",
+			filter:     "a:b AND NOT c:d",
+			want:       &And{Operands: []FilterExpr{&TagMatch{Key: "a", Value: "b"}, &Not{Operand: &TagMatch{Key: "c", Value: "d"}}}},
+			wantString: "a:b AND !c:d",
+		},
+		{
+			name:   "or not binds to the following and",
+			filter: "a:b OR NOT c:d AND e:f",
+			want: &Or{Operands: []FilterExpr{
+				&TagMatch{Key: "a", Value: "b"},
+				&And{Operands: []FilterExpr{&Not{Operand: &TagMatch{Key: "c", Value: "d"}}, &TagMatch{Key: "e", Value: "f"}}},
+			}},
+			wantString: "a:b OR !c:d AND e:f",
+		},
+		{
+			name:   "not of a group",
+			filter: "env:prod AND NOT (region:us-east AND datacenter:primary)",
+			want: &And{Operands: []FilterExpr{
+				&TagMatch{Key: "env", Value: "prod"},
+				&Not{Operand: &And{Operands: []FilterExpr{&TagMatch{Key: "region", Value: "us-east"}, &TagMatch{Key: "datacenter", Value: "primary"}}}},
+			}},
+		},
+		{
+			name:   "leading not keyword",
+			filter: "not env:prod and (service:api OR host:web)",
+			want: &And{Operands: []FilterExpr{
+				&Not{Operand: &TagMatch{Key: "env", Value: "prod"}},
+				&Or{Operands: []FilterExpr{&TagMatch{Key: "service", Value: "api"}, &TagMatch{Key: "host", Value: "web"}}},
+			}},
+			wantString: "!env:prod AND (service:api OR host:web)",
+		},
+		{
+			name:   "in and not in",
+			filter: "env IN (prod, staging) AND region NOT IN (us-east-1, us-west-2)",
+			want: &And{Operands: []FilterExpr{
+				&TagIn{Key: "env", Values: []string{"prod", "staging"}},
+				&Not{Operand: &TagIn{Key: "region", Values: []string{"us-east-1", "us-west-2"}}},
+			}},
+		},
+		{
+			name:       "in list with or separators",
+			filter:     "e IN (f OR g)",
+			want:       &TagIn{Key: "e", Values: []string{"f", "g"}},
+			wantString: "e IN (f, g)",
+		},
+		{
+			name:   "comparisons",
+			filter: "duration:>=100 AND duration:<=200 OR errors:>5",
+			want: &Or{Operands: []FilterExpr{
+				&And{Operands: []FilterExpr{&Compare{Key: "duration", Op: ">=", Value: "100"}, &Compare{Key: "duration", Op: "<=", Value: "200"}}},
+				&Compare{Key: "errors", Op: ">", Value: "5"},
+			}},
+		},
+		{
+			name:   "regex",
+			filter: `host:~"web-.*"`,
+			want:   &Regex{Key: "host", Pattern: "web-.*"},
+		},
+		{
+			name:   "bare tags joined by and not",
+			filter: "foo AND NOT bar",
+			want:   &And{Operands: []FilterExpr{&TagMatch{Key: "foo"}, &Not{Operand: &TagMatch{Key: "bar"}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mf, err := metricFilterParser.ParseString("", tt.filter)
+			require.NoError(t, err)
+
+			tree, err := mf.Tree()
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, tree)
+
+			want := tt.wantString
+			if want == "" {
+				want = tt.filter
+			}
+			rebuilt, err := NewMetricFilter(tree)
+			require.NoError(t, err)
+			assert.Equal(t, want, rebuilt.String())
+
+			again, err := rebuilt.Tree()
+			require.NoError(t, err)
+			assert.Equal(t, tree, again)
+		})
+	}
+}
+
+func Test_NewMetricFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    FilterExpr
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "or inside and is parenthesized",
+			expr: &And{Operands: []FilterExpr{
+				&Or{Operands: []FilterExpr{&TagMatch{Key: "a", Value: "b"}, &TagMatch{Key: "c", Value: "d"}}},
+				&TagMatch{Key: "e", Value: "f"},
+			}},
+			want: "(a:b OR c:d) AND e:f",
+		},
+		{
+			name: "leading compound not",
+			expr: &And{Operands: []FilterExpr{
+				&Not{Operand: &Or{Operands: []FilterExpr{&TagMatch{Key: "a", Value: "b"}, &TagMatch{Key: "c", Value: "d"}}}},
+				&TagMatch{Key: "e", Value: "f"},
+			}},
+			want: " NOT (a:b OR c:d) AND e:f",
+		},
+		{
+			name: "or not of group",
+			expr: &Or{Operands: []FilterExpr{
+				&TagMatch{Key: "a", Value: "b"},
+				&Not{Operand: &And{Operands: []FilterExpr{&TagMatch{Key: "c", Value: "d"}, &TagMatch{Key: "e", Value: "f"}}}},
+			}},
+			want: "a:b OR NOT (c:d AND e:f)",
+		},
+		{
+			name: "double negation",
+			expr: &Not{Operand: &Not{Operand: &TagMatch{Key: "a", Value: "b"}}},
+			want: "a:b",
+		},
+		{
+			name: "negated comparison",
+			expr: &Not{Operand: &Compare{Key: "a", Op: ">", Value: "1"}},
+			want: "!a:>1",
+		},
+		{
+			name: "regex with quotes",
+			expr: &Regex{Key: "path", Pattern: `say "hi"`},
+			want: `path:~"say \"hi\""`,
+		},
+		{
+			name: "bare tag",
+			expr: &TagMatch{Key: "a"},
+			want: "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mf, err := NewMetricFilter(tt.expr)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, mf.String())
+		})
+	}
+}
@@ -0,0 +1,682 @@
+package ddqp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SeparatorStyle selects how Format joins AND-ed filter operands.
+type SeparatorStyle int
+
+const (
+	// SeparatorKeep keeps the separators of the parsed filter.
+	SeparatorKeep SeparatorStyle = iota
+	// SeparatorComma joins AND-ed operands with commas: "{a:b, c:d}".
+	SeparatorComma
+	// SeparatorAnd joins AND-ed operands with AND: "{a:b AND c:d}".
+	SeparatorAnd
+)
+
+// SpacingStyle selects whether Format puts a space after commas.
+type SpacingStyle int
+
+const (
+	// SpacingKeep uses the same spacing as String.
+	SpacingKeep SpacingStyle = iota
+	// SpacingSpaced writes ", ".
+	SpacingSpaced
+	// SpacingCompact writes ",".
+	SpacingCompact
+)
+
+// QuoteStyle selects the quotes Format uses for string literals.
+type QuoteStyle int
+
+const (
+	// QuoteKeep leaves string literals as written.
+	QuoteKeep QuoteStyle = iota
+	// QuoteDouble rewrites string literals with double quotes.
+	QuoteDouble
+	// QuoteSingle rewrites string literals with single quotes unless the
+	// string itself contains a single quote.
+	QuoteSingle
+)
+
+// FormatOptions controls how Format renders a query. The zero value renders
+// the same text as String.
+//
+// Arithmetic operators are always surrounded by spaces: without them the
+// lexer reads "sum:a{*}/sum:b{*}" as a filter value followed by "/sum".
+type FormatOptions struct {
+	// SortTags orders the operands of every AND/OR in a filter, the values
+	// of IN lists and the group-by keys, dropping duplicates. Filters are
+	// rewritten from their Tree, so redundant parentheses disappear too.
+	SortTags bool
+	// FilterSeparator selects how AND-ed filter operands are joined.
+	FilterSeparator SeparatorStyle
+	// CommaSpacing applies to commas in filters, IN lists, group-by keys and
+	// function arguments.
+	CommaSpacing SpacingStyle
+	// Quote selects the quotes used for string literals.
+	Quote QuoteStyle
+	// NormalizeNumbers writes monitor thresholds and the numbers in
+	// expressions in plain decimal form, so "1e6", "+1000000" and
+	// "1000000.0" all become "1000000".
+	NormalizeNumbers bool
+	// Normalize rewrites filters and expressions into the form Equivalent
+	// compares: nested filter groups are flattened, ORs of values of one tag
+	// become an IN list ("env:a OR env:b" is written "env IN (a, b)"),
+	// redundant parentheses are dropped, signs move to the front of each
+	// term and the operands of "+" and "*" are ordered. It implies SortTags.
+	Normalize bool
+	// MaxWidth wraps expressions that are longer than MaxWidth characters
+	// onto one line per top-level "+" or "-" operand. Zero disables wrapping.
+	// Wrapped output still parses because the parsers ignore newlines.
+	MaxWidth int
+	// Indent prefixes wrapped lines. It defaults to two spaces.
+	Indent string
+}
+
+// Canonical renders one stable string for semantically identical queries:
+// filters and expressions are normalized as described for Normalize, tags
+// are sorted and deduplicated, AND is written as a comma, commas are
+// followed by a space, strings use double quotes and numbers are written in
+// plain decimal form. "(sum:a{*} + sum:b{*})" and "sum:b{*} + sum:a{*}" both
+// render as "sum:a{*} + sum:b{*}".
+var Canonical = FormatOptions{
+	SortTags:         true,
+	Normalize:        true,
+	FilterSeparator:  SeparatorComma,
+	CommaSpacing:     SpacingSpaced,
+	Quote:            QuoteDouble,
+	NormalizeNumbers: true,
+}
+
+// Format renders node as query text using opts. Nodes other than queries,
+// expressions, monitors, filters, functions and values are rendered with
+// String.
+func Format(node Node, opts FormatOptions) (string, error) {
+	if opts.Normalize {
+		opts.SortTags = true
+	}
+	f := &formatter{opts: opts}
+	return f.node(node)
+}
+
+type formatter struct {
+	opts FormatOptions
+}
+
+func (f *formatter) node(node Node) (string, error) {
+	switch n := node.(type) {
+	case *GenericQuery:
+		if n.MetricExpression != nil {
+			return f.node(n.MetricExpression)
+		} else if n.MetricQuery != nil {
+			return f.metricQuery(n.MetricQuery)
+		}
+		return "", nil
+	case *MetricQuery:
+		return f.metricQuery(n)
+	case *AggregatorFuction:
+		return f.wrapper(n)
+	case *Query:
+		return f.query(n)
+	case *MetricFilter:
+		return f.filter(n)
+	case *Function:
+		return f.function(n), nil
+	case *Value:
+		return f.value(n), nil
+	case *MetricExpression:
+		return f.expression(n.GroupedExpression, true)
+	case *GroupedExpression:
+		return f.expression(n, true)
+	case *MetricMonitor:
+		return f.monitor(n)
+	case monitorFunction:
+		return f.monitorFunction(n)
+	}
+	return node.String(), nil
+}
+
+// comma returns the comma separator, using keep when the style is
+// SpacingKeep.
+func (f *formatter) comma(keep string) string {
+	switch f.opts.CommaSpacing {
+	case SpacingSpaced:
+		return ", "
+	case SpacingCompact:
+		return ","
+	}
+	return keep
+}
+
+func (f *formatter) quote(s string) string {
+	if f.opts.Quote == QuoteKeep || len(s) < 2 || (s[0] != '"' && s[0] != '\'') {
+		return s
+	}
+	inner := unquote(s)
+	if f.opts.Quote == QuoteSingle && !strings.Contains(inner, "'") {
+		return "'" + inner + "'"
+	}
+	return `"` + strings.ReplaceAll(inner, `"`, `\"`) + `"`
+}
+
+func (f *formatter) metricQuery(mq *MetricQuery) (string, error) {
+	if mq.Query != nil {
+		return f.query(mq.Query)
+	}
+	if mq.AggregatorFuction != nil {
+		return f.wrapper(mq.AggregatorFuction)
+	}
+	return "", fmt.Errorf("empty metric query")
+}
+
+func (f *formatter) wrapper(w *AggregatorFuction) (string, error) {
+	body, err := f.metricQuery(w.Body)
+	if err != nil {
+		return "", err
+	}
+	parts := []string{body}
+	for _, v := range w.Args {
+		parts = append(parts, f.value(v))
+	}
+	return fmt.Sprintf("%s(%s)", w.Name, strings.Join(parts, f.comma(", "))), nil
+}
+
+func (f *formatter) query(q *Query) (string, error) {
+	var sb strings.Builder
+	if q.Aggregator != nil {
+		sb.WriteString(q.Aggregator.String())
+	}
+	sb.WriteString(q.MetricName)
+
+	filter := "*"
+	if q.Filters != nil {
+		var err error
+		if filter, err = f.filter(q.Filters); err != nil {
+			return "", err
+		}
+	}
+	sb.WriteString("{" + filter + "}")
+
+	if len(q.Grouping) > 0 {
+		grouping := q.Grouping
+		if f.opts.SortTags {
+			grouping = sortedUnique(grouping)
+		}
+		sb.WriteString(" by {" + strings.Join(grouping, f.comma(",")) + "}")
+	}
+
+	for _, fn := range q.Function {
+		sb.WriteString("." + f.function(fn))
+	}
+	return sb.String(), nil
+}
+
+func (f *formatter) function(fn *Function) string {
+	args := []string{}
+	for _, v := range fn.Args {
+		args = append(args, f.value(v))
+	}
+	return fmt.Sprintf("%s(%s)", fn.Name, strings.Join(args, f.comma(",")))
+}
+
+func (f *formatter) value(v *Value) string {
+	switch {
+	case v.Separator != nil && v.Separator.Comma:
+		return f.comma(", ")
+	case v.Str != nil:
+		return f.quote(*v.Str)
+	}
+	return v.String()
+}
+
+func (f *formatter) filter(mf *MetricFilter) (string, error) {
+	if !f.opts.SortTags && f.opts.FilterSeparator == SeparatorKeep {
+		params := []*Param{}
+		if mf.Left != nil {
+			params = append(params, mf.Left)
+		}
+		return f.params(append(params, mf.Parameters...)), nil
+	}
+
+	tree, err := mf.Tree()
+	if err != nil {
+		return "", err
+	}
+	if f.opts.Normalize {
+		tree = normalizeFilter(tree)
+	}
+	tree = f.filterExpr(tree)
+
+	style := filterStyle{and: " AND ", list: f.comma(", ")}
+	if f.opts.FilterSeparator == SeparatorComma ||
+		(f.opts.FilterSeparator == SeparatorKeep && usesCommas(mf)) {
+		style.and = f.comma(", ")
+	}
+	return printFilterExpr(tree, style), nil
+}
+
+// params renders the filter token stream as parsed, only applying spacing and
+// quoting.
+func (f *formatter) params(params []*Param) string {
+	var sb strings.Builder
+	for _, p := range params {
+		switch {
+		case p.Separator != nil && p.Separator.Comma:
+			sb.WriteString(f.comma(", "))
+		case p.GroupedFilter != nil:
+			sb.WriteString("(" + f.params(p.GroupedFilter.Parameters) + ")")
+		case p.SimpleFilter != nil:
+			sb.WriteString(f.simpleFilter(p.SimpleFilter))
+		default:
+			sb.WriteString(p.String())
+		}
+	}
+	return sb.String()
+}
+
+func (f *formatter) simpleFilter(sf *SimpleFilter) string {
+	var sb strings.Builder
+	if sf.Negative {
+		sb.WriteString("!")
+	}
+	sb.WriteString(sf.FilterKey)
+	if sf.FilterSeparator == nil || sf.FilterValue == nil {
+		return sb.String()
+	}
+	sb.WriteString(sf.FilterSeparator.String())
+	if len(sf.FilterValue.ListValue) > 0 {
+		sb.WriteString("(")
+		for _, v := range sf.FilterValue.ListValue {
+			sb.WriteString(f.value(v))
+		}
+		sb.WriteString(")")
+	} else {
+		sb.WriteString(f.value(sf.FilterValue.SimpleValue))
+	}
+	return sb.String()
+}
+
+// usesCommas reports whether the first AND-like separator at the top level of
+// the filter is a comma.
+func usesCommas(mf *MetricFilter) bool {
+	for _, p := range mf.Parameters {
+		if p.Separator == nil {
+			continue
+		}
+		if p.Separator.Comma {
+			return true
+		}
+		if p.Separator.And || p.Separator.AndNot {
+			return false
+		}
+	}
+	return false
+}
+
+// filterExpr applies quoting and, with SortTags, sorts and deduplicates the
+// operands of the tree.
+func (f *formatter) filterExpr(expr FilterExpr) FilterExpr {
+	switch e := expr.(type) {
+	case *And:
+		return &And{Operands: f.filterOperands(e.Operands)}
+	case *Or:
+		return &Or{Operands: f.filterOperands(e.Operands)}
+	case *Not:
+		return &Not{Operand: f.filterExpr(e.Operand)}
+	case *TagMatch:
+		return &TagMatch{Key: e.Key, Value: f.quote(e.Value)}
+	case *TagIn:
+		values := []string{}
+		for _, v := range e.Values {
+			values = append(values, f.quote(v))
+		}
+		if f.opts.SortTags {
+			values = sortedUnique(values)
+		}
+		return &TagIn{Key: e.Key, Values: values}
+	case *Compare:
+		return &Compare{Key: e.Key, Op: e.Op, Value: f.quote(e.Value)}
+	}
+	return expr
+}
+
+func (f *formatter) filterOperands(operands []FilterExpr) []FilterExpr {
+	out := []FilterExpr{}
+	for _, op := range operands {
+		out = append(out, f.filterExpr(op))
+	}
+	if !f.opts.SortTags {
+		return out
+	}
+
+	seen := map[string]bool{}
+	unique := []FilterExpr{}
+	for _, op := range out {
+		key := printFilterExpr(op, defaultFilterStyle)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, op)
+		}
+	}
+	// negations that need the "AND NOT"/"OR NOT" form cannot come first
+	sort.SliceStable(unique, func(i, j int) bool {
+		ni, nj := needsNotSeparator(unique[i]), needsNotSeparator(unique[j])
+		if ni != nj {
+			return nj
+		}
+		return printFilterExpr(unique[i], defaultFilterStyle) < printFilterExpr(unique[j], defaultFilterStyle)
+	})
+	return unique
+}
+
+func needsNotSeparator(expr FilterExpr) bool {
+	if _, ok := isCompoundNot(expr); ok {
+		return true
+	}
+	if n, ok := expr.(*Not); ok {
+		if tm, ok := n.Operand.(*TagMatch); ok && tm.Value == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedUnique(values []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (f *formatter) expression(ge *GroupedExpression, top bool) (string, error) {
+	if ge == nil {
+		return "", fmt.Errorf("empty expression")
+	}
+	var terms []string
+	var ops []Operator
+	if f.opts.Normalize {
+		normalized, err := f.normalizedSum(ge, false)
+		if err != nil {
+			return "", err
+		}
+		terms, ops = normalized.terms()
+	} else {
+		left, err := f.term(ge.Left)
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, left)
+		for _, r := range ge.Right {
+			term, err := f.term(r.Term)
+			if err != nil {
+				return "", err
+			}
+			terms = append(terms, term)
+			ops = append(ops, r.Operator)
+		}
+	}
+
+	out := joinTerms(terms, ops)
+	if !top || f.opts.MaxWidth <= 0 || len(out) <= f.opts.MaxWidth || len(ops) == 0 {
+		return out, nil
+	}
+
+	indent := f.opts.Indent
+	if indent == "" {
+		indent = "  "
+	}
+	var sb strings.Builder
+	sb.WriteString(terms[0])
+	for i, op := range ops {
+		sb.WriteString("\n" + indent + op.String() + " " + terms[i+1])
+	}
+	return sb.String(), nil
+}
+
+func (f *formatter) term(t *Term) (string, error) {
+	if t == nil {
+		return "", fmt.Errorf("empty expression term")
+	}
+	left, err := f.factor(t.Left)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(left)
+	for _, r := range t.Right {
+		factor, err := f.factor(r.Factor)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(" " + r.Operator.String() + " " + factor)
+	}
+	return sb.String(), nil
+}
+
+func (f *formatter) factor(fa *Factor) (string, error) {
+	if fa == nil || fa.Base == nil {
+		return "", fmt.Errorf("empty expression factor")
+	}
+	base := fa.Base
+	switch {
+	case base.Number != nil || base.Literal != nil:
+		if f.opts.NormalizeNumbers && base.Number != nil {
+			return formatFloatNoExp(*base.Number), nil
+		}
+		return base.numberString(), nil
+	case base.Unary != nil:
+		operand, err := f.factor(&Factor{Base: base.Unary.Operand})
+		if err != nil {
+			return "", err
+		}
+		return base.Unary.Operator.String() + operand, nil
+	case base.MetricQuery != nil:
+		return f.metricQuery(base.MetricQuery)
+	case base.Reference != nil:
+		return string(*base.Reference), nil
+	case base.ExprAggregatorFuction != nil:
+		fn := base.ExprAggregatorFuction
+		body, err := f.expression(fn.Body, false)
+		if err != nil {
+			return "", err
+		}
+		parts := []string{body}
+		for _, v := range fn.Args {
+			parts = append(parts, f.value(v))
+		}
+		return fmt.Sprintf("%s(%s)", fn.Name, strings.Join(parts, f.comma(", "))), nil
+	case base.Subexpression != nil:
+		inner, err := f.expression(base.Subexpression.GroupedExpression, false)
+		if err != nil {
+			return "", err
+		}
+		return "(" + inner + ")", nil
+	case base.monitorFunction() != nil:
+		return f.monitorFunction(base.monitorFunction())
+	}
+	return "", fmt.Errorf("empty expression factor")
+}
+
+func (f *formatter) monitorFunction(fn monitorFunction) (string, error) {
+	c := fn.call()
+	body, err := f.expression(c.body, false)
+	if err != nil {
+		return "", err
+	}
+	return c.render(body, f.quote(c.algorithmString()), f.monitorNumber, f.value, f.comma(", ")), nil
+}
+
+func (f *formatter) monitorNumber(n monitorNumber) string {
+	if f.opts.NormalizeNumbers {
+		return formatFloatNoExp(*n.value)
+	}
+	return n.String()
+}
+
+func (f *formatter) monitor(mm *MetricMonitor) (string, error) {
+	var query string
+	var err error
+	if mm.MetricExpression != nil {
+		query, err = f.expression(mm.MetricExpression.GroupedExpression, true)
+	} else {
+		query, err = f.metricQuery(mm.MetricQuery)
+	}
+	if err != nil {
+		return "", err
+	}
+	threshold := literalString(mm.ThresholdLiteral, mm.Threshold)
+	if f.opts.NormalizeNumbers {
+		threshold = formatFloatNoExp(mm.Threshold)
+	}
+	return fmt.Sprintf("%s:%s %s %s", mm.timeAggregation(), query, mm.Comparator, threshold), nil
+}
+
+// formattedSum is an expression flattened into signed products of formatted
+// factors, as normalizeSum does for Equivalent.
+type formattedSum []formattedTerm
+
+type formattedTerm struct {
+	negative bool
+	factors  []string
+	divisors []string
+}
+
+func (f *formatter) normalizedSum(ge *GroupedExpression, negative bool) (formattedSum, error) {
+	out, err := f.normalizedTerm(ge.Left, negative)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ge.Right {
+		terms, err := f.normalizedTerm(r.Term, negative != (r.Operator == OpSub))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, terms...)
+	}
+	return out, nil
+}
+
+func (f *formatter) normalizedTerm(t *Term, negative bool) (formattedSum, error) {
+	if t == nil {
+		return nil, fmt.Errorf("empty expression term")
+	}
+	left, flip := stripSigns(t.Left)
+	negative = negative != flip
+	// "(a + b)" on its own contributes its terms directly
+	if len(t.Right) == 0 && left != nil && left.Base != nil && left.Base.Subexpression != nil {
+		return f.normalizedSum(left.Base.Subexpression.GroupedExpression, negative)
+	}
+	term := &formattedTerm{}
+	if err := f.normalizedFactor(term, left, false); err != nil {
+		return nil, err
+	}
+	for _, r := range t.Right {
+		factor, flip := stripSigns(r.Factor)
+		negative = negative != flip
+		if err := f.normalizedFactor(term, factor, r.Operator == OpDiv); err != nil {
+			return nil, err
+		}
+	}
+	term.negative = negative
+	return formattedSum{*term}, nil
+}
+
+func (f *formatter) normalizedFactor(term *formattedTerm, fa *Factor, divide bool) error {
+	factors, divisors := &term.factors, &term.divisors
+	if divide {
+		factors, divisors = divisors, factors
+	}
+	if fa != nil && fa.Base != nil && fa.Base.Subexpression != nil {
+		inner, err := f.normalizedSum(fa.Base.Subexpression.GroupedExpression, false)
+		if err != nil {
+			return err
+		}
+		// a parenthesized product is flattened into the outer product
+		if len(inner) == 1 && !inner[0].negative {
+			*factors = append(*factors, inner[0].factors...)
+			*divisors = append(*divisors, inner[0].divisors...)
+			return nil
+		}
+		terms, ops := inner.terms()
+		*factors = append(*factors, "("+joinTerms(terms, ops)+")")
+		return nil
+	}
+	s, err := f.factor(fa)
+	if err != nil {
+		return err
+	}
+	*factors = append(*factors, s)
+	return nil
+}
+
+// terms orders the terms of s, positive ones first, and returns them with
+// the operators that join them.
+func (s formattedSum) terms() ([]string, []Operator) {
+	type rendered struct {
+		negative bool
+		text     string
+	}
+	all := []rendered{}
+	for _, t := range s {
+		all = append(all, rendered{t.negative, t.String()})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].negative != all[j].negative {
+			return !all[i].negative
+		}
+		return all[i].text < all[j].text
+	})
+
+	terms := []string{}
+	ops := []Operator{}
+	for i, t := range all {
+		switch {
+		case i > 0 && t.negative:
+			ops = append(ops, OpSub)
+		case i > 0:
+			ops = append(ops, OpAdd)
+		case t.negative && strings.HasPrefix(t.text, "-"):
+			// "--1 * a" does not lex
+			t.text = "-(" + t.text + ")"
+		case t.negative:
+			t.text = "-" + t.text
+		}
+		terms = append(terms, t.text)
+	}
+	return terms, ops
+}
+
+func (t formattedTerm) String() string {
+	factors := append([]string{}, t.factors...)
+	divisors := append([]string{}, t.divisors...)
+	sort.Strings(factors)
+	sort.Strings(divisors)
+	if len(factors) == 0 {
+		factors = []string{"1"}
+	}
+	out := strings.Join(factors, " * ")
+	for _, d := range divisors {
+		out += " / " + d
+	}
+	return out
+}
+
+func joinTerms(terms []string, ops []Operator) string {
+	var sb strings.Builder
+	sb.WriteString(terms[0])
+	for i, op := range ops {
+		sb.WriteString(" " + op.String() + " " + terms[i+1])
+	}
+	return sb.String()
+}
@@ -0,0 +1,256 @@
+package ddqp
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Format(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		opts  FormatOptions
+		want  string
+	}{
+		{
+			name:  "zero options match String",
+			query: "sum:metric.name{env:prod,  service:web} by {host,az}.rollup(avg, 60)",
+			want:  "sum:metric.name{env:prod, service:web} by {host,az}.rollup(avg,60)",
+		},
+		{
+			name:  "sort tags",
+			query: "sum:metric.name{service:web, env:prod, env:prod} by {host,az,host}",
+			opts:  FormatOptions{SortTags: true},
+			want:  "sum:metric.name{env:prod, service:web} by {az,host}",
+		},
+		{
+			name:  "sort nested operands and lists",
+			query: "sum:metric.name{(zone:b OR zone:a) AND region IN (us-west, eu, us-west)}",
+			opts:  FormatOptions{SortTags: true},
+			want:  "sum:metric.name{region IN (eu, us-west) AND (zone:a OR zone:b)}",
+		},
+		{
+			name:  "sort keeps negated bare tags last",
+			query: "sum:metric.name{foo AND NOT bar AND baz:qux}",
+			opts:  FormatOptions{SortTags: true},
+			want:  "sum:metric.name{baz:qux AND foo AND NOT bar}",
+		},
+		{
+			name:  "comma separator",
+			query: "sum:metric.name{env:prod AND service:web}",
+			opts:  FormatOptions{FilterSeparator: SeparatorComma},
+			want:  "sum:metric.name{env:prod, service:web}",
+		},
+		{
+			name:  "and separator",
+			query: "sum:metric.name{env:prod, (service:web OR service:api)}",
+			opts:  FormatOptions{FilterSeparator: SeparatorAnd},
+			want:  "sum:metric.name{env:prod AND (service:web OR service:api)}",
+		},
+		{
+			name:  "compact commas",
+			query: "sum:metric.name{env:prod, region IN (a, b)} by {host,az}.rollup(avg,60)",
+			opts:  FormatOptions{CommaSpacing: SpacingCompact},
+			want:  "sum:metric.name{env:prod,region IN (a,b)} by {host,az}.rollup(avg,60)",
+		},
+		{
+			name:  "spaced commas",
+			query: "top(sum:metric.name{env:prod,service:web} by {host,az}.rollup(avg,60),10,'mean','desc')",
+			opts:  FormatOptions{CommaSpacing: SpacingSpaced},
+			want:  "top(sum:metric.name{env:prod, service:web} by {host, az}.rollup(avg, 60), 10, 'mean', 'desc')",
+		},
+		{
+			name:  "double quotes",
+			query: "top(sum:metric.name{*} by {host}, 10, 'mean', 'desc')",
+			opts:  FormatOptions{Quote: QuoteDouble},
+			want:  `top(sum:metric.name{*} by {host}, 10, "mean", "desc")`,
+		},
+		{
+			name:  "single quotes",
+			query: `sum:metric.name{*}.label("CPU User")`,
+			opts:  FormatOptions{Quote: QuoteSingle},
+			want:  `sum:metric.name{*}.label('CPU User')`,
+		},
+		{
+			name:  "wrap long expressions",
+			query: "sum:requests.errors{env:prod} + sum:requests.timeouts{env:prod} - sum:requests.retries{env:prod}",
+			opts:  FormatOptions{MaxWidth: 40},
+			want:  "sum:requests.errors{env:prod}\n  + sum:requests.timeouts{env:prod}\n  - sum:requests.retries{env:prod}",
+		},
+		{
+			name:  "short expressions are not wrapped",
+			query: "sum:a{*} + sum:b{*}",
+			opts:  FormatOptions{MaxWidth: 40, Indent: "\t"},
+			want:  "sum:a{*} + sum:b{*}",
+		},
+		{
+			name:  "custom indent",
+			query: "sum:a{*} + sum:b{*}",
+			opts:  FormatOptions{MaxWidth: 10, Indent: "\t"},
+			want:  "sum:a{*}\n\t+ sum:b{*}",
+		},
+	}
+	parser := NewGenericParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+
+			got, err := Format(ast, tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+
+			_, err = parser.Parse(got)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_FormatMonitor(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("avg(last_5m):sum:metric.name{service:web,env:prod} by {host} > 1e6")
+	require.NoError(t, err)
+
+	got, err := Format(m, FormatOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "avg(last_5m):sum:metric.name{service:web, env:prod} by {host} > 1e6", got)
+
+	got, err = Format(m, Canonical)
+	require.NoError(t, err)
+	assert.Equal(t, "avg(last_5m):sum:metric.name{env:prod, service:web} by {host} > 1000000", got)
+}
+
+func Test_FormatCanonical(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []string
+		want    string
+	}{
+		{
+			name: "separators, order and duplicates",
+			queries: []string{
+				"sum:metric.name{env:prod, service:web} by {host,az}",
+				"sum:metric.name{service:web AND env:prod} by {az, host}",
+				"sum:metric.name{(env:prod) and service:web and env:prod} by {az,host,az}",
+			},
+			want: "sum:metric.name{env:prod, service:web} by {az, host}",
+		},
+		{
+			name: "in lists and or groups",
+			queries: []string{
+				"sum:metric.name{region IN (b, a) AND (zone:y OR zone:x)}",
+				"sum:metric.name{(zone:x OR zone:y), region in (a,b)}",
+			},
+			want: "sum:metric.name{region IN (a, b), zone IN (x, y)}",
+		},
+		{
+			name: "expression numbers",
+			queries: []string{
+				"1e6 * -sum:a{*}",
+				"1000000.0 * -sum:a{*}",
+			},
+			want: "-1000000 * sum:a{*}",
+		},
+		{
+			name: "redundant parentheses",
+			queries: []string{
+				"(sum:a{*})",
+				"sum:a{*}",
+				"((sum:a{*}))",
+			},
+			want: "sum:a{*}",
+		},
+		{
+			name: "commutative operands",
+			queries: []string{
+				"sum:a{*} + sum:b{*}",
+				"sum:b{*} + sum:a{*}",
+				"(sum:b{*} + (sum:a{*}))",
+			},
+			want: "sum:a{*} + sum:b{*}",
+		},
+		{
+			name: "products and signs",
+			queries: []string{
+				"sum:b{*} * sum:a{*} / sum:c{*} - sum:d{*}",
+				"-sum:d{*} + sum:a{*} * (sum:b{*} / sum:c{*})",
+				"-(sum:d{*} - sum:b{*} * sum:a{*} / sum:c{*})",
+			},
+			want: "sum:a{*} * sum:b{*} / sum:c{*} - sum:d{*}",
+		},
+		{
+			name: "or of tag values",
+			queries: []string{
+				"sum:a{env IN (a, b)}",
+				"sum:a{env:a OR env:b}",
+				"sum:a{env:b OR (env:a)}",
+			},
+			want: "sum:a{env IN (a, b)}",
+		},
+		{
+			name: "expression quotes",
+			queries: []string{
+				"sum:a{*}.label('x') / sum:b{*}",
+				`sum:a{*}.label("x") / sum:b{*}`,
+			},
+			want: `sum:a{*}.label("x") / sum:b{*}`,
+		},
+	}
+	parser := NewGenericParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, q := range tt.queries {
+				ast, err := parser.Parse(q)
+				require.NoError(t, err)
+				got, err := Format(ast, Canonical)
+				require.NoError(t, err)
+				assert.Equal(t, tt.want, got, q)
+			}
+		})
+	}
+}
+
+func Test_FormatFromFile(t *testing.T) {
+	f, err := os.Open("./test_queries.txt")
+	if err != nil {
+		t.Skipf("skipping file-driven tests; could not open test_queries.txt: %v", err)
+		return
+	}
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	parser := NewGenericParser()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		t.Run("line_"+fmt.Sprintf("%d", lineNum), func(t *testing.T) {
+			ast, err := parser.Parse(line)
+			require.NoError(t, err)
+
+			got, err := Format(ast, FormatOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, ast.String(), got)
+
+			canonical, err := Format(ast, Canonical)
+			require.NoError(t, err)
+			reparsed, err := parser.Parse(canonical)
+			require.NoError(t, err, canonical)
+			again, err := Format(reparsed, Canonical)
+			require.NoError(t, err)
+			assert.Equal(t, canonical, again)
+		})
+	}
+	require.NoError(t, scanner.Err())
+}
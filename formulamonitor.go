@@ -0,0 +1,223 @@
+package ddqp
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// QueryReference is the name of a sub-query in a formula, e.g. "errors" in
+// "errors / hits * 100". Names start with a letter or an underscore and
+// contain only letters, digits and underscores. A name that reads as a
+// number, such as "inf", is parsed as a number instead.
+type QueryReference string
+
+var queryReferencePattern = regexp.MustCompile(`^[A-Za-z_]\w*$`)
+
+func (r QueryReference) valid() bool {
+	if !queryReferencePattern.MatchString(string(r)) {
+		return false
+	}
+	_, err := strconv.ParseFloat(string(r), 64)
+	return err != nil
+}
+
+// Parse implements participle.Parseable so that references are tried before
+// the numeric operand, whose conversion would fail on a name.
+func (r *QueryReference) Parse(lex *lexer.PeekingLexer) error {
+	tok := lex.Peek()
+	if tok.EOF() || !QueryReference(tok.Value).valid() {
+		return participle.NextMatch
+	}
+	lex.Next()
+	*r = QueryReference(tok.Value)
+	return nil
+}
+
+// FormulaMonitor is a monitor whose query is a formula over named sub-queries,
+// such as
+//
+//	sum(last_5m):errors / hits * 100 > 5
+//
+// where errors and hits are defined separately, e.g. as
+// "sum:trace.http.request.errors{service:web}.as_count()".
+type FormulaMonitor struct {
+	Pos lexer.Position
+
+	Aggregation      string `parser:"@Ident"`
+	EvaluationWindow string `parser:"'(' @Ident ')' ':'"`
+	// Formula uses the arithmetic grammar of MetricExpression; sub-queries
+	// appear in it as ExprValues with a Reference.
+	Formula *MetricExpression `parser:"@@"`
+	Condition
+
+	// Queries maps sub-query names to their parsed form: a *MetricQuery for
+	// metric queries and a *SearchQuery for search based data sources such as
+	// logs, events or RUM.
+	Queries map[string]Node
+}
+
+// String returns the compact monitor query, which refers to the sub-queries
+// by name.
+func (fm *FormulaMonitor) String() string {
+	return fm.render(fm.Formula)
+}
+
+func (fm *FormulaMonitor) render(formula *MetricExpression) string {
+	return fmt.Sprintf("%s(%s):%s %s", fm.Aggregation, fm.EvaluationWindow, formula.String(), fm.Condition)
+}
+
+// Expand returns the equivalent monitor query with every sub-query written
+// inline, e.g. "sum(last_5m):sum:errors{*} / sum:hits{*} * 100 > 5". Only
+// metric sub-queries can be written inline.
+func (fm *FormulaMonitor) Expand() (string, error) {
+	// work on a copy so that the monitor keeps its references
+	formula, err := formulaParser.Parse(fm.Formula.String())
+	if err != nil {
+		return "", err
+	}
+	err = inlineQueries(formula, func(name string) (*MetricQuery, error) {
+		mq, ok := fm.Queries[name].(*MetricQuery)
+		if !ok {
+			if fm.Queries[name] == nil {
+				return nil, fmt.Errorf("query %q is not defined", name)
+			}
+			return nil, fmt.Errorf("query %q is not a metric query and cannot be written inline", name)
+		}
+		return mq, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fm.render(formula), nil
+}
+
+// References returns the names the formula refers to, in the order they first
+// appear.
+func (fm *FormulaMonitor) References() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, ev := range queryReferences(fm.Formula) {
+		if name := string(*ev.Reference); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// UnusedQueries returns the sorted names of the sub-queries the formula does
+// not refer to.
+func (fm *FormulaMonitor) UnusedQueries() []string {
+	used := map[string]bool{}
+	for _, name := range fm.References() {
+		used[name] = true
+	}
+	unused := []string{}
+	for name := range fm.Queries {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// queryReferences returns the values below root that refer to a sub-query.
+func queryReferences(root Node) []*ExprValue {
+	refs := []*ExprValue{}
+	Inspect(root, func(n Node) bool {
+		if ev, ok := n.(*ExprValue); ok && ev.Reference != nil {
+			refs = append(refs, ev)
+		}
+		return true
+	})
+	return refs
+}
+
+func (fm *FormulaMonitor) Position() lexer.Position { return fm.Pos }
+func (fm *FormulaMonitor) Kind() NodeKind           { return KindFormulaMonitor }
+
+func (fm *FormulaMonitor) Children() []Node {
+	nodes := []Node{}
+	if fm.Formula != nil {
+		nodes = append(nodes, fm.Formula)
+	}
+	names := []string{}
+	for name := range fm.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		nodes = append(nodes, fm.Queries[name])
+	}
+	return nodes
+}
+
+// NewFormulaMonitorParser returns a Parser which is capable of interpretting
+// a formula monitor and its sub-queries.
+func NewFormulaMonitorParser() *FormulaMonitorParser {
+	fmp := &FormulaMonitorParser{
+		parser: participle.MustBuild[FormulaMonitor](
+			participle.Lexer(exprLex),
+		),
+	}
+
+	return fmp
+}
+
+// FormulaMonitorParser is parser returned when calling NewFormulaMonitorParser.
+type FormulaMonitorParser struct {
+	parser *participle.Parser[FormulaMonitor]
+}
+
+// Parse parses a formula monitor query together with its sub-queries, which
+// are keyed by name. Each sub-query is parsed as a metric query or, failing
+// that, as a search string. A reference to an undefined sub-query is reported
+// as a *ParseError for query; use UnusedQueries to find sub-queries the
+// formula does not refer to.
+func (fmp *FormulaMonitorParser) Parse(query string, queries map[string]string) (*FormulaMonitor, error) {
+	// the parser doesn't handle queries that are split up across multiple lines
+	sanitized := strings.ReplaceAll(query, "\n", "")
+	ast, err := fmp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+	if err := ast.Condition.resolve(query, sanitized); err != nil {
+		return nil, err
+	}
+	if err := resolveMonitorFunctions(sanitized, ast); err != nil {
+		return nil, newParseError(query, err)
+	}
+	resolveNumbers(ast)
+	for _, ev := range queryReferences(ast) {
+		if _, ok := queries[string(*ev.Reference)]; !ok {
+			return nil, newParseError(query, participle.Errorf(ev.Pos, "query %q is not defined", string(*ev.Reference)))
+		}
+	}
+
+	ast.Queries = map[string]Node{}
+	for name, q := range queries {
+		if ast.Queries[name], err = parseFormulaQuery(q); err != nil {
+			return nil, fmt.Errorf("query %q: %w", name, err)
+		}
+	}
+	return ast, nil
+}
+
+func parseFormulaQuery(query string) (Node, error) {
+	mq, metricErr := metricQueryParser.Parse(query)
+	if metricErr == nil {
+		return mq, nil
+	}
+	sq, searchErr := searchQueryParser.Parse(query)
+	if searchErr == nil {
+		return sq, nil
+	}
+	return nil, fmt.Errorf("neither a metric query (%v) nor a search (%v)", metricErr, searchErr)
+}
@@ -0,0 +1,92 @@
+package ddqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FormulaMonitor(t *testing.T) {
+	parser := NewFormulaMonitorParser()
+	queries := map[string]string{
+		"errors": "sum:trace.http.request.errors{service:web}.as_count()",
+		"hits":   "sum:trace.http.request.hits{service:web}.as_count()",
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expanded string
+		wantErr  bool
+	}{
+		{
+			name:     "request example",
+			query:    "sum(last_5m):errors / hits * 100 > 5",
+			expanded: "sum(last_5m):sum:trace.http.request.errors{service:web}.as_count() / sum:trace.http.request.hits{service:web}.as_count() * 100 > 5",
+		},
+		{
+			name:     "grouped with function",
+			query:    "avg(last_15m):abs((errors - hits) / hits) >= 0.5",
+			expanded: "avg(last_15m):abs((sum:trace.http.request.errors{service:web}.as_count() - sum:trace.http.request.hits{service:web}.as_count()) / sum:trace.http.request.hits{service:web}.as_count()) >= 0.5",
+		},
+		{
+			name:    "undefined query",
+			query:   "sum(last_5m):errors / requests > 5",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fm, err := parser.Parse(tt.query, queries)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, fm.String())
+
+			expanded, err := fm.Expand()
+			require.NoError(t, err)
+			assert.Equal(t, tt.expanded, expanded)
+			assert.Equal(t, tt.query, fm.String())
+
+			_, err = NewMetricMonitorParser().Parse(expanded)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func Test_FormulaMonitorQueries(t *testing.T) {
+	fm, err := NewFormulaMonitorParser().Parse("sum(last_5m):errors / hits > 0.1", map[string]string{
+		"errors":  "status:error service:web",
+		"hits":    "sum:trace.http.request.hits{service:web}.as_count()",
+		"latency": "avg:trace.http.request.duration{service:web}",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"errors", "hits"}, fm.References())
+	assert.Equal(t, []string{"latency"}, fm.UnusedQueries())
+	assert.IsType(t, &SearchQuery{}, fm.Queries["errors"])
+	assert.IsType(t, &MetricQuery{}, fm.Queries["hits"])
+
+	_, err = fm.Expand()
+	assert.EqualError(t, err, `query "errors" is not a metric query and cannot be written inline`)
+}
+
+func Test_FormulaMonitorErrors(t *testing.T) {
+	_, err := NewFormulaMonitorParser().Parse("sum(last_5m):errors / requests > 5", map[string]string{"errors": "sum:errors{*}"})
+	var pe *ParseError
+	require.True(t, errors.As(err, &pe))
+	assert.Equal(t, 23, pe.Pos.Column)
+	assert.Contains(t, pe.Error(), `query "requests" is not defined`)
+
+	_, err = NewFormulaMonitorParser().Parse("sum(last_5m):errors > 5", map[string]string{"errors": "sum:errors{"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `query "errors"`)
+
+	_, err = NewMetricMonitorParser().Parse("sum(last_5m):errors / sum:hits{*} > 5")
+	require.True(t, errors.As(err, &pe))
+	assert.Contains(t, pe.Error(), `unknown query "errors"`)
+}
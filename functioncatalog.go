@@ -0,0 +1,178 @@
+package ddqp
+
+import (
+	"fmt"
+	"sort"
+)
+
+// FunctionPlacement says where a function is written.
+type FunctionPlacement int
+
+const (
+	// MethodFunction is chained onto a query, e.g. ".as_rate()" or
+	// ".rollup(avg, 60)".
+	MethodFunction FunctionPlacement = iota
+	// WrapperFunction takes a query or expression as its first argument,
+	// e.g. "abs(q)" or "top(q, 10, 'mean', 'desc')".
+	WrapperFunction
+)
+
+func (p FunctionPlacement) String() string {
+	if p == MethodFunction {
+		return "method"
+	}
+	return "wrapper"
+}
+
+// ArgKind is the kind of value a function argument accepts.
+type ArgKind int
+
+const (
+	// ArgNumber is a number such as 60.
+	ArgNumber ArgKind = iota
+	// ArgWord is an unquoted word such as avg.
+	ArgWord
+	// ArgString is a quoted string such as 'desc'.
+	ArgString
+)
+
+func (k ArgKind) String() string {
+	switch k {
+	case ArgNumber:
+		return "number"
+	case ArgWord:
+		return "word"
+	}
+	return "string"
+}
+
+// FunctionArg describes an argument of a function. The query a wrapper
+// function applies to is not listed.
+type FunctionArg struct {
+	Name string
+	Kind ArgKind
+	// Values lists the accepted values of a word or string argument, without
+	// quotes. Empty accepts any value.
+	Values []string
+	// Optional arguments may be left out, along with every argument after
+	// them.
+	Optional bool
+	// Default is the value Datadog uses when an optional argument is left
+	// out, if there is one.
+	Default string
+}
+
+// FunctionSpec describes a Datadog query function.
+type FunctionSpec struct {
+	Name      string
+	Placement FunctionPlacement
+	Args      []FunctionArg
+	// Deprecated functions still work but should be replaced, by
+	// Replacement if it is set.
+	Deprecated  bool
+	Replacement string
+}
+
+// FunctionCatalog is a set of known functions, used by Validate. Create one
+// with NewFunctionCatalog and add private or newer functions with Register.
+type FunctionCatalog struct {
+	functions map[string]*FunctionSpec
+}
+
+// NewFunctionCatalog returns a catalog of the built-in Datadog functions.
+func NewFunctionCatalog() *FunctionCatalog {
+	c := &FunctionCatalog{functions: map[string]*FunctionSpec{}}
+	for _, spec := range builtinFunctions() {
+		c.Register(spec)
+	}
+	return c
+}
+
+// Register adds spec to the catalog, replacing any function of the same name.
+func (c *FunctionCatalog) Register(spec *FunctionSpec) {
+	if c.functions == nil {
+		c.functions = map[string]*FunctionSpec{}
+	}
+	c.functions[spec.Name] = spec
+}
+
+// Lookup returns the function called name.
+func (c *FunctionCatalog) Lookup(name string) (*FunctionSpec, bool) {
+	spec, ok := c.functions[name]
+	return spec, ok
+}
+
+// Functions returns every function in the catalog, sorted by name.
+func (c *FunctionCatalog) Functions() []*FunctionSpec {
+	specs := []*FunctionSpec{}
+	for _, spec := range c.functions {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	return specs
+}
+
+var rollupMethods = []string{"avg", "sum", "min", "max", "count"}
+
+// builtinFunctions lists the functions documented by Datadog. anomalies(),
+// forecast() and outliers() have their own node types and are not listed.
+func builtinFunctions() []*FunctionSpec {
+	specs := []*FunctionSpec{
+		{Name: "as_count", Placement: MethodFunction},
+		{Name: "as_rate", Placement: MethodFunction},
+		{Name: "weighted", Placement: MethodFunction},
+		{Name: "rollup", Placement: MethodFunction, Args: []FunctionArg{
+			{Name: "method", Kind: ArgWord, Values: rollupMethods},
+			{Name: "interval", Kind: ArgNumber, Optional: true},
+		}},
+		{Name: "fill", Placement: MethodFunction, Args: []FunctionArg{
+			{Name: "mode", Kind: ArgWord, Values: []string{"null", "zero", "linear", "last"}},
+			{Name: "limit", Kind: ArgNumber, Optional: true},
+		}},
+		{Name: "moving_rollup", Placement: WrapperFunction, Args: []FunctionArg{
+			{Name: "interval", Kind: ArgNumber},
+			{Name: "method", Kind: ArgString, Values: rollupMethods, Optional: true, Default: "avg"},
+		}},
+		{Name: "top", Placement: WrapperFunction, Args: []FunctionArg{
+			{Name: "limit", Kind: ArgNumber},
+			{Name: "by", Kind: ArgString, Values: []string{"max", "min", "last", "l2norm", "area", "mean", "norm"}},
+			{Name: "direction", Kind: ArgString, Values: []string{"asc", "desc"}},
+		}},
+		{Name: "timeshift", Placement: WrapperFunction, Args: []FunctionArg{
+			{Name: "seconds", Kind: ArgNumber},
+		}},
+		{Name: "calendar_shift", Placement: WrapperFunction, Args: []FunctionArg{
+			{Name: "shift", Kind: ArgString},
+			{Name: "timezone", Kind: ArgString, Optional: true, Default: "UTC"},
+		}},
+	}
+	for _, name := range []string{"clamp_min", "clamp_max", "cutoff_min", "cutoff_max"} {
+		specs = append(specs, &FunctionSpec{Name: name, Placement: WrapperFunction, Args: []FunctionArg{
+			{Name: "threshold", Kind: ArgNumber},
+		}})
+	}
+	for _, name := range []string{
+		"abs", "log2", "log10", "cumsum", "integral",
+		"count_nonzero", "count_not_null", "exclude_null", "default_zero",
+		"per_second", "per_minute", "per_hour", "dt", "diff", "monotonic_diff", "derivative",
+		"robust_trend", "trend_line", "piecewise_constant",
+		"autosmooth", "ewma_3", "ewma_5", "ewma_10", "ewma_20", "median_3", "median_5", "median_7", "median_9",
+		"hour_before", "day_before", "week_before", "month_before",
+	} {
+		specs = append(specs, &FunctionSpec{Name: name, Placement: WrapperFunction})
+	}
+	// the fixed-size rank functions predate top()
+	for _, rank := range []string{"top", "bottom"} {
+		for _, n := range []int{5, 10, 15, 20} {
+			for _, by := range []string{"", "_mean", "_min", "_max", "_last", "_area", "_l2norm", "_norm"} {
+				specs = append(specs, &FunctionSpec{
+					Name:        fmt.Sprintf("%s%d%s", rank, n, by),
+					Placement:   WrapperFunction,
+					Deprecated:  true,
+					Replacement: "top",
+				})
+			}
+		}
+	}
+	return specs
+}
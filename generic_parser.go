@@ -1,7 +1,10 @@
 package ddqp
 
 import (
+	"errors"
 	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
 )
 
 type GenericParser struct{}
@@ -10,27 +13,35 @@ func NewGenericParser() *GenericParser {
 	return &GenericParser{}
 }
 
+// genericParser is shared by the functions that parse generic queries
+// themselves.
+var genericParser = NewGenericParser()
+
 type GenericQuery struct {
 	MetricExpression *MetricExpression
 	MetricQuery      *MetricQuery
 }
 
-// Parse sanitizes the query string and returns the AST and any error.
+// Parse sanitizes the query string and returns the AST. Invalid input is
+// reported as a *ParseError.
 func (gp *GenericParser) Parse(query string) (*GenericQuery, error) {
 	// the parser doesn't handle queries that are split up across multiple lines
 	sanitized := strings.ReplaceAll(query, "\n", "")
 
 	// Prefer MetricQuery parsing first because '*' '-' '/' are valid inside identifiers/filters
-	mqp := NewMetricQueryParser()
-	if metricQuery, err := mqp.Parse(sanitized); err == nil {
+	metricQuery, queryErr := metricQueryParser.Parse(sanitized)
+	if queryErr == nil {
 		return &GenericQuery{MetricQuery: metricQuery}, nil
 	}
 
 	// Fallback to MetricExpression
-	mep := NewMetricExpressionParser()
-	metricExpression, err := mep.Parse(sanitized)
+	metricExpression, err := metricExpressionParser.Parse(sanitized)
 	if err != nil {
-		return nil, err
+		// report whichever parser got further into the input
+		if queryErr.(*ParseError).Pos.Offset > err.(*ParseError).Pos.Offset {
+			err = queryErr
+		}
+		return nil, newParseError(query, errors.Unwrap(err))
 	}
 	return &GenericQuery{MetricExpression: metricExpression}, nil
 }
@@ -43,3 +54,23 @@ func (gq *GenericQuery) String() string {
 	}
 	return ""
 }
+
+func (gq *GenericQuery) Position() lexer.Position {
+	if gq.MetricExpression != nil {
+		return gq.MetricExpression.Pos
+	} else if gq.MetricQuery != nil {
+		return gq.MetricQuery.Pos
+	}
+	return lexer.Position{}
+}
+
+func (gq *GenericQuery) Kind() NodeKind { return KindGenericQuery }
+
+func (gq *GenericQuery) Children() []Node {
+	if gq.MetricExpression != nil {
+		return []Node{gq.MetricExpression}
+	} else if gq.MetricQuery != nil {
+		return []Node{gq.MetricQuery}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package ddqp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// LogMonitor is a log monitor query such as
+//
+//	logs("service:web status:error").index("main").rollup("count").by("host").last("5m") > 100
+//
+// Methods may be chained in any order; String always writes index, rollup,
+// by and last in that order. String arguments are stored without their
+// quotes, and String writes the calls whose arguments are unchanged as they
+// were parsed.
+type LogMonitor struct {
+	Pos lexer.Position
+
+	// Search is the log search query, e.g. "service:web status:error".
+	Search string
+	// SearchQuery is Search parsed with a SearchQueryParser. It is filled in
+	// by Parse and is not used by String.
+	SearchQuery *SearchQuery
+	Indexes     []string
+	// Rollup is nil when the query counts matching logs implicitly.
+	Rollup *LogRollup
+	// GroupBy lists the facets results are grouped by, e.g. "host" or
+	// "@http.status_code".
+	GroupBy []string
+	// Window is the evaluation window, e.g. "5m".
+	Window string
+	Condition
+
+	written writtenCalls
+}
+
+// logMonitorGrammar is what the parser reads; the methods are collected in
+// any order and then moved to the typed fields of LogMonitor.
+type logMonitorGrammar struct {
+	Pos lexer.Position
+
+	Search  *searchArg   `parser:"'logs' @@"`
+	Methods []*logMethod `parser:"@@*"`
+	Condition
+}
+
+// end is the position of the token after the method chain of g, which is
+// the comparator.
+func (g *logMonitorGrammar) end() lexer.Position {
+	if len(g.Methods) > 0 {
+		return g.Methods[len(g.Methods)-1].EndPos
+	}
+	return g.Search.EndPos
+}
+
+type logMethod struct {
+	Pos    lexer.Position
+	EndPos lexer.Position
+
+	Indexes []string   `parser:"  '.' 'index' '(' @String ( ',' @String )* ')'"`
+	Rollup  *LogRollup `parser:"| '.' @@"`
+	GroupBy []string   `parser:"| '.' 'by' '(' @String ( ',' @String )* ')'"`
+	Window  *string    `parser:"| '.' 'last' '(' @String ')'"`
+}
+
+func (m *logMethod) args() []string {
+	switch {
+	case len(m.Indexes) > 0:
+		return m.Indexes
+	case m.Rollup != nil:
+		return m.Rollup.args()
+	case m.Window != nil:
+		return []string{*m.Window}
+	}
+	return m.GroupBy
+}
+
+func (m *logMethod) name() string {
+	switch {
+	case len(m.Indexes) > 0:
+		return "index"
+	case m.Rollup != nil:
+		return "rollup"
+	case m.Window != nil:
+		return "last"
+	}
+	return "by"
+}
+
+// searchArg is the parenthesized search string a log, event or process
+// monitor starts with, e.g. ("status:error").
+type searchArg struct {
+	Pos    lexer.Position
+	EndPos lexer.Position
+
+	Value string `parser:"'(' @String ')'"`
+}
+
+// valuePos is the position of the search string, after the parenthesis.
+func (s *searchArg) valuePos() lexer.Position {
+	pos := s.Pos
+	pos.Offset++
+	pos.Column++
+	return pos
+}
+
+// LogRollup is the rollup() call of a log or event monitor: a method such as
+// "count", "avg" or "cardinality", and the measure or facet it applies to, if
+// any.
+type LogRollup struct {
+	Pos lexer.Position
+
+	Method  string `parser:"'rollup' '(' @String"`
+	Measure string `parser:"( ',' @String )? ')'"`
+}
+
+// String returns the string representation of the log monitor.
+func (lm *LogMonitor) String() string {
+	var sb strings.Builder
+	writeChain(&sb, lm.written, doubleQuoted, "logs", lm.Search, map[string][]string{
+		"index":  lm.Indexes,
+		"rollup": lm.Rollup.args(),
+		"by":     lm.GroupBy,
+		"last":   {lm.Window},
+	})
+	fmt.Fprintf(&sb, " %s", lm.Condition)
+	return sb.String()
+}
+
+func (lr *LogRollup) String() string {
+	if lr.Measure != "" {
+		return fmt.Sprintf("rollup(%s, %s)", strconv.Quote(lr.Method), strconv.Quote(lr.Measure))
+	}
+	return fmt.Sprintf("rollup(%s)", strconv.Quote(lr.Method))
+}
+
+// quoteAll quotes values and joins them with sep.
+func quoteAll(values []string, sep string) string {
+	quoted := []string{}
+	for _, v := range values {
+		quoted = append(quoted, strconv.Quote(v))
+	}
+	return strings.Join(quoted, sep)
+}
+
+func (lm *LogMonitor) Position() lexer.Position { return lm.Pos }
+func (lm *LogMonitor) Kind() NodeKind           { return KindLogMonitor }
+
+func (lm *LogMonitor) Children() []Node {
+	if lm.SearchQuery != nil {
+		return []Node{lm.SearchQuery}
+	}
+	return nil
+}
+
+// NewLogMonitorParser returns a Parser which is capable of interpretting
+// a log monitor query.
+func NewLogMonitorParser() *LogMonitorParser {
+	lmp := &LogMonitorParser{
+		parser: participle.MustBuild[logMonitorGrammar](
+			participle.Lexer(lex),
+			participle.Unquote("String"),
+		),
+	}
+
+	return lmp
+}
+
+var logMonitorParser = NewLogMonitorParser()
+
+// LogMonitorParser is parser returned when calling NewLogMonitorParser.
+type LogMonitorParser struct {
+	parser *participle.Parser[logMonitorGrammar]
+}
+
+// Parse sanitizes the query string and returns the AST. Invalid input,
+// including a repeated method, a missing last() or an invalid search string,
+// is reported as a *ParseError.
+func (lmp *LogMonitorParser) Parse(query string) (*LogMonitor, error) {
+	// the parser doesn't handle queries that are split up across multiple lines
+	sanitized := strings.ReplaceAll(query, "\n", "")
+	g, err := lmp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+
+	lm := &LogMonitor{
+		Pos:       g.Pos,
+		Search:    g.Search.Value,
+		Condition: g.Condition,
+		written:   writtenCalls{},
+	}
+	lm.written.record("logs", []string{lm.Search}, sanitized, g.Search.Pos, g.Search.EndPos)
+	seen := map[string]bool{}
+	for _, m := range g.Methods {
+		if seen[m.name()] {
+			return nil, newParseError(query, participle.Errorf(m.Pos, "%s() is given more than once", m.name()))
+		}
+		seen[m.name()] = true
+		lm.written.record(m.name(), m.args(), sanitized, m.Pos, m.EndPos)
+		switch {
+		case len(m.Indexes) > 0:
+			lm.Indexes = m.Indexes
+		case m.Rollup != nil:
+			lm.Rollup = m.Rollup
+		case m.Window != nil:
+			lm.Window = *m.Window
+		default:
+			lm.GroupBy = m.GroupBy
+		}
+	}
+	if !seen["last"] {
+		return nil, newParseError(query, participle.Errorf(g.end(), "log monitor needs an evaluation window, e.g. .last(\"5m\")"))
+	}
+
+	if err := lm.Condition.resolve(query, sanitized); err != nil {
+		return nil, err
+	}
+	if lm.SearchQuery, err = searchQueryParser.Parse(lm.Search); err != nil {
+		return nil, newParseError(query, participle.Errorf(g.Search.valuePos(), "invalid search %q: %v", lm.Search, err))
+	}
+	return lm, nil
+}
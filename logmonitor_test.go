@@ -0,0 +1,144 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LogMonitor(t *testing.T) {
+	parser := NewLogMonitorParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+		// column is where the error is reported, if set
+		column int
+	}{
+		{
+			name:  "count by host",
+			query: `logs("service:web status:error").index("main").rollup("count").by("host").last("5m") > 100`,
+		},
+		{
+			name:  "average of a measure",
+			query: `logs("service:api").index("main").rollup("avg", "@duration").by("@http.url_details.path").last("15m") >= 2000000000`,
+		},
+		{
+			name:  "only search and window",
+			query: `logs("status:error").last("1h") > 0`,
+		},
+		{
+			name:  "several indexes and facets",
+			query: `logs("source:nginx").index("main", "retention-30").rollup("cardinality", "@usr.id").by("service", "env").last("10m") < 5`,
+		},
+		{
+			name:  "escaped quotes in search",
+			query: `logs("@msg:\"connection refused\"").rollup("count").last("5m") != 0`,
+		},
+		{
+			name:  "methods in any order",
+			query: `logs("service:web").by("host").rollup("count").index("main").last("5m") > 1`,
+			want:  `logs("service:web").index("main").rollup("count").by("host").last("5m") > 1`,
+		},
+		{
+			name:  "single quotes",
+			query: `logs('service:web').index('main','retention-30').rollup('count').last('5m') > 1`,
+		},
+		{
+			name:  "single quotes in any order",
+			query: `logs('service:web').by('host').rollup('count').last('5m') > 1`,
+			want:  `logs('service:web').rollup('count').by('host').last('5m') > 1`,
+		},
+		{
+			name:    "repeated method",
+			query:   `logs("service:web").by("host").by("env").last("5m") > 1`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid search",
+			query:   `logs("service:web AND").last("5m") > 1`,
+			wantErr: true,
+			column:  6,
+		},
+		{
+			name:    "missing window",
+			query:   `logs("status:error").rollup("count") > 1`,
+			wantErr: true,
+			column:  38,
+		},
+		{
+			name:    "missing window with a comparator in the search",
+			query:   `logs("status:>500") > 1`,
+			wantErr: true,
+			column:  21,
+		},
+		{
+			name:    "invalid search after a method",
+			query:   `logs("status:>500 AND").index("main").last("5m") > 1`,
+			wantErr: true,
+			column:  6,
+		},
+		{
+			name:    "invalid threshold",
+			query:   `logs("status:error").last("5m") > lots`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				var pe *ParseError
+				require.ErrorAs(t, err, &pe)
+				if tt.column != 0 {
+					assert.Equal(t, tt.column, pe.Pos.Column)
+				}
+				return
+			}
+			require.NoError(t, err)
+			want := tt.want
+			if want == "" {
+				want = tt.query
+			}
+			assert.Equal(t, want, ast.String())
+		})
+	}
+}
+
+func Test_LogMonitorFields(t *testing.T) {
+	m, err := NewLogMonitorParser().Parse(`logs("service:web status:error").index("main").rollup("avg", "@duration").by("host", "env").last("5m") > 1e3`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "service:web status:error", m.Search)
+	assert.Equal(t, []string{"main"}, m.Indexes)
+	require.NotNil(t, m.Rollup)
+	assert.Equal(t, "avg", m.Rollup.Method)
+	assert.Equal(t, "@duration", m.Rollup.Measure)
+	assert.Equal(t, []string{"host", "env"}, m.GroupBy)
+	assert.Equal(t, "5m", m.Window)
+	assert.Equal(t, ">", m.Comparator)
+	assert.Equal(t, 1000.0, m.Threshold)
+
+	require.NotNil(t, m.SearchQuery)
+	assert.Equal(t, m.Search, m.SearchQuery.String())
+	assert.Equal(t, []Node{m.SearchQuery}, m.Children())
+
+	built := &LogMonitor{
+		Search:    "service:web",
+		Rollup:    &LogRollup{Method: "count"},
+		Window:    "5m",
+		Condition: Condition{Comparator: ">=", Threshold: 10},
+	}
+	assert.Equal(t, `logs("service:web").rollup("count").last("5m") >= 10`, built.String())
+
+	// changed arguments are quoted like the rest of the query
+	m, err = NewLogMonitorParser().Parse(`logs('service:web').by('host',  'env').last('5m') > 1`)
+	require.NoError(t, err)
+	m.GroupBy = append(m.GroupBy, "region")
+	m.Rollup = &LogRollup{Method: "count"}
+	assert.Equal(t, `logs('service:web').rollup('count').by('host', 'env', 'region').last('5m') > 1`, m.String())
+}
@@ -0,0 +1,125 @@
+package ddqp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// methodOrder is the order in which the methods of log, event and process
+// monitors are written, whatever order they were parsed in.
+var methodOrder = []string{"index", "over", "exclude", "rollup", "by", "last"}
+
+// chainStyle is how a method chain quotes and separates the arguments of
+// calls that were not parsed, such as those of a monitor built by hand.
+type chainStyle struct {
+	quote byte
+	sep   string
+}
+
+var (
+	// doubleQuoted is the style of log and event monitors, e.g.
+	// .by("host", "env").
+	doubleQuoted = chainStyle{quote: '"', sep: ", "}
+	// singleQuoted is the style of process monitors, e.g.
+	// .over('env:prod','role:lb').
+	singleQuoted = chainStyle{quote: '\'', sep: ","}
+)
+
+// writtenCall is a call of a method chain as it was parsed.
+type writtenCall struct {
+	args []string
+	// text is the argument list as written, e.g. ('host', "env").
+	text string
+}
+
+// writtenCalls maps the names of the calls of a parsed method chain, such as
+// "logs" or "rollup", to how they were written.
+type writtenCalls map[string]writtenCall
+
+// record keeps the argument list of the call name, which spans from pos to
+// end in sanitized.
+func (w writtenCalls) record(name string, args []string, sanitized string, pos, end lexer.Position) {
+	text := strings.TrimSpace(sanitized[pos.Offset:end.Offset])
+	if i := strings.IndexByte(text, '('); i >= 0 {
+		w[name] = writtenCall{args: args, text: text[i:]}
+	}
+}
+
+// writeChain writes the method chain of a log, event or process monitor:
+// the call head, e.g. logs, with search as its argument, followed by the
+// methods in methodOrder. Methods without arguments are left out. A call
+// whose arguments are unchanged since parsing is written as it was; other
+// calls quote their arguments like the parsed call or, failing that, the
+// parsed search, and fall back to style.
+func writeChain(sb *strings.Builder, written writtenCalls, style chainStyle, head, search string, methods map[string][]string) {
+	if q, ok := written.quote(head); ok {
+		style.quote = q
+	}
+	sb.WriteString(head)
+	sb.WriteString(written.args(head, []string{search}, style))
+	for _, name := range methodOrder {
+		if args := methods[name]; len(args) > 0 {
+			sb.WriteString("." + name)
+			sb.WriteString(written.args(name, args, style))
+		}
+	}
+}
+
+// args returns the argument list of the call name.
+func (w writtenCalls) args(name string, args []string, style chainStyle) string {
+	call, ok := w[name]
+	if ok && equalStrings(call.args, args) {
+		return call.text
+	}
+	if q, ok := w.quote(name); ok {
+		style.quote = q
+	}
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, quoteArg(arg, style.quote))
+	}
+	return "(" + strings.Join(quoted, style.sep) + ")"
+}
+
+// quote returns the quote the call name was written with.
+func (w writtenCalls) quote(name string) (byte, bool) {
+	i := strings.IndexAny(w[name].text, `"'`)
+	if i < 0 {
+		return 0, false
+	}
+	return w[name].text[i], true
+}
+
+// quoteArg quotes s with quote, or with double quotes if s contains a single
+// quote, which the lexer cannot escape in a single-quoted string.
+func quoteArg(s string, quote byte) string {
+	if quote != '\'' || strings.Contains(s, "'") {
+		return strconv.Quote(s)
+	}
+	return "'" + strings.ReplaceAll(s, `\`, `\\`) + "'"
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// args returns the arguments of the rollup() call, or nil if lr is nil.
+func (lr *LogRollup) args() []string {
+	switch {
+	case lr == nil:
+		return nil
+	case lr.Measure != "":
+		return []string{lr.Method, lr.Measure}
+	}
+	return []string{lr.Method}
+}
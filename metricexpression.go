@@ -25,32 +25,105 @@ func (o *Operator) Capture(s []string) error {
 }
 
 type ExprValue struct {
-	Subexpression         *MetricExpression            `  "(" @@ ")"`
-	ExprAggregatorFuction *ExpressionAggregatorFuction `| @@`
-	MetricQuery           *MetricQuery                 `| @@`
-	Number                *float64                     `| @Ident`
+	Pos lexer.Position
+
+	Subexpression         *MetricExpression            `parser:"  '(' @@ ')'"`
+	Unary                 *UnaryExpr                   `parser:"| @@"`
+	Anomalies             *Anomalies                   `parser:"| @@"`
+	Forecast              *Forecast                    `parser:"| @@"`
+	Outliers              *Outliers                    `parser:"| @@"`
+	ExprAggregatorFuction *ExpressionAggregatorFuction `parser:"| @@"`
+	MetricQuery           *MetricQuery                 `parser:"| @@"`
+	Reference             *QueryReference              `parser:"| @@"`
+	// Literal is a number as written, e.g. "1e6" or "-0.5". It is kept so
+	// that String round-trips.
+	Literal *NumberLiteral `parser:"| @@"`
+	// Number is the value of Literal. It is filled in by Parse; values built
+	// by hand only need to set Number.
+	Number *float64
 }
 
-func (expr *ExprValue) GetQueries() []string {
-	strs := []string{}
-	if expr.Subexpression != nil {
-		m := expr.Subexpression.GetQueries()
-		for _, v := range m {
-			strs = append(strs, v)
-		}
-		return strs
+// UnaryExpr is a value preceded by a sign, e.g. "-sum:a{*}" or "-(a - b)".
+type UnaryExpr struct {
+	Pos lexer.Position
+
+	// Operator is OpSub or OpAdd.
+	Operator Operator   `parser:"@('-' | '+')"`
+	Operand  *ExprValue `parser:"@@"`
+}
+
+// NumberLiteral is the text of a number in an expression, e.g. "60", "0.5",
+// "1e6", "1e+6" or "-1".
+type NumberLiteral string
+
+// Parse implements participle.Parseable. The lexer reads numbers as
+// identifiers and splits "1e+6" in two, so the production checks the text
+// instead of the token type.
+func (n *NumberLiteral) Parse(lex *lexer.PeekingLexer) error {
+	tok := lex.Peek()
+	switch lexSymbols[tok.Type] {
+	case "Ident", "FilterIdent", "Float", "Int":
+	default:
+		return participle.NextMatch
+	}
+	checkpoint := lex.MakeCheckpoint()
+	lex.Next()
+	text := tok.Value
+	if next := lex.Peek(); strings.HasSuffix(strings.ToLower(text), "e") && lexSymbols[next.Type] == "Float" &&
+		next.Pos.Offset == tok.Pos.Offset+len(tok.Value) {
+		text += next.Value
+		lex.Next()
+	}
+	if _, err := parseThreshold(text); err != nil {
+		lex.LoadCheckpoint(checkpoint)
+		return participle.NextMatch
 	}
+	*n = NumberLiteral(text)
+	return nil
+}
 
-	if expr.MetricQuery != nil {
-		strs = append(strs, expr.MetricQuery.String())
-		return strs
+// resolveNumbers sets the Number of every numeric literal below root.
+func resolveNumbers(root Node) {
+	Inspect(root, func(n Node) bool {
+		if ev, ok := n.(*ExprValue); ok && ev.Literal != nil {
+			v, _ := parseThreshold(string(*ev.Literal))
+			ev.Number = &v
+		}
+		return true
+	})
+}
+
+// numberString returns Literal unless Number was changed after parsing.
+func (expr *ExprValue) numberString() string {
+	if expr.Number == nil {
+		return string(*expr.Literal)
+	}
+	if expr.Literal == nil {
+		return formatFloatNoExp(*expr.Number)
 	}
+	return literalString(string(*expr.Literal), *expr.Number)
+}
 
+func (expr *ExprValue) GetQueries() []string {
+	switch {
+	case expr.Subexpression != nil:
+		return expr.Subexpression.GroupedExpression.queries()
+	case expr.Unary != nil:
+		return expr.Unary.Operand.GetQueries()
+	case expr.ExprAggregatorFuction != nil:
+		return expr.ExprAggregatorFuction.Body.queries()
+	case expr.monitorFunction() != nil:
+		return expr.monitorFunction().call().body.queries()
+	case expr.MetricQuery != nil:
+		return []string{expr.MetricQuery.String()}
+	}
 	return []string{}
 }
 
 type Factor struct {
-	Base *ExprValue `@@`
+	Pos lexer.Position
+
+	Base *ExprValue `parser:"@@"`
 }
 
 func (f *Factor) GetQueries() []string {
@@ -58,13 +131,17 @@ func (f *Factor) GetQueries() []string {
 }
 
 type OpFactor struct {
-	Operator Operator `@("*" | "/")`
-	Factor   *Factor  `@@`
+	Pos lexer.Position
+
+	Operator Operator `parser:"@('*' | '/')"`
+	Factor   *Factor  `parser:"@@"`
 }
 
 type Term struct {
-	Left  *Factor     `@@`
-	Right []*OpFactor `@@*`
+	Pos lexer.Position
+
+	Left  *Factor     `parser:"@@"`
+	Right []*OpFactor `parser:"@@*"`
 }
 
 func (t *Term) GetQueries() []string {
@@ -78,8 +155,10 @@ func (t *Term) GetQueries() []string {
 }
 
 type OpTerm struct {
-	Operator Operator `@("+" | "-")`
-	Term     *Term    `@@`
+	Pos lexer.Position
+
+	Operator Operator `parser:"@('+' | '-')"`
+	Term     *Term    `parser:"@@"`
 }
 
 type MetricExpression struct {
@@ -91,7 +170,7 @@ type MetricExpression struct {
 type ExpressionAggregatorFuction struct {
 	Pos lexer.Position
 
-	Name string             `parser:"@Ident '('"`
+	Name string             `parser:"(?! Ident '(' SpaceAggregatorCondition) @Ident '('"`
 	Body *GroupedExpression `parser:"@@"`
 	Args []*Value           `parser:"( ',' @@ )* ')'"`
 }
@@ -99,43 +178,56 @@ type ExpressionAggregatorFuction struct {
 type GroupedExpression struct {
 	Pos lexer.Position
 
-	Left  *Term     `@@`
-	Right []*OpTerm `@@*`
+	Left  *Term     `parser:"@@"`
+	Right []*OpTerm `parser:"@@*"`
 }
 
-func (me *MetricExpression) GetQueries() map[string]string {
-	queries := me.GroupedExpression.Left.GetQueries()
-
-	for _, v := range me.GroupedExpression.Right {
-		rightQueries := v.Term.GetQueries()
-
-		queries = append(queries, rightQueries...)
+// queries returns the metric queries in ge, from left to right.
+func (ge *GroupedExpression) queries() []string {
+	queries := ge.Left.GetQueries()
+	for _, v := range ge.Right {
+		queries = append(queries, v.Term.GetQueries()...)
 	}
+	return queries
+}
 
+// GetQueries names the metric queries of me a, b, c, and so on, in the order
+// they appear. Every occurrence gets its own name, even if it repeats an
+// earlier query; ExtractFormula gives identical queries a shared name.
+func (me *MetricExpression) GetQueries() map[string]string {
 	queryMap := make(map[string]string)
-	for key, value := range queries {
-		queryMap[toCharStr(key+1)] = value
+	for i, query := range me.GroupedExpression.queries() {
+		queryMap[LetterNaming(i)] = query
 	}
 	return queryMap
 }
 
-func toCharStr(i int) string {
-	const abc = "abcdefghijklmnopqrstuvwxyz"
-	return abc[i-1 : i]
-}
-
 // NewMetricExpressionParser returns a Parser which is capable of interpretting
 // a metric expression.
 func NewMetricExpressionParser() *MetricExpressionParser {
 	mep := &MetricExpressionParser{
 		parser: participle.MustBuild[MetricExpression](
-			participle.Lexer(lex),
+			participle.Lexer(exprLex),
 		),
 	}
 
 	return mep
 }
 
+// metricExpressionParser is shared by the functions that parse metric
+// expressions themselves.
+var metricExpressionParser = NewMetricExpressionParser()
+
+// newFormulaParser returns a MetricExpressionParser that also accepts names
+// of sub-queries, as in "errors / hits * 100".
+func newFormulaParser() *MetricExpressionParser {
+	mep := NewMetricExpressionParser()
+	mep.references = true
+	return mep
+}
+
+var formulaParser = newFormulaParser()
+
 // Display
 
 func (o Operator) String() string {
@@ -153,18 +245,31 @@ func (o Operator) String() string {
 }
 
 func (expr *ExprValue) String() string {
-	if expr.Number != nil {
-		return formatFloatNoExp(*expr.Number)
+	if expr.Number != nil || expr.Literal != nil {
+		return expr.numberString()
+	}
+	if expr.Unary != nil {
+		return expr.Unary.String()
 	}
 	if expr.MetricQuery != nil {
 		return expr.MetricQuery.String()
 	}
+	if expr.Reference != nil {
+		return string(*expr.Reference)
+	}
 	if expr.ExprAggregatorFuction != nil {
 		return expr.ExprAggregatorFuction.String()
 	}
+	if fn := expr.monitorFunction(); fn != nil {
+		return fn.String()
+	}
 	return "(" + expr.Subexpression.String() + ")"
 }
 
+func (u *UnaryExpr) String() string {
+	return u.Operator.String() + u.Operand.String()
+}
+
 func (f *Factor) String() string {
 	out := f.Base.String()
 	return out
@@ -210,39 +315,339 @@ func (ge *GroupedExpression) String() string {
 	return strings.Join(out, " ")
 }
 
+func (me *MetricExpression) Position() lexer.Position { return me.Pos }
+func (me *MetricExpression) Kind() NodeKind           { return KindMetricExpression }
+
+func (me *MetricExpression) Children() []Node {
+	if me.GroupedExpression != nil {
+		return []Node{me.GroupedExpression}
+	}
+	return nil
+}
+
+func (me *ExpressionAggregatorFuction) Position() lexer.Position { return me.Pos }
+func (me *ExpressionAggregatorFuction) Kind() NodeKind           { return KindExpressionAggregatorFuction }
+
+func (me *ExpressionAggregatorFuction) Children() []Node {
+	nodes := []Node{}
+	if me.Body != nil {
+		nodes = append(nodes, me.Body)
+	}
+	for _, v := range me.Args {
+		nodes = append(nodes, v)
+	}
+	return nodes
+}
+
+func (ge *GroupedExpression) Position() lexer.Position { return ge.Pos }
+func (ge *GroupedExpression) Kind() NodeKind           { return KindGroupedExpression }
+
+func (ge *GroupedExpression) Children() []Node {
+	nodes := []Node{}
+	if ge.Left != nil {
+		nodes = append(nodes, ge.Left)
+	}
+	for _, r := range ge.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (o *OpTerm) Position() lexer.Position { return o.Pos }
+func (o *OpTerm) Kind() NodeKind           { return KindOpTerm }
+
+func (o *OpTerm) Children() []Node {
+	if o.Term != nil {
+		return []Node{o.Term}
+	}
+	return nil
+}
+
+func (t *Term) Position() lexer.Position { return t.Pos }
+func (t *Term) Kind() NodeKind           { return KindTerm }
+
+func (t *Term) Children() []Node {
+	nodes := []Node{}
+	if t.Left != nil {
+		nodes = append(nodes, t.Left)
+	}
+	for _, r := range t.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (o *OpFactor) Position() lexer.Position { return o.Pos }
+func (o *OpFactor) Kind() NodeKind           { return KindOpFactor }
+
+func (o *OpFactor) Children() []Node {
+	if o.Factor != nil {
+		return []Node{o.Factor}
+	}
+	return nil
+}
+
+func (f *Factor) Position() lexer.Position { return f.Pos }
+func (f *Factor) Kind() NodeKind           { return KindFactor }
+
+func (f *Factor) Children() []Node {
+	if f.Base != nil {
+		return []Node{f.Base}
+	}
+	return nil
+}
+
+func (expr *ExprValue) Position() lexer.Position { return expr.Pos }
+func (expr *ExprValue) Kind() NodeKind           { return KindExprValue }
+
+func (expr *ExprValue) Children() []Node {
+	switch {
+	case expr.Subexpression != nil:
+		return []Node{expr.Subexpression}
+	case expr.Unary != nil:
+		return []Node{expr.Unary}
+	case expr.ExprAggregatorFuction != nil:
+		return []Node{expr.ExprAggregatorFuction}
+	case expr.MetricQuery != nil:
+		return []Node{expr.MetricQuery}
+	}
+	if fn := expr.monitorFunction(); fn != nil {
+		return []Node{fn}
+	}
+	return nil
+}
+
+func (u *UnaryExpr) Position() lexer.Position { return u.Pos }
+func (u *UnaryExpr) Kind() NodeKind           { return KindUnaryExpr }
+
+func (u *UnaryExpr) Children() []Node {
+	if u.Operand != nil {
+		return []Node{u.Operand}
+	}
+	return nil
+}
+
+// monitorFunction returns the anomalies, forecast or outliers call held by
+// the value, if any.
+func (expr *ExprValue) monitorFunction() monitorFunction {
+	switch {
+	case expr.Anomalies != nil:
+		return expr.Anomalies
+	case expr.Forecast != nil:
+		return expr.Forecast
+	case expr.Outliers != nil:
+		return expr.Outliers
+	}
+	return nil
+}
+
 // MetricExpressionParser is parser returned when calling NewMetricExpressionParser.
 type MetricExpressionParser struct {
 	parser *participle.Parser[MetricExpression]
+	// references allows names of sub-queries in place of metric queries
+	references bool
 }
 
-// Parse sanitizes the query string and returns the AST and any error.
+// Parse sanitizes the query string and returns the AST. Invalid input,
+// including a bare name where a query is expected, is reported as a
+// *ParseError.
 func (mep *MetricExpressionParser) Parse(expr string) (*MetricExpression, error) {
 	// the parser doesn't handle queries that are split up across multiple lines
 	sanitized := strings.ReplaceAll(expr, "\n", "")
-	// return the raw parsed outpu
-	return mep.parser.ParseString("", sanitized)
+	ast, err := mep.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(expr, err)
+	}
+	if err := resolveMonitorFunctions(sanitized, ast); err != nil {
+		return nil, newParseError(expr, err)
+	}
+	resolveNumbers(ast)
+	if !mep.references {
+		if err := rejectQueryReferences(ast); err != nil {
+			return nil, newParseError(expr, err)
+		}
+	}
+	return ast, nil
 }
 
-// MetricExpressionFormula breaks down a query into its formulaic parts
+// rejectQueryReferences reports the first name of a sub-query below root.
+// Named sub-queries are only defined for formulas.
+func rejectQueryReferences(root Node) error {
+	if refs := queryReferences(root); len(refs) > 0 {
+		return participle.Errorf(refs[0].Pos, "unknown query %q; use a FormulaMonitorParser or NewMetricExpressionFromFormula for formulas over named queries", string(*refs[0].Reference))
+	}
+	return nil
+}
+
+// MetricExpressionFormula breaks down a query into its formulaic parts: a
+// formula over named sub-queries, e.g. "(a + b) / c", and the sub-queries.
 type MetricExpressionFormula struct {
+	// Expressions maps each name to its sub-query.
 	Expressions map[string]string
 	Formula     string
+	// Names lists the names in the order their sub-queries first appear.
+	Names []string
 }
 
-func NewMetricExpressionFormula(expr *MetricExpression) *MetricExpressionFormula {
-	exprFormula := &MetricExpressionFormula{
-		Expressions: map[string]string{},
-		Formula:     "",
-	}
+// FormulaNaming returns a candidate name for the i-th distinct sub-query of
+// a formula, counting from 0.
+type FormulaNaming func(i int) string
 
-	exprFormula.Expressions = expr.GetQueries()
+// LetterNaming names sub-queries a, b, ..., z, aa, ab, and so on.
+func LetterNaming(i int) string {
+	const abc = "abcdefghijklmnopqrstuvwxyz"
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(abc[(i-1)%26]) + name
+	}
+	return name
+}
 
-	formula := expr.String()
+// QueryNaming names sub-queries query1, query2, and so on, as the Datadog
+// API does.
+func QueryNaming(i int) string {
+	return fmt.Sprintf("query%d", i+1)
+}
 
-	for key, value := range exprFormula.Expressions {
-		formula = strings.ReplaceAll(formula, value, key)
+// NewMetricExpressionFormula replaces the metric queries in the String form
+// of expr with the names returned by GetQueries.
+//
+// Deprecated: use ExtractFormula, which gives identical queries a shared name,
+// takes a naming scheme and reports why a formula cannot be extracted.
+func NewMetricExpressionFormula(expr *MetricExpression) *MetricExpressionFormula {
+	exprFormula := &MetricExpressionFormula{Expressions: expr.GetQueries(), Names: []string{}}
+	for i := 0; i < len(exprFormula.Expressions); i++ {
+		exprFormula.Names = append(exprFormula.Names, LetterNaming(i))
 	}
 
+	formula := expr.String()
+	for _, name := range exprFormula.Names {
+		formula = strings.ReplaceAll(formula, exprFormula.Expressions[name], name)
+	}
 	exprFormula.Formula = formula
 	return exprFormula
 }
+
+// ExtractFormula replaces every metric query in expr, from left to right,
+// with a name chosen by naming. Queries written identically share a name.
+// Names that are not valid query references, or that are already used by
+// expr or an earlier sub-query, are skipped. expr itself is not modified.
+func ExtractFormula(expr *MetricExpression, naming FormulaNaming) (*MetricExpressionFormula, error) {
+	// work on a copy so that expr keeps its queries
+	formula, err := formulaParser.Parse(expr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	f := &MetricExpressionFormula{Expressions: map[string]string{}, Names: []string{}}
+	namer := newFormulaNamer(naming, formula)
+	Inspect(formula, func(n Node) bool {
+		if err != nil {
+			return false
+		}
+		ev, ok := n.(*ExprValue)
+		if !ok || ev.MetricQuery == nil {
+			return true
+		}
+		query := ev.MetricQuery.String()
+		name, isNew, nameErr := namer.name(query)
+		if err = nameErr; err != nil {
+			return false
+		}
+		if isNew {
+			f.Expressions[name] = query
+			f.Names = append(f.Names, name)
+		}
+		ref := QueryReference(name)
+		ev.MetricQuery, ev.Reference = nil, &ref
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.Formula = formula.String()
+	return f, nil
+}
+
+// maxSkippedFormulaNames bounds the search for a usable name, so that a
+// naming scheme that keeps returning the same name fails instead of looping.
+const maxSkippedFormulaNames = 100
+
+// formulaNamer chooses the names of the sub-queries of a formula.
+type formulaNamer struct {
+	naming FormulaNaming
+	next   int
+	// used holds the names that are taken, including those root refers to
+	used map[string]bool
+	// names maps each sub-query to its name
+	names map[string]string
+}
+
+func newFormulaNamer(naming FormulaNaming, root Node) *formulaNamer {
+	used := map[string]bool{}
+	for _, ev := range queryReferences(root) {
+		used[string(*ev.Reference)] = true
+	}
+	return &formulaNamer{naming: naming, used: used, names: map[string]string{}}
+}
+
+// name returns the name of query, and whether it was chosen by this call
+// rather than shared with an identical earlier query.
+func (fn *formulaNamer) name(query string) (string, bool, error) {
+	if name, ok := fn.names[query]; ok {
+		return name, false, nil
+	}
+	for skipped := 0; skipped <= maxSkippedFormulaNames; skipped++ {
+		name := fn.naming(fn.next)
+		fn.next++
+		if QueryReference(name).valid() && !fn.used[name] {
+			fn.used[name] = true
+			fn.names[query] = name
+			return name, true, nil
+		}
+	}
+	return "", false, fmt.Errorf("formula naming returned no usable name after %d attempts", maxSkippedFormulaNames+1)
+}
+
+// Expression rebuilds the expression the formula was extracted from by
+// writing every sub-query inline.
+func (f *MetricExpressionFormula) Expression() (*MetricExpression, error) {
+	return NewMetricExpressionFromFormula(f.Formula, f.Expressions)
+}
+
+// NewMetricExpressionFromFormula parses formula, e.g. "(a + b) / c", and
+// replaces every name in it with the matching metric query from queries.
+func NewMetricExpressionFromFormula(formula string, queries map[string]string) (*MetricExpression, error) {
+	me, err := formulaParser.Parse(formula)
+	if err != nil {
+		return nil, err
+	}
+	err = inlineQueries(me, func(name string) (*MetricQuery, error) {
+		query, ok := queries[name]
+		if !ok {
+			return nil, fmt.Errorf("query %q is not defined", name)
+		}
+		mq, err := metricQueryParser.Parse(query)
+		if err != nil {
+			return nil, fmt.Errorf("query %q: %w", name, err)
+		}
+		return mq, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return me, nil
+}
+
+// inlineQueries replaces every query reference in me with the query lookup
+// returns for it.
+func inlineQueries(me *MetricExpression, lookup func(name string) (*MetricQuery, error)) error {
+	for _, ev := range queryReferences(me) {
+		mq, err := lookup(string(*ev.Reference))
+		if err != nil {
+			return err
+		}
+		ev.Reference, ev.MetricQuery = nil, mq
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package ddqp
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/alecthomas/participle/v2"
@@ -11,7 +14,7 @@ import (
 
 func newMetricExpressionParser() *participle.Parser[MetricExpression] {
 	return participle.MustBuild[MetricExpression](
-		participle.Lexer(lex),
+		participle.Lexer(exprLex),
 		participle.Unquote("String"),
 	)
 }
@@ -146,16 +149,14 @@ func Test_MetricExpressionCanParse(t *testing.T) {
 }
 
 func Test_MetricExpressionFormula(t *testing.T) {
-	parser := newMetricExpressionParser()
+	parser := NewMetricExpressionParser()
 
 	tests := []struct {
-		name             string
-		query            string
-		formula          string // Expected formula or empty if we don't care about exact mapping
-		expressions      map[string]string
-		wantErr          bool
-		printAST         bool // For debugging, can opt in to print AST
-		skipFormulaCheck bool // Skip formula assertion for cases where map ordering matters
+		name        string
+		query       string
+		formula     string
+		expressions map[string]string
+		names       []string
 	}{
 		{
 			name:    "addition formula",
@@ -165,8 +166,7 @@ func Test_MetricExpressionFormula(t *testing.T) {
 				"a": "sum:metric.name{foo:bar}",
 				"b": "sum:metric.name_two{foo:bar, baz:bang}",
 			},
-			wantErr:  false,
-			printAST: false,
+			names: []string{"a", "b"},
 		},
 		{
 			name:    "addition and division formula",
@@ -177,9 +177,7 @@ func Test_MetricExpressionFormula(t *testing.T) {
 				"b": "sum:metric.name_two{foo:bar}",
 				"c": "sum:metric.name_three{*}",
 			},
-			wantErr:          false,
-			printAST:         false,
-			skipFormulaCheck: true,
+			names: []string{"a", "b", "c"},
 		},
 		{
 			name:    "calculate percent",
@@ -189,46 +187,208 @@ func Test_MetricExpressionFormula(t *testing.T) {
 				"a": "sum:metric.name{foo:bar}",
 				"b": "sum:metric.name_two{foo:bar}",
 			},
-			wantErr:          false,
-			printAST:         true,
-			skipFormulaCheck: true,
+			names: []string{"a", "b"},
+		},
+		{
+			name:    "query that is a substring of another",
+			query:   "sum:metric.name{foo:bar}.as_count() / sum:metric.name{foo:bar}",
+			formula: "a / b",
+			expressions: map[string]string{
+				"a": "sum:metric.name{foo:bar}.as_count()",
+				"b": "sum:metric.name{foo:bar}",
+			},
+			names: []string{"a", "b"},
+		},
+		{
+			name:    "repeated query",
+			query:   "(sum:errors{*} - sum:hits{*}) / sum:errors{*}",
+			formula: "(a - b) / a",
+			expressions: map[string]string{
+				"a": "sum:errors{*}",
+				"b": "sum:hits{*}",
+			},
+			names: []string{"a", "b"},
+		},
+		{
+			name:    "wrapped queries",
+			query:   "default_zero(sum:errors{*}) / anomalies(sum:hits{*}, 'basic', 2)",
+			formula: "default_zero(a) / anomalies(b, 'basic', 2)",
+			expressions: map[string]string{
+				"a": "sum:errors{*}",
+				"b": "sum:hits{*}",
+			},
+			names: []string{"a", "b"},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ast, err := parser.ParseString("", tt.query)
-			if (err != nil) != tt.wantErr {
-				require.NoError(t, err)
-			}
+			ast, err := parser.Parse(tt.query)
+			require.NoError(t, err)
 
-			expr := NewMetricExpressionFormula(ast)
-			if !tt.skipFormulaCheck {
-				assert.Equal(t, tt.formula, expr.Formula)
-			}
-			// For expressions, we should check content equality as the key assignment could vary
-			expressionsEqual := true
-			if len(expr.Expressions) != len(tt.expressions) {
-				expressionsEqual = false
-			} else {
-				// Check if all expected expressions exist in result
-				for _, expectedVal := range tt.expressions {
-					found := false
-					for _, actualVal := range expr.Expressions {
-						if expectedVal == actualVal {
-							found = true
-							break
-						}
-					}
-					if !found {
-						expressionsEqual = false
-						break
-					}
+			expr, err := ExtractFormula(ast, LetterNaming)
+			require.NoError(t, err)
+			assert.Equal(t, tt.formula, expr.Formula)
+			assert.Equal(t, tt.expressions, expr.Expressions)
+			assert.Equal(t, tt.names, expr.Names)
+			assert.Equal(t, tt.query, ast.String())
+
+			rebuilt, err := expr.Expression()
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, rebuilt.String())
+		})
+	}
+}
+
+func Test_ExtractFormula(t *testing.T) {
+	me, err := NewMetricExpressionParser().Parse("sum:a{*} / (sum:b{*} + sum:a{*})")
+	require.NoError(t, err)
+
+	f, err := ExtractFormula(me, QueryNaming)
+	require.NoError(t, err)
+	assert.Equal(t, "query1 / (query2 + query1)", f.Formula)
+	assert.Equal(t, []string{"query1", "query2"}, f.Names)
+
+	// names that are taken or not valid references are skipped
+	f, err = ExtractFormula(me, func(i int) string { return []string{"a", "2x", "a", "b"}[i] })
+	require.NoError(t, err)
+	assert.Equal(t, "a / (b + a)", f.Formula)
+
+	_, err = ExtractFormula(me, func(int) string { return "x" })
+	assert.Error(t, err)
+
+	// more sub-queries than letters
+	queries := []string{}
+	for i := 0; i < 28; i++ {
+		queries = append(queries, fmt.Sprintf("sum:m%d{*}", i))
+	}
+	me, err = NewMetricExpressionParser().Parse(strings.Join(queries, " + "))
+	require.NoError(t, err)
+	f, err = ExtractFormula(me, LetterNaming)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"y", "z", "aa", "ab"}, f.Names[24:])
+	assert.Equal(t, "sum:m27{*}", f.Expressions["ab"])
+}
+
+func Test_LetterNaming(t *testing.T) {
+	for i, want := range map[int]string{0: "a", 25: "z", 26: "aa", 51: "az", 52: "ba", 701: "zz", 702: "aaa"} {
+		assert.Equal(t, want, LetterNaming(i))
+	}
+}
+
+func Test_NewMetricExpressionFromFormula(t *testing.T) {
+	me, err := NewMetricExpressionFromFormula("default_zero(errors) / hits * 100", map[string]string{
+		"errors": "sum:errors{service:web}.as_count()",
+		"hits":   "sum:hits{service:web}.as_count()",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "default_zero(sum:errors{service:web}.as_count()) / sum:hits{service:web}.as_count() * 100", me.String())
+
+	_, err = NewMetricExpressionFromFormula("a / b", map[string]string{"a": "sum:a{*}"})
+	assert.EqualError(t, err, `query "b" is not defined`)
+
+	_, err = NewMetricExpressionFromFormula("a", map[string]string{"a": "sum:a{"})
+	assert.ErrorContains(t, err, `query "a"`)
+}
+
+func Test_MetricExpressionNumbers(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		numbers []float64
+	}{
+		{name: "unary minus", query: "-sum:a{*}"},
+		{name: "unary minus on a group", query: "-(sum:a{*} - sum:b{*})"},
+		{name: "unary plus", query: "+sum:a{*} / 2", numbers: []float64{2}},
+		{name: "scientific notation", query: "1e6 * sum:bytes{*}", numbers: []float64{1e6}},
+		{name: "signed exponent", query: "sum:bytes{*} / 1e+6", numbers: []float64{1e6}},
+		{name: "fraction", query: "0.5 * sum:a{*}", numbers: []float64{0.5}},
+		{name: "negative number", query: "sum:a{*} * -1", numbers: []float64{-1}},
+		{name: "trailing zeros", query: "sum:a{*} * 100.0", numbers: []float64{100}},
+		{name: "negative metric in a sum", query: "sum:a{*} + -sum:b{*}"},
+		{name: "negative filter value", query: "avg:a{host:-foo}"},
+		{name: "negative filter value with a sign", query: "-avg:a{host:-foo} * 2", numbers: []float64{2}},
+	}
+	parser := NewMetricExpressionParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, me.String())
+
+			numbers := []float64{}
+			Inspect(me, func(n Node) bool {
+				if ev, ok := n.(*ExprValue); ok && ev.Number != nil {
+					numbers = append(numbers, *ev.Number)
 				}
+				return true
+			})
+			if tt.numbers == nil {
+				tt.numbers = []float64{}
 			}
-			if !expressionsEqual {
-				t.Logf("Expected expressions: %v\nActual expressions: %v", tt.expressions, expr.Expressions)
-			}
-			assert.True(t, expressionsEqual, "Expressions maps should contain the same values (might have different keys)")
+			assert.Equal(t, tt.numbers, numbers)
+		})
+	}
+}
+
+func Test_ExprValueGetQueries(t *testing.T) {
+	me, err := NewMetricExpressionParser().Parse("abs(sum:a{*} - sum:b{*}) / -(sum:c{*} + anomalies(sum:d{*}, 'basic', 2))")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "sum:a{*}", "b": "sum:b{*}", "c": "sum:c{*}", "d": "sum:d{*}"}, me.GetQueries())
+
+	// every occurrence of a query gets its own name
+	me, err = NewMetricExpressionParser().Parse("sum:a{*} / (sum:b{*} + sum:a{*})")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "sum:a{*}", "b": "sum:b{*}", "c": "sum:a{*}"}, me.GetQueries())
+}
+
+func Test_NewMetricExpressionFormula(t *testing.T) {
+	me, err := NewMetricExpressionParser().Parse("sum:a{*} / sum:b{*}")
+	require.NoError(t, err)
+	f := NewMetricExpressionFormula(me) //nolint:staticcheck // deprecated, but still supported
+	require.NotNil(t, f)
+	assert.Equal(t, "a / b", f.Formula)
+	assert.Equal(t, []string{"a", "b"}, f.Names)
+
+	// repeated queries are not merged
+	me, err = NewMetricExpressionParser().Parse("(sum:errors{*} - sum:hits{*}) / sum:errors{*}")
+	require.NoError(t, err)
+	f = NewMetricExpressionFormula(me) //nolint:staticcheck // deprecated, but still supported
+	assert.Equal(t, map[string]string{"a": "sum:errors{*}", "b": "sum:hits{*}", "c": "sum:errors{*}"}, f.Expressions)
+
+	// an expression that does not parse back still yields a formula
+	ref := QueryReference("not a name")
+	broken := &MetricExpression{GroupedExpression: &GroupedExpression{Left: &Term{Left: &Factor{Base: &ExprValue{Reference: &ref}}}}}
+	f = NewMetricExpressionFormula(broken) //nolint:staticcheck // deprecated, but still supported
+	require.NotNil(t, f)
+	assert.Equal(t, "not a name", f.Formula)
+	assert.Empty(t, f.Expressions)
+}
+
+func Test_MetricExpressionRejectsNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		column int
+	}{
+		{name: "bare name", query: "foo", column: 1},
+		{name: "formula", query: "foo / bar * 100", column: 1},
+		{name: "typo after a query", query: "sum:a{*} + typo", column: 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMetricExpressionParser().Parse(tt.query)
+			var pe *ParseError
+			require.True(t, errors.As(err, &pe), "%v", err)
+			assert.Equal(t, tt.column, pe.Pos.Column)
+			assert.Contains(t, pe.Error(), "unknown query")
+
+			_, err = NewGenericParser().Parse(tt.query)
+			require.True(t, errors.As(err, &pe), "%v", err)
 		})
 	}
+
+	// formulas are still accepted where they are expected
+	f, err := NewMetricExpressionFromFormula("a + b", map[string]string{"a": "sum:a{*}", "b": "sum:b{*}"})
+	require.NoError(t, err)
+	assert.Equal(t, "sum:a{*} + sum:b{*}", f.String())
 }
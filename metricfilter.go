@@ -10,8 +10,8 @@ import (
 type MetricFilter struct {
 	Pos lexer.Position
 
-	Left       *Param   `(@@ | "*" )`
-	Parameters []*Param `( @@* )`
+	Left       *Param   `parser:"(@@ | '*' )"`
+	Parameters []*Param `parser:"( @@* )"`
 }
 
 func (mf *MetricFilter) String() string {
@@ -26,10 +26,13 @@ func (mf *MetricFilter) String() string {
 }
 
 type Param struct {
-	GroupedFilter *GroupedFilter        ` "(" @@ ")"`
-	Separator     *FilterValueSeparator `| @@`
-	SimpleFilter  *SimpleFilter         `| @@`
-	Asterisk      bool                  `| @"*"`
+	Pos lexer.Position
+
+	GroupedFilter    *GroupedFilter        `parser:" '(' @@ ')'"`
+	Separator        *FilterValueSeparator `parser:"| @@"`
+	SimpleFilter     *SimpleFilter         `parser:"| @@"`
+	Asterisk         bool                  `parser:"| @'*'"`
+	TemplateVariable *TemplateVariable     `parser:"| @@"`
 }
 
 func (p *Param) String() string {
@@ -45,19 +48,31 @@ func (p *Param) String() string {
 		return "*"
 	}
 
+	if p.TemplateVariable != nil {
+		return p.TemplateVariable.String()
+	}
+
 	return p.SimpleFilter.String()
 }
 
 type SimpleFilter struct {
-	Negative        bool             `@"!"?`
-	FilterKey       string           `@Ident`
-	FilterSeparator *FilterSeparator `@@`
-	FilterValue     *FilterValue     `@@`
+	Pos lexer.Position
+
+	Negative bool `parser:"@'!'?"`
+	// FilterSeparator and FilterValue are both nil for a bare tag, as in
+	// "{production}". A bare tag has to be followed by a comma, a closing
+	// brace or parenthesis, AND, OR or the end of the filter; "foo AND NOT
+	// bar" is read as a single SimpleFilter with an AndNot separator.
+	FilterKey       string           `parser:"( @Ident (?= ',' | '}' | ')' | ('AND' | 'and' | 'OR' | 'or') (?! 'NOT' | 'not') | EOF) | @Ident"`
+	FilterSeparator *FilterSeparator `parser:"  @@"`
+	FilterValue     *FilterValue     `parser:"  @@ )"`
 }
 
 func (sf *SimpleFilter) String() string {
-	// TODO: Negative
-	base := fmt.Sprintf("%s%s%s", sf.FilterKey, sf.FilterSeparator.String(), sf.FilterValue.String())
+	base := sf.FilterKey
+	if sf.FilterSeparator != nil && sf.FilterValue != nil {
+		base += sf.FilterSeparator.String() + sf.FilterValue.String()
+	}
 
 	if sf.Negative {
 		return fmt.Sprintf("!%s", base)
@@ -67,7 +82,9 @@ func (sf *SimpleFilter) String() string {
 }
 
 type GroupedFilter struct {
-	Parameters []*Param `( @@* | "*" )?`
+	Pos lexer.Position
+
+	Parameters []*Param `parser:"( @@* | '*' )?"`
 }
 
 func (gf *GroupedFilter) String() string {
@@ -80,17 +97,19 @@ func (gf *GroupedFilter) String() string {
 }
 
 type FilterSeparator struct {
-	Colon        bool `@":"`
-	GreaterThan  bool `| @":>"`
-	LessThan     bool `| @":<"`
-	GreaterEqual bool `| @":>="`
-	LessEqual    bool `| @":<="`
-	Regex        bool `| @":~"`
-	In           bool `| @("IN" | "in") `
-	NotIn        bool `| @("NOT" "IN" | "not" "in")`
-	Not          bool `| @("NOT" | "not")`
-	AndNot       bool `| @("AND" "NOT" | "and" "not")`
-	OrNot        bool `| @("OR" "NOT" | "or" "not")`
+	Pos lexer.Position
+
+	Colon        bool `parser:"@':'"`
+	GreaterThan  bool `parser:"| @':>'"`
+	LessThan     bool `parser:"| @':<'"`
+	GreaterEqual bool `parser:"| @':>='"`
+	LessEqual    bool `parser:"| @':<='"`
+	Regex        bool `parser:"| @':~'"`
+	In           bool `parser:"| @('IN' | 'in') "`
+	NotIn        bool `parser:"| @('NOT' 'IN' | 'not' 'in')"`
+	Not          bool `parser:"| @('NOT' | 'not')"`
+	AndNot       bool `parser:"| @('AND' 'NOT' | 'and' 'not')"`
+	OrNot        bool `parser:"| @('OR' 'NOT' | 'or' 'not')"`
 }
 
 func (fs *FilterSeparator) String() string {
@@ -138,8 +157,10 @@ func (fs *FilterSeparator) String() string {
 }
 
 type FilterKey struct {
-	Negative bool   `@"!"?`
-	Key      string `@Ident`
+	Pos lexer.Position
+
+	Negative bool   `parser:"@'!'?"`
+	Key      string `parser:"@Ident"`
 }
 
 func (fk *FilterKey) String() string {
@@ -151,8 +172,10 @@ func (fk *FilterKey) String() string {
 }
 
 type FilterValue struct {
-	SimpleValue *Value   `@@`
-	ListValue   []*Value `| ( "(" @@* ")" )?`
+	Pos lexer.Position
+
+	SimpleValue *Value   `parser:"@@"`
+	ListValue   []*Value `parser:"| ( '(' @@* ')' )?"`
 }
 
 func (fv *FilterValue) String() string {
@@ -168,12 +191,15 @@ func (fv *FilterValue) String() string {
 }
 
 type Value struct {
-	Separator  *FilterValueSeparator ` @@`
-	Boolean    *Bool                 `|  @("true"|"false")`
-	Identifier *string               `| "!"? @Ident ( @"." @Ident )*`
-	Str        *string               `| @(String)`
-	Number     *float64              `| @(Float|Int)`
-	Wildcard   *string               `| @(FilterIdent|'*')`
+	Pos lexer.Position
+
+	Separator        *FilterValueSeparator `parser:" @@"`
+	Boolean          *Bool                 `parser:"|  @('true'|'false')"`
+	Identifier       *string               `parser:"| '!'? @Ident ( @'.' @Ident )*"`
+	Str              *string               `parser:"| @(String)"`
+	TemplateVariable *TemplateVariable     `parser:"| @@"`
+	Number           *float64              `parser:"| @(Float|Int)"`
+	Wildcard         *string               `parser:"| @(FilterIdent|'*')"`
 }
 
 func (v *Value) String() string {
@@ -197,17 +223,23 @@ func (v *Value) String() string {
 		return *v.Wildcard
 	}
 
+	if v.TemplateVariable != nil {
+		return v.TemplateVariable.String()
+	}
+
 	return *v.Str
 }
 
 type FilterValueSeparator struct {
-	Comma  bool ` @","`
-	AndNot bool `| @("AND" "NOT" | "and" "not")`
-	And    bool `| @("AND" | "and")`
-	OrNot  bool `| @("OR" "NOT" | "or" "not")`
-	Or     bool `| @("OR" | "or")`
-	In     bool `| @("IN" | "in")`
-	Not    bool `| @("NOT" | "not")`
+	Pos lexer.Position
+
+	Comma  bool `parser:" @','"`
+	AndNot bool `parser:"| @('AND' 'NOT' | 'and' 'not')"`
+	And    bool `parser:"| @('AND' | 'and')"`
+	OrNot  bool `parser:"| @('OR' 'NOT' | 'or' 'not')"`
+	Or     bool `parser:"| @('OR' | 'or')"`
+	In     bool `parser:"| @('IN' | 'in')"`
+	Not    bool `parser:"| @('NOT' | 'not')"`
 }
 
 func (fvs *FilterValueSeparator) String() string {
@@ -237,3 +269,101 @@ func (fvs *FilterValueSeparator) String() string {
 
 	return " IN "
 }
+
+func (mf *MetricFilter) Position() lexer.Position { return mf.Pos }
+func (mf *MetricFilter) Kind() NodeKind           { return KindMetricFilter }
+
+func (mf *MetricFilter) Children() []Node {
+	nodes := []Node{}
+	if mf.Left != nil {
+		nodes = append(nodes, mf.Left)
+	}
+	for _, p := range mf.Parameters {
+		nodes = append(nodes, p)
+	}
+	return nodes
+}
+
+func (p *Param) Position() lexer.Position { return p.Pos }
+func (p *Param) Kind() NodeKind           { return KindParam }
+
+func (p *Param) Children() []Node {
+	switch {
+	case p.GroupedFilter != nil:
+		return []Node{p.GroupedFilter}
+	case p.Separator != nil:
+		return []Node{p.Separator}
+	case p.SimpleFilter != nil:
+		return []Node{p.SimpleFilter}
+	case p.TemplateVariable != nil:
+		return []Node{p.TemplateVariable}
+	}
+	return nil
+}
+
+func (sf *SimpleFilter) Position() lexer.Position { return sf.Pos }
+func (sf *SimpleFilter) Kind() NodeKind           { return KindSimpleFilter }
+
+func (sf *SimpleFilter) Children() []Node {
+	nodes := []Node{}
+	if sf.FilterSeparator != nil {
+		nodes = append(nodes, sf.FilterSeparator)
+	}
+	if sf.FilterValue != nil {
+		nodes = append(nodes, sf.FilterValue)
+	}
+	return nodes
+}
+
+func (gf *GroupedFilter) Position() lexer.Position { return gf.Pos }
+func (gf *GroupedFilter) Kind() NodeKind           { return KindGroupedFilter }
+
+func (gf *GroupedFilter) Children() []Node {
+	nodes := []Node{}
+	for _, p := range gf.Parameters {
+		nodes = append(nodes, p)
+	}
+	return nodes
+}
+
+func (fs *FilterSeparator) Position() lexer.Position { return fs.Pos }
+func (fs *FilterSeparator) Kind() NodeKind           { return KindFilterSeparator }
+func (fs *FilterSeparator) Children() []Node         { return nil }
+
+func (fk *FilterKey) Position() lexer.Position { return fk.Pos }
+func (fk *FilterKey) Kind() NodeKind           { return KindFilterKey }
+func (fk *FilterKey) Children() []Node         { return nil }
+
+func (fv *FilterValue) Position() lexer.Position { return fv.Pos }
+func (fv *FilterValue) Kind() NodeKind           { return KindFilterValue }
+
+func (fv *FilterValue) Children() []Node {
+	if len(fv.ListValue) > 0 {
+		nodes := []Node{}
+		for _, v := range fv.ListValue {
+			nodes = append(nodes, v)
+		}
+		return nodes
+	}
+	if fv.SimpleValue != nil {
+		return []Node{fv.SimpleValue}
+	}
+	return nil
+}
+
+func (v *Value) Position() lexer.Position { return v.Pos }
+func (v *Value) Kind() NodeKind           { return KindValue }
+
+func (v *Value) Children() []Node {
+	if v.Separator != nil {
+		return []Node{v.Separator}
+	}
+	if v.TemplateVariable != nil {
+		return []Node{v.TemplateVariable}
+	}
+	return nil
+}
+
+func (fvs *FilterValueSeparator) Position() lexer.Position { return fvs.Pos }
+func (fvs *FilterValueSeparator) Kind() NodeKind           { return KindFilterValueSeparator }
+func (fvs *FilterValueSeparator) Children() []Node         { return nil }
@@ -112,6 +112,12 @@ func Test_MetricMonitorFilter(t *testing.T) {
 			wantErr:  false,
 			printAST: false,
 		},
+		{
+			name:     "test bare tags",
+			query:    "production, !canary",
+			wantErr:  false,
+			printAST: false,
+		},
 		{
 			name:     "test multiple negative filter with !",
 			query:    "!a:b, !c:d",
@@ -11,40 +11,149 @@ import (
 type MetricMonitor struct {
 	Pos lexer.Position
 
-	Aggregation      string       `@Ident`
-	EvaluationWindow string       `"(" @Ident ")" ":"`
-	MetricQuery      *MetricQuery `@@`
-	Comparator       string       `@( ">" | ">" "=" | "<" | "<" "=" )`
-	Threshold        float64      `@(Ident)`
+	// ChangeType is "change" or "pct_change" for change alerts, which compare
+	// the aggregated value with its value ShiftWindow earlier, e.g.
+	// "pct_change(avg(last_5m),last_1h)". It is empty for other monitors.
+	ChangeType       string `parser:"( @('change' | 'pct_change') '(' )?"`
+	Aggregation      string `parser:"@Ident"`
+	EvaluationWindow string `parser:"'(' @Ident ')'"`
+	ShiftWindow      string `parser:"( ',' @Ident ')' )? ':'"`
+	// MetricExpression holds bodies that combine queries, such as
+	// "sum:a{*} / sum:b{*} * 100". Parse moves bodies that are a single
+	// (possibly wrapped) query to MetricQuery, so exactly one of the two is
+	// set.
+	MetricExpression *MetricExpression `parser:"@@"`
+	MetricQuery      *MetricQuery
+	Condition
 }
 
 // String returns the string representation of the metric monitor.
 func (mm *MetricMonitor) String() string {
-	return fmt.Sprintf("%s(%s):%s %s %g", mm.Aggregation, mm.EvaluationWindow, mm.MetricQuery.String(), mm.Comparator, mm.Threshold)
+	return fmt.Sprintf("%s:%s %s", mm.timeAggregation(), mm.Body().String(), mm.Condition)
+}
+
+// timeAggregation returns the part before the colon, e.g. "avg(last_5m)" or
+// "change(max(last_5m),last_30m)".
+func (mm *MetricMonitor) timeAggregation() string {
+	agg := fmt.Sprintf("%s(%s)", mm.Aggregation, mm.EvaluationWindow)
+	if mm.ChangeType != "" {
+		return fmt.Sprintf("%s(%s,%s)", mm.ChangeType, agg, mm.ShiftWindow)
+	}
+	return agg
+}
+
+// Body returns the monitored query or expression.
+func (mm *MetricMonitor) Body() Node {
+	if mm.MetricExpression != nil {
+		return mm.MetricExpression
+	}
+	return mm.MetricQuery
+}
+
+// MetricQueries returns every metric query the monitor evaluates, in order,
+// looking through arithmetic and wrapper functions.
+func (mm *MetricMonitor) MetricQueries() []*MetricQuery {
+	queries := []*MetricQuery{}
+	Inspect(mm, func(n Node) bool {
+		if mq, ok := n.(*MetricQuery); ok && mq.Query != nil {
+			queries = append(queries, mq)
+			return false
+		}
+		return true
+	})
+	return queries
+}
+
+func (mm *MetricMonitor) Position() lexer.Position { return mm.Pos }
+func (mm *MetricMonitor) Kind() NodeKind           { return KindMetricMonitor }
+
+func (mm *MetricMonitor) Children() []Node {
+	if mm.MetricExpression != nil {
+		return []Node{mm.MetricExpression}
+	} else if mm.MetricQuery != nil {
+		return []Node{mm.MetricQuery}
+	}
+	return nil
+}
+
+// singleMetricQuery returns the query an expression consists of, converting
+// wrapper functions such as "default_zero(sum:a{*})" into their MetricQuery
+// form. It returns nil when the expression combines several values.
+func singleMetricQuery(me *MetricExpression) *MetricQuery {
+	ge := me.GroupedExpression
+	if ge == nil || len(ge.Right) > 0 || ge.Left == nil || len(ge.Left.Right) > 0 || ge.Left.Left == nil {
+		return nil
+	}
+	value := ge.Left.Left.Base
+	switch {
+	case value == nil:
+		return nil
+	case value.MetricQuery != nil:
+		return value.MetricQuery
+	case value.ExprAggregatorFuction != nil:
+		fn := value.ExprAggregatorFuction
+		body := singleMetricQuery(&MetricExpression{GroupedExpression: fn.Body})
+		if body == nil {
+			return nil
+		}
+		return &MetricQuery{
+			Pos:               fn.Pos,
+			AggregatorFuction: &AggregatorFuction{Pos: fn.Pos, Name: fn.Name, Body: body, Args: fn.Args},
+		}
+	}
+	return nil
 }
 
 // NewMetricMonitorParser returns a Parser which is capable of interpretting
-// a metric query.
+// a metric monitor query.
 func NewMetricMonitorParser() *MetricMonitorParser {
 	mmp := &MetricMonitorParser{
 		parser: participle.MustBuild[MetricMonitor](
-			participle.Lexer(lex),
-			participle.Unquote("String"),
+			participle.Lexer(exprLex),
 		),
 	}
 
 	return mmp
 }
 
+var metricMonitorParser = NewMetricMonitorParser()
+
 // MetricMonitorParser is parser returned when calling NewMetricMonitorParser.
 type MetricMonitorParser struct {
 	parser *participle.Parser[MetricMonitor]
 }
 
-// Parse sanitizes the query string and returns the AST and any error.
+// Parse sanitizes the query string and returns the AST. Invalid input is
+// reported as a *ParseError.
 func (mmp *MetricMonitorParser) Parse(query string) (*MetricMonitor, error) {
 	// the parser doesn't handle queries that are split up across multiple lines
 	sanitized := strings.ReplaceAll(query, "\n", "")
-	// return the raw parsed outpu
-	return mmp.parser.ParseString("", sanitized)
+	ast, err := mmp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+	if err := ast.Condition.resolve(query, sanitized); err != nil {
+		return nil, err
+	}
+	// the grammar makes the shift window optional, so check that it is
+	// written exactly when the monitor is a change alert
+	if ast.ChangeType == "" && ast.ShiftWindow != "" {
+		pos := lexer.Position{Offset: strings.Index(sanitized, ",")}
+		return nil, newParseError(query, participle.Errorf(pos, "shift window %q is only allowed in change() or pct_change()", ast.ShiftWindow))
+	}
+	if ast.ChangeType != "" && ast.ShiftWindow == "" {
+		pos := lexer.Position{Offset: strings.Index(sanitized, ":")}
+		return nil, newParseError(query, participle.Errorf(pos, "%s() needs a shift window, e.g. %s(avg(last_5m),last_1h)", ast.ChangeType, ast.ChangeType))
+	}
+	if err := resolveMonitorFunctions(sanitized, ast); err != nil {
+		return nil, newParseError(query, err)
+	}
+	resolveNumbers(ast)
+	if err := rejectQueryReferences(ast); err != nil {
+		return nil, newParseError(query, err)
+	}
+	if mq := singleMetricQuery(ast.MetricExpression); mq != nil {
+		ast.MetricQuery, ast.MetricExpression = mq, nil
+	}
+	return ast, nil
 }
@@ -1,9 +1,11 @@
 package ddqp
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/alecthomas/repr"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -34,6 +36,18 @@ func Test_MetricMonitor(t *testing.T) {
 			wantErr:  false,
 			printAST: false,
 		},
+		{
+			name:  "space aggregation condition",
+			query: "avg(last_5m):count(v: v<=1):a{v:>=10} > 0",
+		},
+		{
+			name:  "space aggregation condition in an expression",
+			query: "avg(last_5m):count(v: v<=1):a{v:>=10} / sum:b{*} > 0",
+		},
+		{
+			name:  "negated expression",
+			query: "avg(last_5m):-sum:a{*} * 1e-3 > 5",
+		},
 		{
 			name:     "test less than operator",
 			query:    "min(last_10m):min:system.cpu.idle{env:production} by {host} < 10",
@@ -70,6 +84,114 @@ func Test_MetricMonitor(t *testing.T) {
 			wantErr:  false,
 			printAST: false,
 		},
+		{
+			name:     "test greater than or equal comparator",
+			query:    "avg(last_5m):sum:errors.count{service:api} >= 500",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test less than or equal comparator",
+			query:    "avg(last_5m):avg:system.memory.free{*} <= 100",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test equal comparator",
+			query:    "max(last_5m):sum:jobs.failed{*} == 0",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test not equal comparator",
+			query:    "max(last_5m):sum:jobs.running{*} != 1",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test negative threshold",
+			query:    "avg(last_5m):avg:temperature{*} < -5",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test scientific notation threshold",
+			query:    "avg(last_5m):sum:bytes.sent{*} > 1e6",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test signed exponent threshold",
+			query:    "avg(last_5m):sum:bytes.sent{*} > 1.5e+06",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test leading plus threshold",
+			query:    "avg(last_5m):sum:bytes.sent{*} >= +5",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test arithmetic expression monitor",
+			query:    "avg(last_5m):sum:errors{*}.as_count() / sum:hits{*}.as_count() * 100 > 5",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test wrapped expression monitor",
+			query:    "max(last_10m):default_zero(sum:a{*}) - sum:b{*} > 0",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test parenthesized expression monitor",
+			query:    "avg(last_1h):(sum:a{env:prod} + sum:b{env:prod}) / 2 >= 10",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test wrapper with string args monitor",
+			query:    "avg(last_5m):top(sum:a{*} by {host}, 10, 'mean', 'desc') > 1",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test percent change monitor",
+			query:    "pct_change(avg(last_5m),last_1h):avg:system.load.1{*} by {host} > 20",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test change monitor",
+			query:    "change(max(last_5m),last_30m):sum:errors{service:api}.as_count() >= 100",
+			wantErr:  false,
+			printAST: false,
+		},
+		{
+			name:     "test change monitor without shift window",
+			query:    "change(max(last_5m)):sum:errors{*} > 1",
+			wantErr:  true,
+			printAST: false,
+		},
+		{
+			name:     "test shift window without change",
+			query:    "max(last_5m),last_30m):sum:errors{*} > 1",
+			wantErr:  true,
+			printAST: false,
+		},
+		{
+			name:     "test non-numeric threshold",
+			query:    "avg(last_5m):sum:bytes.sent{*} > high",
+			wantErr:  true,
+			printAST: false,
+		},
+		{
+			name:     "test single equals comparator",
+			query:    "avg(last_5m):sum:bytes.sent{*} = 5",
+			wantErr:  true,
+			printAST: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -77,6 +199,10 @@ func Test_MetricMonitor(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				require.NoError(t, err)
 			}
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
 
 			if tt.printAST {
 				repr.Println(ast)
@@ -88,3 +214,142 @@ func Test_MetricMonitor(t *testing.T) {
 		})
 	}
 }
+
+func Test_MetricMonitorThreshold(t *testing.T) {
+	tests := []struct {
+		literal string
+		want    float64
+	}{
+		{"90", 90},
+		{"25.75", 25.75},
+		{"-5", -5},
+		{"+5", 5},
+		{"1e6", 1000000},
+		{"1.5e+06", 1500000},
+		{"-2.5e-3", -0.0025},
+	}
+	parser := NewMetricMonitorParser()
+	for _, tt := range tests {
+		t.Run(tt.literal, func(t *testing.T) {
+			m, err := parser.Parse("avg(last_5m):sum:m{*} > " + tt.literal)
+			require.NoError(t, err)
+			assert.Equal(t, tt.literal, m.ThresholdLiteral)
+			assert.Equal(t, tt.want, m.Threshold)
+		})
+	}
+}
+
+func Test_MetricMonitorThresholdChanged(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("avg(last_5m):sum:m{*} > 1e6")
+	require.NoError(t, err)
+	assert.Equal(t, "avg(last_5m):sum:m{*} > 1e6", m.String())
+
+	// a threshold changed after parsing wins over the original literal
+	m.Threshold = 2000000
+	assert.Equal(t, "avg(last_5m):sum:m{*} > 2000000", m.String())
+
+	built := &MetricMonitor{
+		Aggregation:      "avg",
+		EvaluationWindow: "last_5m",
+		MetricQuery:      m.MetricQuery,
+		Condition:        Condition{Comparator: "<", Threshold: 0.5},
+	}
+	assert.Equal(t, "avg(last_5m):sum:m{*} < 0.5", built.String())
+}
+
+func Test_MetricMonitorBody(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		wantExpression bool
+		wantQueries    []string
+	}{
+		{
+			name:        "single query",
+			query:       "avg(last_5m):sum:a{*} > 1",
+			wantQueries: []string{"sum:a{*}"},
+		},
+		{
+			name:        "wrapped query",
+			query:       "avg(last_5m):default_zero(sum:a{*}) > 1",
+			wantQueries: []string{"sum:a{*}"},
+		},
+		{
+			name:           "ratio",
+			query:          "avg(last_5m):sum:errors{*}.as_count() / sum:hits{*}.as_count() * 100 > 5",
+			wantExpression: true,
+			wantQueries:    []string{"sum:errors{*}.as_count()", "sum:hits{*}.as_count()"},
+		},
+		{
+			name:           "wrapper inside expression",
+			query:          "max(last_10m):default_zero(sum:a{*}) - sum:b{*} > 0",
+			wantExpression: true,
+			wantQueries:    []string{"sum:a{*}", "sum:b{*}"},
+		},
+	}
+	parser := NewMetricMonitorParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+			if tt.wantExpression {
+				assert.Nil(t, m.MetricQuery)
+				assert.NotNil(t, m.MetricExpression)
+			} else {
+				assert.NotNil(t, m.MetricQuery)
+				assert.Nil(t, m.MetricExpression)
+			}
+
+			queries := []string{}
+			for _, q := range m.MetricQueries() {
+				queries = append(queries, q.String())
+			}
+			assert.Equal(t, tt.wantQueries, queries)
+		})
+	}
+}
+
+func Test_MetricMonitorChange(t *testing.T) {
+	tests := []struct {
+		query       string
+		changeType  string
+		aggregation string
+		window      string
+		shift       string
+	}{
+		{"pct_change(avg(last_5m),last_1h):avg:system.load.1{*} by {host} > 20", "pct_change", "avg", "last_5m", "last_1h"},
+		{"change(max(last_5m),last_30m):sum:errors{*} > 100", "change", "max", "last_5m", "last_30m"},
+		{"avg(last_5m):sum:errors{*} > 100", "", "avg", "last_5m", ""},
+	}
+	parser := NewMetricMonitorParser()
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			m, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.changeType, m.ChangeType)
+			assert.Equal(t, tt.aggregation, m.Aggregation)
+			assert.Equal(t, tt.window, m.EvaluationWindow)
+			assert.Equal(t, tt.shift, m.ShiftWindow)
+		})
+	}
+}
+
+func Test_MetricMonitorChangeErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"change(avg(last_5m):avg:a{*} > 1", "1:20: change() needs a shift window, e.g. change(avg(last_5m),last_1h)"},
+		{"pct_change(avg(last_5m):avg:a{*} > 1", "1:24: pct_change() needs a shift window"},
+		{"avg(last_5m),last_1h):avg:a{*} > 1", `1:13: shift window "last_1h" is only allowed in change() or pct_change()`},
+	}
+	parser := NewMetricMonitorParser()
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := parser.Parse(tt.query)
+			var pe *ParseError
+			require.True(t, errors.As(err, &pe), "%v", err)
+			assert.Contains(t, pe.Error(), tt.want)
+		})
+	}
+}
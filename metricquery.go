@@ -48,7 +48,7 @@ type Query struct {
 	MetricName string        `parser:"@Ident( @'.' @Ident)*"`
 	Filters    *MetricFilter `parser:"'{' @@ '}'"`
 	By         string        `parser:"('by')?"`
-	Grouping   []string      `parser:"( '{' ( @(Ident|'*') ( ',' @(Ident|'*') )* ) '}' )?"`
+	Grouping   []string      `parser:"( '{' ( @(Ident|'*'|TemplateVariable) ( ',' @(Ident|'*'|TemplateVariable) )* ) '}' )?"`
 	Function   []*Function   `parser:"( '.' @@ ( '.' @@ )* )?"`
 }
 
@@ -59,14 +59,18 @@ type Aggregator struct {
 	Separator                 string `parser:"':'"`
 }
 
+// String prints the aggregator including its trailing separator, e.g. "sum:".
+func (a *Aggregator) String() string {
+	if a.SpaceAggregationCondition != "" {
+		return fmt.Sprintf("%s(%s):", a.Name, a.SpaceAggregationCondition)
+	}
+	return fmt.Sprintf("%s:", a.Name)
+}
+
 func (q *Query) String() string {
 	base := ""
 	if q.Aggregator != nil {
-		base = q.Aggregator.Name
-		if q.Aggregator.SpaceAggregationCondition != "" {
-			base = fmt.Sprintf("%s(%s)", base, q.Aggregator.SpaceAggregationCondition)
-		}
-		base = fmt.Sprintf("%s:", base)
+		base = q.Aggregator.String()
 	}
 
 	base = fmt.Sprintf("%s%s{%s}", base, q.MetricName, q.Filters.String())
@@ -87,6 +91,7 @@ func (q *Query) String() string {
 }
 
 type Function struct {
+	Pos  lexer.Position
 	Name string   `parser:"@Ident"`
 	Args []*Value `parser:"'(' ( @@ ( ',' @@ )* )? ')'"`
 }
@@ -99,6 +104,65 @@ func (f *Function) String() string {
 	return fmt.Sprintf("%s(%s)", f.Name, strings.Join(args, ","))
 }
 
+func (mq *MetricQuery) Position() lexer.Position { return mq.Pos }
+func (mq *MetricQuery) Kind() NodeKind           { return KindMetricQuery }
+
+func (mq *MetricQuery) Children() []Node {
+	if mq.Query != nil {
+		return []Node{mq.Query}
+	}
+	if mq.AggregatorFuction != nil {
+		return []Node{mq.AggregatorFuction}
+	}
+	return nil
+}
+
+func (w *AggregatorFuction) Position() lexer.Position { return w.Pos }
+func (w *AggregatorFuction) Kind() NodeKind           { return KindAggregatorFuction }
+
+func (w *AggregatorFuction) Children() []Node {
+	nodes := []Node{}
+	if w.Body != nil {
+		nodes = append(nodes, w.Body)
+	}
+	for _, v := range w.Args {
+		nodes = append(nodes, v)
+	}
+	return nodes
+}
+
+func (q *Query) Position() lexer.Position { return q.Pos }
+func (q *Query) Kind() NodeKind           { return KindQuery }
+
+func (q *Query) Children() []Node {
+	nodes := []Node{}
+	if q.Aggregator != nil {
+		nodes = append(nodes, q.Aggregator)
+	}
+	if q.Filters != nil {
+		nodes = append(nodes, q.Filters)
+	}
+	for _, f := range q.Function {
+		nodes = append(nodes, f)
+	}
+	return nodes
+}
+
+func (a *Aggregator) Position() lexer.Position { return a.Pos }
+func (a *Aggregator) Kind() NodeKind           { return KindAggregator }
+func (a *Aggregator) Children() []Node         { return nil }
+
+func (f *Function) Position() lexer.Position { return f.Pos }
+func (f *Function) Kind() NodeKind           { return KindFunction }
+
+func (f *Function) Children() []Node {
+	nodes := []Node{}
+	for _, v := range f.Args {
+		nodes = append(nodes, v)
+	}
+	return nodes
+}
+
 type Bool bool
 
 func (b *Bool) Capture(v []string) error { *b = v[0] == "true"; return nil }
@@ -116,15 +180,23 @@ func NewMetricQueryParser() *MetricQueryParser {
 	return mqp
 }
 
+// metricQueryParser is shared by the functions that parse metric queries
+// themselves, so that they don't build a parser on every call.
+var metricQueryParser = NewMetricQueryParser()
+
 // MetricQueryParser is parser returned when calling NewMetricQueryParser.
 type MetricQueryParser struct {
 	parser *participle.Parser[MetricQuery]
 }
 
-// Parse sanitizes the query string and returns the AST and any error.
+// Parse sanitizes the query string and returns the AST. Invalid input is
+// reported as a *ParseError.
 func (mqp *MetricQueryParser) Parse(query string) (*MetricQuery, error) {
 	// the parser doesn't handle queries that are split up across multiple lines
 	sanitized := strings.ReplaceAll(query, "\n", "")
-	// return the raw parsed outpu
-	return mqp.parser.ParseString("", sanitized)
+	ast, err := mqp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+	return ast, nil
 }
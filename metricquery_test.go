@@ -50,6 +50,12 @@ func Test_MetricQuery(t *testing.T) {
 			wantErr:  false,
 			printAST: false,
 		},
+		{
+			name:     "filter value with a leading hyphen",
+			query:    "avg:namespace.metric.name{host:-foo}",
+			wantErr:  false,
+			printAST: false,
+		},
 		{
 			name:     "test underscores in metric name",
 			query:    "sum:namespace.metric_name{foo:bar} by {baz}",
@@ -0,0 +1,274 @@
+package ddqp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// Anomalies is the anomalies() monitor function:
+//
+//	anomalies(avg:system.cpu.user{env:prod}, 'agile', 2, direction='above', alert_window='last_15m')
+type Anomalies struct {
+	Pos lexer.Position
+
+	Query *GroupedExpression `parser:"'anomalies' '(' @@ ','"`
+	// AlgorithmLiteral is the algorithm as written, including its quotes.
+	AlgorithmLiteral string `parser:"@String ','"`
+	// Algorithm is one of "basic", "agile" or "robust". It is filled in by
+	// Parse; nodes built by hand only need to set Algorithm.
+	Algorithm string
+	// BoundsLiteral is the bounds as written, e.g. "2" or "2.0".
+	BoundsLiteral string `parser:"@(Ident | Float | Int)"`
+	// Bounds is the width of the expected range, in standard deviations. It
+	// is filled in by Parse; nodes built by hand only need to set Bounds.
+	Bounds float64
+	// Options are the named arguments, e.g. direction='above', in the order
+	// they were written.
+	Options []*NamedArg `parser:"( ',' @@ )* ')'"`
+}
+
+// Forecast is the forecast() monitor function:
+//
+//	forecast(avg:system.disk.in_use{*} by {host}, 'linear', 1, history='1w')
+type Forecast struct {
+	Pos lexer.Position
+
+	Query *GroupedExpression `parser:"'forecast' '(' @@ ','"`
+	// AlgorithmLiteral is the algorithm as written, including its quotes.
+	AlgorithmLiteral string `parser:"@String ','"`
+	// Algorithm is either "linear" or "seasonal". It is filled in by Parse;
+	// nodes built by hand only need to set Algorithm.
+	Algorithm string
+	// DeviationsLiteral is the deviations as written, e.g. "1" or "1e0".
+	DeviationsLiteral string `parser:"@(Ident | Float | Int)"`
+	// Deviations is the width of the forecast range, in standard deviations.
+	// It is filled in by Parse; nodes built by hand only need to set
+	// Deviations.
+	Deviations float64
+	// Options are the named arguments, e.g. model='default', in the order
+	// they were written.
+	Options []*NamedArg `parser:"( ',' @@ )* ')'"`
+}
+
+// Outliers is the outliers() monitor function:
+//
+//	outliers(avg:system.cpu.user{*} by {host}, 'mad', 3, 20)
+type Outliers struct {
+	Pos lexer.Position
+
+	Query *GroupedExpression `parser:"'outliers' '(' @@ ','"`
+	// AlgorithmLiteral is the algorithm as written, including its quotes.
+	AlgorithmLiteral string `parser:"@String ','"`
+	// Algorithm is one of "dbscan", "scaleddbscan", "mad" or "scaledmad",
+	// matched without regard to case. It is filled in by Parse; nodes built by
+	// hand only need to set Algorithm.
+	Algorithm string
+	// ToleranceLiteral is the tolerance as written, e.g. "3" or "3.0".
+	ToleranceLiteral string `parser:"@(Ident | Float | Int)"`
+	// Tolerance controls how far a series must deviate to be an outlier. It
+	// is filled in by Parse; nodes built by hand only need to set Tolerance.
+	Tolerance float64
+	// PercentageLiteral is the percentage as written, or "" if it is omitted.
+	PercentageLiteral string `parser:"( (?! ',' Ident '=') ',' @(Ident | Float | Int) )?"`
+	// Percentage is the optional share of points that must deviate, used by
+	// the MAD algorithms. It is filled in by Parse when PercentageLiteral is
+	// set.
+	Percentage *float64
+	// Options are the named arguments in the order they were written.
+	Options []*NamedArg `parser:"( ',' @@ )* ')'"`
+}
+
+// NamedArg is a keyword argument of a monitor function, e.g. interval=60 or
+// direction='above'.
+type NamedArg struct {
+	Pos lexer.Position
+
+	Name  string `parser:"@Ident '='"`
+	Value *Value `parser:"@@"`
+}
+
+func (na *NamedArg) String() string {
+	return fmt.Sprintf("%s=%s", na.Name, na.Value.String())
+}
+
+// Option returns the value of the named argument, without quotes.
+func (a *Anomalies) Option(name string) (string, bool) { return option(a.Options, name) }
+
+// Option returns the value of the named argument, without quotes.
+func (f *Forecast) Option(name string) (string, bool) { return option(f.Options, name) }
+
+// Option returns the value of the named argument, without quotes.
+func (o *Outliers) Option(name string) (string, bool) { return option(o.Options, name) }
+
+func option(opts []*NamedArg, name string) (string, bool) {
+	for _, opt := range opts {
+		if opt.Name == name && opt.Value != nil {
+			return unquote(opt.Value.String()), true
+		}
+	}
+	return "", false
+}
+
+// monitorAlgorithms lists the algorithms accepted by each monitor function.
+var monitorAlgorithms = map[string][]string{
+	"anomalies": {"basic", "agile", "robust"},
+	"forecast":  {"linear", "seasonal"},
+	"outliers":  {"dbscan", "scaleddbscan", "mad", "scaledmad"},
+}
+
+// monitorFunction is implemented by Anomalies, Forecast and Outliers so that
+// printing, formatting and comparison can treat them alike.
+type monitorFunction interface {
+	Node
+	call() *monitorCall
+}
+
+// monitorCall is the shape shared by the monitor functions: a name, a body,
+// a quoted algorithm, numeric positional arguments and named options.
+type monitorCall struct {
+	name      string
+	body      *GroupedExpression
+	algorithm *string // Algorithm field of the node
+	literal   *string // AlgorithmLiteral field of the node
+	numbers   []monitorNumber
+	options   []*NamedArg
+}
+
+// monitorNumber is a numeric positional argument of a monitor function.
+type monitorNumber struct {
+	literal *string // e.g. the BoundsLiteral field of the node
+	value   *float64
+}
+
+func (n monitorNumber) String() string {
+	return literalString(*n.literal, *n.value)
+}
+
+func (a *Anomalies) call() *monitorCall {
+	return &monitorCall{"anomalies", a.Query, &a.Algorithm, &a.AlgorithmLiteral, []monitorNumber{{&a.BoundsLiteral, &a.Bounds}}, a.Options}
+}
+
+func (f *Forecast) call() *monitorCall {
+	return &monitorCall{"forecast", f.Query, &f.Algorithm, &f.AlgorithmLiteral, []monitorNumber{{&f.DeviationsLiteral, &f.Deviations}}, f.Options}
+}
+
+func (o *Outliers) call() *monitorCall {
+	numbers := []monitorNumber{{&o.ToleranceLiteral, &o.Tolerance}}
+	if o.Percentage != nil {
+		numbers = append(numbers, monitorNumber{&o.PercentageLiteral, o.Percentage})
+	}
+	return &monitorCall{"outliers", o.Query, &o.Algorithm, &o.AlgorithmLiteral, numbers, o.Options}
+}
+
+// algorithmString returns AlgorithmLiteral unless Algorithm was changed after
+// parsing.
+func (c *monitorCall) algorithmString() string {
+	if *c.literal != "" && unquote(*c.literal) == *c.algorithm {
+		return *c.literal
+	}
+	return "'" + *c.algorithm + "'"
+}
+
+// render prints the call using the given rendering of the body and the
+// arguments.
+func (c *monitorCall) render(body, algorithm string, number func(monitorNumber) string, value func(*Value) string, comma string) string {
+	parts := []string{body, algorithm}
+	for _, n := range c.numbers {
+		parts = append(parts, number(n))
+	}
+	for _, opt := range c.options {
+		parts = append(parts, opt.Name+"="+value(opt.Value))
+	}
+	return fmt.Sprintf("%s(%s)", c.name, strings.Join(parts, comma))
+}
+
+func (c *monitorCall) String() string {
+	return c.render(c.body.String(), c.algorithmString(), monitorNumber.String, (*Value).String, ", ")
+}
+
+func (a *Anomalies) String() string { return a.call().String() }
+func (f *Forecast) String() string  { return f.call().String() }
+func (o *Outliers) String() string  { return o.call().String() }
+
+func (a *Anomalies) Position() lexer.Position { return a.Pos }
+func (a *Anomalies) Kind() NodeKind           { return KindAnomalies }
+func (a *Anomalies) Children() []Node         { return a.call().children() }
+
+func (f *Forecast) Position() lexer.Position { return f.Pos }
+func (f *Forecast) Kind() NodeKind           { return KindForecast }
+func (f *Forecast) Children() []Node         { return f.call().children() }
+
+func (o *Outliers) Position() lexer.Position { return o.Pos }
+func (o *Outliers) Kind() NodeKind           { return KindOutliers }
+func (o *Outliers) Children() []Node         { return o.call().children() }
+
+func (c *monitorCall) children() []Node {
+	nodes := []Node{}
+	if c.body != nil {
+		nodes = append(nodes, c.body)
+	}
+	for _, opt := range c.options {
+		nodes = append(nodes, opt)
+	}
+	return nodes
+}
+
+func (na *NamedArg) Position() lexer.Position { return na.Pos }
+func (na *NamedArg) Kind() NodeKind           { return KindNamedArg }
+
+func (na *NamedArg) Children() []Node {
+	if na.Value != nil {
+		return []Node{na.Value}
+	}
+	return nil
+}
+
+// resolveMonitorFunctions fills in the Algorithm and numeric arguments of
+// every monitor function below root and checks the algorithm against
+// monitorAlgorithms. sanitized is the text that was parsed, used to point
+// errors at the offending argument.
+func resolveMonitorFunctions(sanitized string, root Node) error {
+	var err error
+	Inspect(root, func(n Node) bool {
+		fn, ok := n.(monitorFunction)
+		if !ok || err != nil {
+			return err == nil
+		}
+		if o, ok := fn.(*Outliers); ok && o.PercentageLiteral != "" {
+			// the grammar only captures the literal of the optional percentage
+			o.Percentage = new(float64)
+		}
+		c := fn.call()
+		algorithmPos := argumentPosition(sanitized, fn.Position(), *c.literal)
+		for _, number := range c.numbers {
+			v, parseErr := parseThreshold(*number.literal)
+			if parseErr != nil {
+				err = participle.Errorf(argumentPosition(sanitized, algorithmPos, *number.literal), "invalid %s argument %q", c.name, *number.literal)
+				return false
+			}
+			*number.value = v
+		}
+		*c.algorithm = unquote(*c.literal)
+		allowed := monitorAlgorithms[c.name]
+		for _, name := range allowed {
+			if strings.EqualFold(name, *c.algorithm) {
+				return true
+			}
+		}
+		err = participle.Errorf(algorithmPos, "unknown %s algorithm %q, expected one of %s", c.name, *c.algorithm, strings.Join(allowed, ", "))
+		return false
+	})
+	return err
+}
+
+// argumentPosition returns the position of the first occurrence of arg from
+// pos on, or pos if arg is not found.
+func argumentPosition(sanitized string, pos lexer.Position, arg string) lexer.Position {
+	if i := strings.Index(sanitized[pos.Offset:], arg); i >= 0 {
+		pos.Offset += i
+	}
+	return pos
+}
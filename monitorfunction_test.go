@@ -0,0 +1,208 @@
+package ddqp
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MonitorFunctions(t *testing.T) {
+	parser := NewMetricMonitorParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{
+			name:  "anomalies with options",
+			query: "avg(last_4h):anomalies(avg:system.cpu.user{env:prod}, 'agile', 2, direction='above', alert_window='last_15m', interval=60, count_default_zero='true') >= 1",
+		},
+		{
+			name:  "anomalies over an expression",
+			query: "avg(last_4h):anomalies(sum:errors{*} / sum:hits{*}, 'basic', 3) >= 1",
+		},
+		{
+			name:  "forecast over a future window",
+			query: "max(next_1w):forecast(avg:system.disk.in_use{*} by {host}, 'linear', 1) >= 0.95",
+		},
+		{
+			name:  "seasonal forecast with options",
+			query: "max(next_3d):forecast(avg:system.disk.in_use{*} by {host}, 'seasonal', 2, interval='60m', seasonality='weekly') >= 0.9",
+		},
+		{
+			name:  "outliers",
+			query: "avg(last_1h):outliers(avg:cpu{*} by {host}, 'dbscan', 3) > 0",
+		},
+		{
+			name:  "outliers with percentage",
+			query: "avg(last_1h):outliers(avg:cpu{*} by {host}, 'scaledMAD', 3, 20) > 0",
+		},
+		{
+			name:  "outliers with options",
+			query: "avg(last_1h):outliers(avg:cpu{*} by {host}, 'mad', 3, 20, direction='above') > 0",
+		},
+		{
+			name:  "bounds as written",
+			query: "avg(last_4h):anomalies(avg:cpu{*}, 'agile', 2.0) >= 1",
+		},
+		{
+			name:  "deviations in scientific notation",
+			query: "max(next_1w):forecast(avg:system.disk.in_use{*}, 'linear', 1e0) >= 0.95",
+		},
+		{
+			name:  "tolerance and percentage as written",
+			query: "avg(last_1h):outliers(avg:cpu{*} by {host}, 'mad', 3.0, 20.50) > 0",
+		},
+		{
+			name:    "invalid bounds",
+			query:   "avg(last_4h):anomalies(avg:cpu{*}, 'agile', two) >= 1",
+			wantErr: true,
+		},
+		{
+			name:    "unknown anomalies algorithm",
+			query:   "avg(last_4h):anomalies(avg:cpu{*}, 'linear', 2) >= 1",
+			wantErr: true,
+		},
+		{
+			name:    "missing bounds",
+			query:   "avg(last_4h):anomalies(avg:cpu{*}, 'agile') >= 1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, ast.String())
+		})
+	}
+}
+
+func Test_MonitorFunctionFields(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse("avg(last_4h):anomalies(avg:system.cpu.user{env:prod}, 'agile', 2, direction='above', interval=60) >= 1")
+	require.NoError(t, err)
+	require.NotNil(t, m.MetricExpression)
+
+	a := m.MetricExpression.GroupedExpression.Left.Left.Base.Anomalies
+	require.NotNil(t, a)
+	assert.Equal(t, "agile", a.Algorithm)
+	assert.Equal(t, 2.0, a.Bounds)
+	assert.Equal(t, "avg:system.cpu.user{env:prod}", a.Query.String())
+
+	direction, ok := a.Option("direction")
+	assert.True(t, ok)
+	assert.Equal(t, "above", direction)
+	interval, ok := a.Option("interval")
+	assert.True(t, ok)
+	assert.Equal(t, "60", interval)
+	_, ok = a.Option("alert_window")
+	assert.False(t, ok)
+
+	queries := []string{}
+	for _, q := range m.MetricQueries() {
+		queries = append(queries, q.String())
+	}
+	assert.Equal(t, []string{"avg:system.cpu.user{env:prod}"}, queries)
+
+	// a changed algorithm wins over the parsed literal
+	a.Algorithm = "robust"
+	assert.Equal(t, "avg(last_4h):anomalies(avg:system.cpu.user{env:prod}, 'robust', 2, direction='above', interval=60) >= 1", m.String())
+
+	// and so do changed bounds
+	a.Bounds = 3
+	assert.Equal(t, "avg(last_4h):anomalies(avg:system.cpu.user{env:prod}, 'robust', 3, direction='above', interval=60) >= 1", m.String())
+}
+
+func Test_OutliersPercentage(t *testing.T) {
+	parser := NewMetricExpressionParser()
+
+	e, err := parser.Parse("outliers(avg:cpu{*} by {host}, 'mad', 3, 20)")
+	require.NoError(t, err)
+	o := e.GroupedExpression.Left.Left.Base.Outliers
+	require.NotNil(t, o)
+	require.NotNil(t, o.Percentage)
+	assert.Equal(t, 20.0, *o.Percentage)
+	assert.Empty(t, o.Options)
+
+	// a named option is not mistaken for the percentage
+	e, err = parser.Parse("outliers(avg:cpu{*} by {host}, 'dbscan', 3, direction='below')")
+	require.NoError(t, err)
+	o = e.GroupedExpression.Left.Left.Base.Outliers
+	assert.Nil(t, o.Percentage)
+	require.Len(t, o.Options, 1)
+	assert.Equal(t, "direction", o.Options[0].Name)
+}
+
+func Test_MonitorFunctionAlgorithmError(t *testing.T) {
+	query := "avg(last_1w):forecast(avg:disk{*}, 'agile', 1) > 0.9"
+	_, err := NewMetricMonitorParser().Parse(query)
+	require.Error(t, err)
+
+	var pe *ParseError
+	require.True(t, errors.As(err, &pe))
+	assert.Equal(t, 35, pe.Pos.Offset)
+	assert.Equal(t, `unknown forecast algorithm "agile", expected one of linear, seasonal`, pe.Hint)
+}
+
+func Test_MonitorFunctionJSON(t *testing.T) {
+	m, err := NewMetricMonitorParser().Parse(`avg(last_4h):anomalies(avg:cpu{*}, "agile", 2, direction='above') >= 1`)
+	require.NoError(t, err)
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"algorithm":"agile","algorithm_literal":"\"agile\"","bounds":2`)
+
+	decoded := &MetricMonitor{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, m, decoded)
+
+	e, err := NewMetricExpressionParser().Parse("outliers(avg:cpu{*} by {host}, 'mad', 3.0, 20)")
+	require.NoError(t, err)
+	data, err = json.Marshal(e)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"tolerance":3,"percentage":20,"number_literals":["3.0","20"]`)
+
+	fromJSON := &MetricExpression{}
+	require.NoError(t, json.Unmarshal(data, fromJSON))
+	assert.Equal(t, e.String(), fromJSON.String())
+}
+
+func Test_MonitorFunctionFormat(t *testing.T) {
+	for _, query := range []string{
+		"avg(last_4h):anomalies(avg:cpu{*}, 'agile', 2.0) >= 1",
+		`avg(last_4h):anomalies(avg:cpu{*}, "agile", 2e0) >= 1`,
+	} {
+		m, err := NewMetricMonitorParser().Parse(query)
+		require.NoError(t, err)
+		got, err := Format(m, Canonical)
+		require.NoError(t, err)
+		assert.Equal(t, `avg(last_4h):anomalies(avg:cpu{*}, "agile", 2) >= 1`, got, query)
+	}
+}
+
+func Test_MonitorFunctionEquivalent(t *testing.T) {
+	parser := NewMetricMonitorParser()
+	a, err := parser.Parse("avg(last_4h):anomalies(avg:cpu{*}, 'agile', 2, direction='above', interval=60) >= 1")
+	require.NoError(t, err)
+	b, err := parser.Parse(`avg(last_4h):anomalies(avg:cpu{*}, "agile", 2, interval=60, direction="above") >= 1`)
+	require.NoError(t, err)
+	ok, diff := Equivalent(a, b)
+	assert.True(t, ok, diff)
+
+	c, err := parser.Parse("avg(last_4h):anomalies(avg:cpu{*}, 'agile', 3, direction='above', interval=60) >= 1")
+	require.NoError(t, err)
+	ok, _ = Equivalent(a, c)
+	assert.False(t, ok)
+
+	out, err := Format(b, Canonical)
+	require.NoError(t, err)
+	assert.Equal(t, `avg(last_4h):anomalies(avg:cpu{*}, "agile", 2, interval=60, direction="above") >= 1`, out)
+}
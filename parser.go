@@ -1,21 +1,93 @@
 package ddqp
 
 import (
+	"io"
+
 	"github.com/alecthomas/participle/v2/lexer"
 )
 
 // This is the primary lexer for all parsers
-// nolint:govet
 var lex = lexer.MustSimple([]lexer.SimpleRule{
-	{"Comment", `(?i)rem[^\n]*`},
-	{"String", `"(\\"|[^"])*"|'[^']*'`},
-	{"SpaceAggregatorCondition", `v: v[<>=]*([0-9]*[.])?[0-9]+`},
-	{"ComparisonOperator", `:>[=]?|:<[=]?|:~`},
-	{"Ident", `[a-zA-Z0-9_][\w\d\-\*\./]*`},
-	{"FilterIdent", `[*/$-][\w\d*\-\.\/]+`},
-	{"Float", `[+-]?([0-9]*[.])?[0-9]+`},
-	{"Int", `\d+`},
-	{"Punct", `[-[!@#$%^&*()+_={}\|:;"'<,>.?\/]|]`},
-	{"EOL", `[\n\r]+`},
-	{"whitespace", `[ \t]+`},
+	{Name: "Comment", Pattern: `(?i)rem[^\n]*`},
+	{Name: "String", Pattern: `"(\\"|[^"])*"|'[^']*'`},
+	{Name: "SpaceAggregatorCondition", Pattern: `v: v[<>=]*([0-9]*[.])?[0-9]+`},
+	{Name: "ComparisonOperator", Pattern: `:>[=]?|:<[=]?|:~`},
+	{Name: "Ident", Pattern: `[a-zA-Z0-9_][\w\d\-\*\./]*`},
+	{Name: "TemplateVariable", Pattern: `\$[\w\-]+(\.[\w\-]+)?`},
+	{Name: "FilterIdent", Pattern: `[*/$-][\w\d*\-\.\/]+`},
+	{Name: "Float", Pattern: `[+-]?([0-9]*[.])?[0-9]+`},
+	{Name: "Int", Pattern: `\d+`},
+	{Name: "Punct", Pattern: `[-[!@#$%^&*()+_={}\|:;"'<,>.?\/]|]`},
+	{Name: "EOL", Pattern: `[\n\r]+`},
+	{Name: "whitespace", Pattern: `[ \t]+`},
 })
+
+// exprLex is the lexer for parsers of arithmetic expressions. It reads
+// tokens with lex, except that outside of braces a "-" directly before a
+// letter is a sign, as in "-sum:a{*}", rather than the start of a
+// FilterIdent. Filters such as "{host:-foo}" are lexed as before.
+var exprLex lexer.Definition = signDefinition{lex}
+
+var (
+	punctToken       = lex.Symbols()["Punct"]
+	identToken       = lex.Symbols()["Ident"]
+	filterIdentToken = lex.Symbols()["FilterIdent"]
+)
+
+type signDefinition struct {
+	lexer.Definition
+}
+
+func (d signDefinition) Lex(filename string, r io.Reader) (lexer.Lexer, error) {
+	l, err := d.Definition.Lex(filename, r)
+	if err != nil {
+		return nil, err
+	}
+	return &signLexer{Lexer: l}, nil
+}
+
+// signLexer splits a FilterIdent such as "-sum" into the sign and an Ident
+// when it is not inside braces.
+type signLexer struct {
+	lexer.Lexer
+
+	depth   int
+	pending *lexer.Token
+}
+
+func (l *signLexer) Next() (lexer.Token, error) {
+	if l.pending != nil {
+		tok := *l.pending
+		l.pending = nil
+		return tok, nil
+	}
+	tok, err := l.Lexer.Next()
+	if err != nil {
+		return tok, err
+	}
+	switch {
+	case tok.Type == punctToken && tok.Value == "{":
+		l.depth++
+	case tok.Type == punctToken && tok.Value == "}" && l.depth > 0:
+		l.depth--
+	case tok.Type == filterIdentToken && l.depth == 0 && isSignedName(tok.Value):
+		rest := tok
+		rest.Type = identToken
+		rest.Value = tok.Value[1:]
+		rest.Pos.Offset++
+		rest.Pos.Column++
+		l.pending = &rest
+		tok.Type = punctToken
+		tok.Value = "-"
+	}
+	return tok, nil
+}
+
+// isSignedName reports whether s is a "-" followed by the start of a name.
+func isSignedName(s string) bool {
+	if len(s) < 2 || s[0] != '-' {
+		return false
+	}
+	c := s[1]
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,208 @@
+package ddqp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// ProcessMonitor is a live process monitor query such as
+//
+//	processes('nginx').over('env:prod','role:lb').exclude('host:canary-*').rollup('count').last('10m') < 1
+//
+// The methods may be chained in any order; String always writes over,
+// exclude, rollup, by and last in that order. Scope tags are parsed as metric
+// filters, so they can be matched and walked like the filters of a metric
+// query. String writes the calls whose arguments are unchanged as they were
+// parsed, and single-quotes other arguments, as process monitors are
+// conventionally written, unless an argument contains a single quote.
+type ProcessMonitor struct {
+	Pos lexer.Position
+
+	// Search is the process search string, e.g. "nginx".
+	Search string
+	// Over lists the tags that scope the monitor, e.g. "env:prod" or "*".
+	Over []*MetricFilter
+	// Exclude lists the tags whose processes are left out.
+	Exclude []*MetricFilter
+	// GroupBy lists the tag keys alerts are grouped by.
+	GroupBy []string
+	// Rollup is nil when the query counts matching processes implicitly.
+	Rollup *LogRollup
+	// Window is the evaluation window, e.g. "10m".
+	Window string
+	Condition
+
+	written writtenCalls
+}
+
+// processMonitorGrammar is what the parser reads; the methods are collected
+// in any order and the scope strings are then parsed as filters.
+type processMonitorGrammar struct {
+	Pos lexer.Position
+
+	Search  *searchArg       `parser:"'processes' @@"`
+	Methods []*processMethod `parser:"@@*"`
+	Condition
+}
+
+// end is the position of the token after the method chain of g, which is
+// the comparator.
+func (g *processMonitorGrammar) end() lexer.Position {
+	if len(g.Methods) > 0 {
+		return g.Methods[len(g.Methods)-1].EndPos
+	}
+	return g.Search.EndPos
+}
+
+type processMethod struct {
+	Pos    lexer.Position
+	EndPos lexer.Position
+
+	Rollup *LogRollup   `parser:"  '.' @@"`
+	Window *string      `parser:"| '.' 'last' '(' @String ')'"`
+	Tags   *processTags `parser:"| '.' @@"`
+}
+
+// processTags is one of the methods that take a list of tags.
+type processTags struct {
+	Method string   `parser:"@( 'over' | 'exclude' | 'by' )"`
+	Tags   []string `parser:"'(' @String ( ',' @String )* ')'"`
+}
+
+func (m *processMethod) name() string {
+	switch {
+	case m.Rollup != nil:
+		return "rollup"
+	case m.Window != nil:
+		return "last"
+	}
+	return m.Tags.Method
+}
+
+// String returns the string representation of the process monitor.
+func (pm *ProcessMonitor) String() string {
+	var sb strings.Builder
+	writeChain(&sb, pm.written, singleQuoted, "processes", pm.Search, map[string][]string{
+		"over":    filterStrings(pm.Over),
+		"exclude": filterStrings(pm.Exclude),
+		"rollup":  pm.Rollup.args(),
+		"by":      pm.GroupBy,
+		"last":    {pm.Window},
+	})
+	fmt.Fprintf(&sb, " %s", pm.Condition)
+	return sb.String()
+}
+
+func (pm *ProcessMonitor) Position() lexer.Position { return pm.Pos }
+func (pm *ProcessMonitor) Kind() NodeKind           { return KindProcessMonitor }
+
+func (pm *ProcessMonitor) Children() []Node {
+	nodes := []Node{}
+	for _, f := range pm.Over {
+		nodes = append(nodes, f)
+	}
+	for _, f := range pm.Exclude {
+		nodes = append(nodes, f)
+	}
+	return nodes
+}
+
+// NewProcessMonitorParser returns a Parser which is capable of interpretting
+// a process monitor query.
+func NewProcessMonitorParser() *ProcessMonitorParser {
+	pmp := &ProcessMonitorParser{
+		parser: participle.MustBuild[processMonitorGrammar](
+			participle.Lexer(lex),
+			participle.Unquote("String"),
+		),
+	}
+
+	return pmp
+}
+
+var processMonitorParser = NewProcessMonitorParser()
+
+// ProcessMonitorParser is parser returned when calling NewProcessMonitorParser.
+type ProcessMonitorParser struct {
+	parser *participle.Parser[processMonitorGrammar]
+}
+
+// Parse sanitizes the query string and returns the AST. Invalid input,
+// including a repeated method, a missing last() or scope tags that are not
+// valid filters, is reported as a *ParseError.
+func (pmp *ProcessMonitorParser) Parse(query string) (*ProcessMonitor, error) {
+	// the parser doesn't handle queries that are split up across multiple lines
+	sanitized := strings.ReplaceAll(query, "\n", "")
+	g, err := pmp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+
+	pm := &ProcessMonitor{
+		Pos:       g.Pos,
+		Search:    g.Search.Value,
+		Condition: g.Condition,
+		written:   writtenCalls{},
+	}
+	pm.written.record("processes", []string{pm.Search}, sanitized, g.Search.Pos, g.Search.EndPos)
+	seen := map[string]bool{}
+	for _, m := range g.Methods {
+		if seen[m.name()] {
+			return nil, newParseError(query, participle.Errorf(m.Pos, "%s() is given more than once", m.name()))
+		}
+		seen[m.name()] = true
+		var args []string
+		switch m.name() {
+		case "rollup":
+			pm.Rollup = m.Rollup
+			args = m.Rollup.args()
+		case "last":
+			pm.Window = *m.Window
+			args = []string{pm.Window}
+		case "over":
+			pm.Over, err = scopeFilters(query, sanitized, m.Tags.Tags)
+			args = filterStrings(pm.Over)
+		case "exclude":
+			pm.Exclude, err = scopeFilters(query, sanitized, m.Tags.Tags)
+			args = filterStrings(pm.Exclude)
+		default:
+			pm.GroupBy = m.Tags.Tags
+			args = pm.GroupBy
+		}
+		if err != nil {
+			return nil, err
+		}
+		// scope tags are recorded the way their filters print, which is what
+		// String compares them with
+		pm.written.record(m.name(), args, sanitized, m.Pos, m.EndPos)
+	}
+	if !seen["last"] {
+		return nil, newParseError(query, participle.Errorf(g.end(), "process monitor needs an evaluation window, e.g. .last('5m')"))
+	}
+	if err := pm.Condition.resolve(query, sanitized); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// scopeFilters parses the tags that scope a monitor, such as "env:prod", "*"
+// or a bare tag such as "production", as metric filters.
+func scopeFilters(query, sanitized string, tags []string) ([]*MetricFilter, error) {
+	filters := []*MetricFilter{}
+	for _, tag := range tags {
+		mf, err := metricFilterParser.ParseString("", tag)
+		if err == nil {
+			// the grammar accepts some incomplete filters, such as "env:prod OR"
+			_, err = mf.Tree()
+		}
+		if err != nil {
+			pos := lexer.Position{Offset: strings.Index(sanitized, tag)}
+			return nil, newParseError(query, participle.Errorf(pos, "invalid scope tag %q", tag))
+		}
+		filters = append(filters, mf)
+	}
+	return filters, nil
+}
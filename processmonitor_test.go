@@ -0,0 +1,145 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ProcessMonitor(t *testing.T) {
+	parser := NewProcessMonitorParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+		// column is where the error is reported, if set
+		column int
+	}{
+		{
+			name:  "request example",
+			query: `processes('nginx').over('env:prod','role:lb').exclude('host:canary-*').rollup('count').last('10m') < 1`,
+		},
+		{
+			name:  "all hosts",
+			query: `processes('java -jar app.jar').over('*').rollup('count').last('5m') <= 2`,
+		},
+		{
+			name:  "grouped",
+			query: `processes('postgres').over('env:prod').rollup('count').by('host','env').last('5m') != 3`,
+		},
+		{
+			name:  "double quotes",
+			query: `processes("nginx").over("env:prod").last("10m") < 1`,
+		},
+		{
+			name:  "single quote in an argument",
+			query: `processes("it's").over('env:prod').last('10m') < 1`,
+		},
+		{
+			name:  "backslash in an argument",
+			query: `processes('C:\\app\\run.exe').last('10m') < 1`,
+		},
+		{
+			name:  "bare scope tag",
+			query: `processes('nginx').over('production').last('10m') < 1`,
+		},
+		{
+			name:  "methods in any order",
+			query: `processes('java').by('host').rollup('count').over('env:prod').last('5m') > 0`,
+			want:  `processes('java').over('env:prod').rollup('count').by('host').last('5m') > 0`,
+		},
+		{
+			name:  "window first",
+			query: `processes('java').last('5m').exclude('host:canary-*').over('*') > 0`,
+			want:  `processes('java').over('*').exclude('host:canary-*').last('5m') > 0`,
+		},
+		{
+			name:    "repeated method",
+			query:   `processes('java').over('env:prod').over('role:lb').last('5m') > 0`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid scope tag",
+			query:   `processes('java').over('(env:prod').last('5m') > 0`,
+			wantErr: true,
+		},
+		{
+			name:    "missing window",
+			query:   `processes('nginx').over('env:prod').rollup('count') < 1`,
+			wantErr: true,
+			column:  53,
+		},
+		{
+			name:    "missing window with a comparator in the search",
+			query:   `processes('a<b').over('env:prod') < 1`,
+			wantErr: true,
+			column:  35,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				var pe *ParseError
+				require.ErrorAs(t, err, &pe)
+				if tt.column != 0 {
+					assert.Equal(t, tt.column, pe.Pos.Column)
+				}
+				return
+			}
+			require.NoError(t, err)
+			want := tt.want
+			if want == "" {
+				want = tt.query
+			}
+			assert.Equal(t, want, ast.String())
+
+			reparsed, err := parser.Parse(ast.String())
+			require.NoError(t, err)
+			assert.Equal(t, ast.Search, reparsed.Search)
+		})
+	}
+}
+
+func Test_ProcessMonitorFields(t *testing.T) {
+	m, err := NewProcessMonitorParser().Parse(`processes('nginx').over('env:prod','role:lb').exclude('host:canary-*').rollup('count').last('10m') < 1`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "nginx", m.Search)
+	require.Len(t, m.Over, 2)
+	assert.Equal(t, "env", m.Over[0].Left.SimpleFilter.FilterKey)
+	assert.Equal(t, "role:lb", m.Over[1].String())
+	require.Len(t, m.Exclude, 1)
+	assert.Equal(t, "host", m.Exclude[0].Left.SimpleFilter.FilterKey)
+	assert.Equal(t, "count", m.Rollup.Method)
+	assert.Equal(t, "10m", m.Window)
+	assert.Equal(t, 1.0, m.Threshold)
+
+	keys := []string{}
+	Inspect(m, func(n Node) bool {
+		if sf, ok := n.(*SimpleFilter); ok {
+			keys = append(keys, sf.FilterKey)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"env", "role", "host"}, keys)
+
+	match, err := m.Over[0].MatchesTags([]string{"env:prod", "host:lb-1"})
+	require.NoError(t, err)
+	assert.True(t, match)
+
+	monitor, err := parseMonitorQuery(m.String())
+	require.NoError(t, err)
+	assert.IsType(t, &ProcessMonitor{}, monitor)
+
+	// changed arguments keep the quote style of the query
+	m, err = NewProcessMonitorParser().Parse(`processes("nginx").over("env:prod", "role:lb").last("10m") < 1`)
+	require.NoError(t, err)
+	m.GroupBy = []string{"host"}
+	m.Over = m.Over[:1]
+	assert.Equal(t, `processes("nginx").over("env:prod").by("host").last("10m") < 1`, m.String())
+}
@@ -0,0 +1,145 @@
+package ddqp
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// QueryReport lists what a query, expression or monitor refers to. It is
+// returned by Report.
+type QueryReport struct {
+	// Queries has an entry for every metric query, in the order written.
+	Queries []*QueryUsage
+	// Metrics and TagKeys are the sorted, distinct metric names and filter
+	// tag keys of Queries.
+	Metrics []string
+	TagKeys []string
+	// TemplateVariables are the names, without "$", of the template
+	// variables used anywhere, in order of first appearance.
+	TemplateVariables []string
+}
+
+// QueryUsage describes a single metric query.
+type QueryUsage struct {
+	Pos    lexer.Position
+	Metric string
+	// Aggregator is the space aggregator, e.g. "sum", or "" if there is none.
+	Aggregator string
+	Tags       []*TagUsage
+	GroupBy    []string
+	// Functions are the functions applied to the query, in the order they
+	// apply: chained functions such as as_count(), then the functions
+	// wrapping the query or an expression containing it, innermost first.
+	Functions []string
+}
+
+// TagUsage is a tag a filter refers to.
+type TagUsage struct {
+	Key string
+	// Value is the value matched, with any wildcards. It is "" for a bare tag,
+	// the operator and number for a comparison, e.g. ">=100", and the pattern
+	// for a regex. A key IN (...) list has a TagUsage per value.
+	Value string
+	// Negated is set when the filter excludes the tag, as in "!env:dev" or
+	// "NOT env IN (a, b)".
+	Negated bool
+	// Match is the part of the filter the tag comes from: a *TagMatch,
+	// *TagIn, *Compare or *Regex.
+	Match FilterExpr
+}
+
+// Report walks node and lists the metrics, aggregators, tags, group-by keys,
+// functions and template variables it uses. node may be any parsed query,
+// expression or monitor. Queries inside wrapper functions and monitor
+// functions are included. Search based monitors, such as log monitors, have
+// no metric queries.
+func Report(node Node) (*QueryReport, error) {
+	r := &QueryReport{Queries: []*QueryUsage{}, TemplateVariables: TemplateVariables(node)}
+	var err error
+	Traverse(node, func(c *Cursor) bool {
+		q, ok := c.Node().(*Query)
+		if !ok || err != nil {
+			return err == nil
+		}
+		var usage *QueryUsage
+		if usage, err = queryUsage(q, c.Ancestors()); err == nil {
+			r.Queries = append(r.Queries, usage)
+		}
+		return false
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, keys := []string{}, []string{}
+	for _, q := range r.Queries {
+		metrics = append(metrics, q.Metric)
+		for _, tag := range q.Tags {
+			keys = append(keys, tag.Key)
+		}
+	}
+	r.Metrics, r.TagKeys = sortedUnique(metrics), sortedUnique(keys)
+	return r, nil
+}
+
+func queryUsage(q *Query, ancestors []Node) (*QueryUsage, error) {
+	usage := &QueryUsage{
+		Pos:       q.Pos,
+		Metric:    q.MetricName,
+		Tags:      []*TagUsage{},
+		GroupBy:   append([]string{}, q.Grouping...),
+		Functions: []string{},
+	}
+	if q.Aggregator != nil {
+		usage.Aggregator = q.Aggregator.Name
+	}
+	if q.Filters != nil {
+		tree, err := q.Filters.Tree()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", q.MetricName, err)
+		}
+		usage.Tags = tagUsages(tree, false, usage.Tags)
+	}
+	for _, fn := range q.Function {
+		usage.Functions = append(usage.Functions, fn.Name)
+	}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		switch fn := ancestors[i].(type) {
+		case *AggregatorFuction:
+			usage.Functions = append(usage.Functions, fn.Name)
+		case *ExpressionAggregatorFuction:
+			usage.Functions = append(usage.Functions, fn.Name)
+		case monitorFunction:
+			usage.Functions = append(usage.Functions, fn.call().name)
+		}
+	}
+	return usage, nil
+}
+
+// tagUsages appends the tags below expr to tags.
+func tagUsages(expr FilterExpr, negated bool, tags []*TagUsage) []*TagUsage {
+	switch e := expr.(type) {
+	case *And:
+		for _, op := range e.Operands {
+			tags = tagUsages(op, negated, tags)
+		}
+	case *Or:
+		for _, op := range e.Operands {
+			tags = tagUsages(op, negated, tags)
+		}
+	case *Not:
+		tags = tagUsages(e.Operand, !negated, tags)
+	case *TagMatch:
+		tags = append(tags, &TagUsage{Key: e.Key, Value: e.Value, Negated: negated, Match: e})
+	case *TagIn:
+		for _, v := range e.Values {
+			tags = append(tags, &TagUsage{Key: e.Key, Value: v, Negated: negated, Match: e})
+		}
+	case *Compare:
+		tags = append(tags, &TagUsage{Key: e.Key, Value: e.Op + e.Value, Negated: negated, Match: e})
+	case *Regex:
+		tags = append(tags, &TagUsage{Key: e.Key, Value: e.Pattern, Negated: negated, Match: e})
+	}
+	return tags
+}
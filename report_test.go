@@ -0,0 +1,95 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Report(t *testing.T) {
+	ast, err := NewMetricMonitorParser().Parse("avg(last_5m):abs(top(sum:requests{env:$env AND !status:5* AND host IN (a, b)} by {host}.as_count(), 10, 'mean', 'desc') - avg:latency{NOT region IN (eu, us), code:>=500}.rollup(max, 60)) > 5")
+	require.NoError(t, err)
+
+	r, err := Report(ast)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"latency", "requests"}, r.Metrics)
+	assert.Equal(t, []string{"code", "env", "host", "region", "status"}, r.TagKeys)
+	assert.Equal(t, []string{"env"}, r.TemplateVariables)
+	require.Len(t, r.Queries, 2)
+
+	requests := r.Queries[0]
+	assert.Equal(t, "requests", requests.Metric)
+	assert.Equal(t, "sum", requests.Aggregator)
+	assert.Equal(t, []string{"host"}, requests.GroupBy)
+	assert.Equal(t, []string{"as_count", "top", "abs"}, requests.Functions)
+	assert.Equal(t, []*TagUsage{
+		{Key: "env", Value: "$env", Match: &TagMatch{Key: "env", Value: "$env"}},
+		{Key: "status", Value: "5*", Negated: true, Match: &TagMatch{Key: "status", Value: "5*"}},
+		{Key: "host", Value: "a", Match: &TagIn{Key: "host", Values: []string{"a", "b"}}},
+		{Key: "host", Value: "b", Match: &TagIn{Key: "host", Values: []string{"a", "b"}}},
+	}, requests.Tags)
+
+	latency := r.Queries[1]
+	assert.Equal(t, "avg", latency.Aggregator)
+	assert.Equal(t, []string{}, latency.GroupBy)
+	assert.Equal(t, []string{"rollup", "abs"}, latency.Functions)
+	tags := []string{}
+	for _, tag := range latency.Tags {
+		s := tag.Key + ":" + tag.Value
+		if tag.Negated {
+			s = "!" + s
+		}
+		tags = append(tags, s)
+	}
+	assert.Equal(t, []string{"!region:eu", "!region:us", "code:>=500"}, tags)
+}
+
+func Test_ReportKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    func() (Node, error)
+		metrics []string
+		vars    []string
+	}{
+		{
+			name: "anomaly monitor",
+			node: func() (Node, error) {
+				return NewMetricMonitorParser().Parse("avg(last_4h):anomalies(avg:cpu{*}, 'basic', 2) >= 1")
+			},
+			metrics: []string{"cpu"},
+		},
+		{
+			name: "formula monitor",
+			node: func() (Node, error) {
+				return NewFormulaMonitorParser().Parse("sum(last_5m):errors / hits > 5", map[string]string{
+					"errors": "sum:errors{service:$service}",
+					"hits":   "sum:hits{*}",
+					"logs":   "service:web",
+				})
+			},
+			metrics: []string{"errors", "hits"},
+			vars:    []string{"service"},
+		},
+		{
+			name: "log monitor",
+			node: func() (Node, error) {
+				return NewLogMonitorParser().Parse(`logs("service:web").index("*").rollup("count").last("5m") > 1`)
+			},
+			metrics: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := tt.node()
+			require.NoError(t, err)
+			r, err := Report(node)
+			require.NoError(t, err)
+			assert.Equal(t, tt.metrics, r.Metrics)
+			if tt.vars == nil {
+				tt.vars = []string{}
+			}
+			assert.Equal(t, tt.vars, r.TemplateVariables)
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package ddqp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// searchLex is the lexer for log, RUM, APM and event search strings, which
+// do not share the metric query syntax.
+var searchLex = lexer.MustSimple([]lexer.SimpleRule{
+	{Name: "String", Pattern: `"(\\.|[^"\\])*"`},
+	{Name: "Keyword", Pattern: `(AND|OR|NOT|TO)\b`},
+	{Name: "Comparator", Pattern: `[<>]=?`},
+	{Name: "Term", Pattern: `(\\.|[^\s:()\[\]{}"<>\\-])(\\.|[^\s:()\[\]{}"<>\\])*`},
+	{Name: "Punct", Pattern: `[-:()\[\]{}]`},
+	{Name: "whitespace", Pattern: `\s+`},
+})
+
+// SearchQuery is a log or event search string such as
+//
+//	service:web -status:info @http.status_code:[400 TO 499] "timed out"
+//
+// The empty search, which matches everything, has a nil Expression.
+type SearchQuery struct {
+	Pos lexer.Position
+
+	Expression *SearchOr `parser:"@@?"`
+}
+
+// SearchOr is a list of alternatives separated by OR.
+type SearchOr struct {
+	Pos lexer.Position
+
+	Left  *SearchAnd   `parser:"@@"`
+	Right []*SearchAnd `parser:"( 'OR' @@ )*"`
+}
+
+// SearchAnd is a list of terms that must all match. Terms are separated by
+// whitespace or by an explicit AND.
+type SearchAnd struct {
+	Pos lexer.Position
+
+	Left  *SearchUnary        `parser:"@@"`
+	Right []*SearchAndOperand `parser:"@@*"`
+}
+
+// SearchAndOperand is a term after the first in a SearchAnd.
+type SearchAndOperand struct {
+	Pos lexer.Position
+
+	// Explicit is set when the term is preceded by AND.
+	Explicit bool         `parser:"@'AND'?"`
+	Operand  *SearchUnary `parser:"@@"`
+}
+
+// SearchUnary is a term, possibly negated with NOT or excluded with "-".
+type SearchUnary struct {
+	Pos lexer.Position
+
+	// Negation is "NOT", "-" or empty.
+	Negation string      `parser:"@( 'NOT' | '-' )?"`
+	Term     *SearchTerm `parser:"@@"`
+}
+
+// SearchTerm is a parenthesized search, an attribute match, a quoted phrase
+// or a free-text word, which may contain the wildcards * and ?.
+type SearchTerm struct {
+	Pos lexer.Position
+
+	Group     *SearchOr        `parser:"  '(' @@ ')'"`
+	Attribute *SearchAttribute `parser:"| @@"`
+	Phrase    *string          `parser:"| @String"`
+	Word      *string          `parser:"| @Term"`
+}
+
+// SearchAttribute matches a tag or attribute, e.g. "env:prod",
+// "@duration:>1000000" or "@http.status_code:[400 TO 499]". Attributes start
+// with "@"; tags do not.
+type SearchAttribute struct {
+	Pos lexer.Position
+
+	Key string `parser:"@Term ':'"`
+	// Comparator is one of ">", ">=", "<" and "<=", or empty for an exact
+	// match.
+	Comparator string       `parser:"@Comparator?"`
+	Value      *SearchValue `parser:"@@"`
+}
+
+// SearchValue is the value an attribute is matched against. Words may
+// contain colons, as in the event search "tags:env:prod".
+type SearchValue struct {
+	Pos lexer.Position
+
+	Range  *SearchRange      `parser:"  @@"`
+	Group  *SearchValueGroup `parser:"| @@"`
+	Phrase *string           `parser:"| @String"`
+	Word   *string           `parser:"| @( '-'? Term ( ':' Term )* )"`
+}
+
+// SearchRange is a range of values, e.g. "[400 TO 499]". Square brackets
+// include the bound and curly braces exclude it; "*" leaves it open.
+type SearchRange struct {
+	Pos lexer.Position
+
+	LowerInclusive bool   `parser:"( @'[' | '{' )"`
+	Lower          string `parser:"@( '-'? Term | String ) 'TO'"`
+	Upper          string `parser:"@( '-'? Term | String )"`
+	UpperInclusive bool   `parser:"( @']' | '}' )"`
+}
+
+// SearchValueGroup matches an attribute against several values, e.g.
+// "service:(web OR api)".
+type SearchValueGroup struct {
+	Pos lexer.Position
+
+	Left  *SearchValue     `parser:"'(' @@"`
+	Right []*SearchValueOp `parser:"@@* ')'"`
+}
+
+// SearchValueOp is a value after the first in a SearchValueGroup.
+type SearchValueOp struct {
+	Pos lexer.Position
+
+	// Operator is "OR", "AND" or empty when the values are separated by
+	// whitespace only.
+	Operator string       `parser:"@( 'OR' | 'AND' )?"`
+	Value    *SearchValue `parser:"@@"`
+}
+
+func (sq *SearchQuery) String() string {
+	if sq.Expression == nil {
+		return ""
+	}
+	return sq.Expression.String()
+}
+
+func (so *SearchOr) String() string {
+	out := []string{so.Left.String()}
+	for _, r := range so.Right {
+		out = append(out, r.String())
+	}
+	return strings.Join(out, " OR ")
+}
+
+func (sa *SearchAnd) String() string {
+	out := []string{sa.Left.String()}
+	for _, r := range sa.Right {
+		out = append(out, r.String())
+	}
+	return strings.Join(out, " ")
+}
+
+func (op *SearchAndOperand) String() string {
+	if op.Explicit {
+		return "AND " + op.Operand.String()
+	}
+	return op.Operand.String()
+}
+
+func (su *SearchUnary) String() string {
+	switch su.Negation {
+	case "NOT":
+		return "NOT " + su.Term.String()
+	case "-":
+		return "-" + su.Term.String()
+	}
+	return su.Term.String()
+}
+
+func (st *SearchTerm) String() string {
+	switch {
+	case st.Group != nil:
+		return "(" + st.Group.String() + ")"
+	case st.Attribute != nil:
+		return st.Attribute.String()
+	case st.Phrase != nil:
+		return *st.Phrase
+	case st.Word != nil:
+		return *st.Word
+	}
+	return ""
+}
+
+func (sa *SearchAttribute) String() string {
+	return fmt.Sprintf("%s:%s%s", sa.Key, sa.Comparator, sa.Value.String())
+}
+
+func (sv *SearchValue) String() string {
+	switch {
+	case sv.Range != nil:
+		return sv.Range.String()
+	case sv.Group != nil:
+		return sv.Group.String()
+	case sv.Phrase != nil:
+		return *sv.Phrase
+	case sv.Word != nil:
+		return *sv.Word
+	}
+	return ""
+}
+
+func (sr *SearchRange) String() string {
+	open, closing := "{", "}"
+	if sr.LowerInclusive {
+		open = "["
+	}
+	if sr.UpperInclusive {
+		closing = "]"
+	}
+	return fmt.Sprintf("%s%s TO %s%s", open, sr.Lower, sr.Upper, closing)
+}
+
+func (sg *SearchValueGroup) String() string {
+	out := []string{sg.Left.String()}
+	for _, r := range sg.Right {
+		out = append(out, r.String())
+	}
+	return "(" + strings.Join(out, " ") + ")"
+}
+
+func (op *SearchValueOp) String() string {
+	if op.Operator != "" {
+		return op.Operator + " " + op.Value.String()
+	}
+	return op.Value.String()
+}
+
+func (sq *SearchQuery) Position() lexer.Position { return sq.Pos }
+func (sq *SearchQuery) Kind() NodeKind           { return KindSearchQuery }
+
+func (sq *SearchQuery) Children() []Node {
+	if sq.Expression != nil {
+		return []Node{sq.Expression}
+	}
+	return nil
+}
+
+func (so *SearchOr) Position() lexer.Position { return so.Pos }
+func (so *SearchOr) Kind() NodeKind           { return KindSearchOr }
+
+func (so *SearchOr) Children() []Node {
+	nodes := []Node{}
+	if so.Left != nil {
+		nodes = append(nodes, so.Left)
+	}
+	for _, r := range so.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (sa *SearchAnd) Position() lexer.Position { return sa.Pos }
+func (sa *SearchAnd) Kind() NodeKind           { return KindSearchAnd }
+
+func (sa *SearchAnd) Children() []Node {
+	nodes := []Node{}
+	if sa.Left != nil {
+		nodes = append(nodes, sa.Left)
+	}
+	for _, r := range sa.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (op *SearchAndOperand) Position() lexer.Position { return op.Pos }
+func (op *SearchAndOperand) Kind() NodeKind           { return KindSearchAndOperand }
+
+func (op *SearchAndOperand) Children() []Node {
+	if op.Operand != nil {
+		return []Node{op.Operand}
+	}
+	return nil
+}
+
+func (su *SearchUnary) Position() lexer.Position { return su.Pos }
+func (su *SearchUnary) Kind() NodeKind           { return KindSearchUnary }
+
+func (su *SearchUnary) Children() []Node {
+	if su.Term != nil {
+		return []Node{su.Term}
+	}
+	return nil
+}
+
+func (st *SearchTerm) Position() lexer.Position { return st.Pos }
+func (st *SearchTerm) Kind() NodeKind           { return KindSearchTerm }
+
+func (st *SearchTerm) Children() []Node {
+	switch {
+	case st.Group != nil:
+		return []Node{st.Group}
+	case st.Attribute != nil:
+		return []Node{st.Attribute}
+	}
+	return nil
+}
+
+func (sa *SearchAttribute) Position() lexer.Position { return sa.Pos }
+func (sa *SearchAttribute) Kind() NodeKind           { return KindSearchAttribute }
+
+func (sa *SearchAttribute) Children() []Node {
+	if sa.Value != nil {
+		return []Node{sa.Value}
+	}
+	return nil
+}
+
+func (sv *SearchValue) Position() lexer.Position { return sv.Pos }
+func (sv *SearchValue) Kind() NodeKind           { return KindSearchValue }
+
+func (sv *SearchValue) Children() []Node {
+	switch {
+	case sv.Range != nil:
+		return []Node{sv.Range}
+	case sv.Group != nil:
+		return []Node{sv.Group}
+	}
+	return nil
+}
+
+func (sr *SearchRange) Position() lexer.Position { return sr.Pos }
+func (sr *SearchRange) Kind() NodeKind           { return KindSearchRange }
+func (sr *SearchRange) Children() []Node         { return nil }
+
+func (sg *SearchValueGroup) Position() lexer.Position { return sg.Pos }
+func (sg *SearchValueGroup) Kind() NodeKind           { return KindSearchValueGroup }
+
+func (sg *SearchValueGroup) Children() []Node {
+	nodes := []Node{}
+	if sg.Left != nil {
+		nodes = append(nodes, sg.Left)
+	}
+	for _, r := range sg.Right {
+		nodes = append(nodes, r)
+	}
+	return nodes
+}
+
+func (op *SearchValueOp) Position() lexer.Position { return op.Pos }
+func (op *SearchValueOp) Kind() NodeKind           { return KindSearchValueOp }
+
+func (op *SearchValueOp) Children() []Node {
+	if op.Value != nil {
+		return []Node{op.Value}
+	}
+	return nil
+}
+
+// NewSearchQueryParser returns a Parser which is capable of interpretting
+// a log or event search string.
+func NewSearchQueryParser() *SearchQueryParser {
+	sqp := &SearchQueryParser{
+		parser: participle.MustBuild[SearchQuery](
+			participle.Lexer(searchLex),
+			participle.UseLookahead(2),
+		),
+	}
+
+	return sqp
+}
+
+var searchQueryParser = NewSearchQueryParser()
+
+// SearchQueryParser is parser returned when calling NewSearchQueryParser.
+type SearchQueryParser struct {
+	parser *participle.Parser[SearchQuery]
+}
+
+// Parse returns the AST of a search string. Unlike the metric parsers it
+// keeps newlines, which separate terms like any other whitespace. Invalid
+// input is reported as a *ParseError.
+func (sqp *SearchQueryParser) Parse(query string) (*SearchQuery, error) {
+	ast, err := sqp.parser.ParseString("", query)
+	if err != nil {
+		return nil, newParseErrorAt(query, err, inputPosition)
+	}
+	return ast, nil
+}
@@ -0,0 +1,118 @@
+package ddqp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SearchQuery(t *testing.T) {
+	parser := NewSearchQueryParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{name: "empty search", query: ""},
+		{name: "match all", query: "*"},
+		{name: "free text", query: "timeout error"},
+		{name: "quoted phrase", query: `"connection refused"`},
+		{name: "tag", query: "service:web"},
+		{name: "attribute", query: "@http.method:POST"},
+		{name: "exclusion", query: "service:web -status:info"},
+		{name: "not", query: "service:web NOT status:info"},
+		{name: "range", query: "@http.status_code:[400 TO 499]"},
+		{name: "exclusive open range", query: "@duration:{1000 TO *}"},
+		{name: "comparison", query: "@duration:>1000000"},
+		{name: "negative comparison", query: "@temperature:<=-5"},
+		{name: "wildcards", query: "host:web-* @http.url:/api/v?/users"},
+		{name: "quoted attribute value", query: `@error.message:"disk full"`},
+		{name: "boolean operators", query: "(env:prod OR env:staging) AND service:web"},
+		{name: "value group", query: "service:(web OR api OR worker)"},
+		{name: "colon in value", query: "sources:kubernetes tags:env:prod"},
+		{name: "escaped colon", query: `@url:https\://example.com`},
+		{name: "request example", query: `service:web -status:info @http.status_code:[400 TO 499] @duration:>1000000 "timed out" (env:prod OR env:staging)`},
+		{name: "unbalanced parenthesis", query: "(env:prod OR env:staging", wantErr: true},
+		{name: "dangling OR", query: "env:prod OR", wantErr: true},
+		{name: "range without TO", query: "@status:[400 499]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, ast.String())
+		})
+	}
+}
+
+func Test_SearchQueryAST(t *testing.T) {
+	q, err := NewSearchQueryParser().Parse(`service:web -status:info @http.status_code:[400 TO 499] "timed out"`)
+	require.NoError(t, err)
+	require.NotNil(t, q.Expression)
+	assert.Empty(t, q.Expression.Right)
+
+	and := q.Expression.Left
+	require.Len(t, and.Right, 3)
+
+	assert.Equal(t, "service", and.Left.Term.Attribute.Key)
+	assert.Equal(t, "web", *and.Left.Term.Attribute.Value.Word)
+
+	excluded := and.Right[0].Operand
+	assert.Equal(t, "-", excluded.Negation)
+	assert.Equal(t, "status", excluded.Term.Attribute.Key)
+
+	status := and.Right[1].Operand.Term.Attribute
+	require.NotNil(t, status.Value.Range)
+	assert.Equal(t, &SearchRange{
+		Pos:            status.Value.Range.Pos,
+		LowerInclusive: true,
+		Lower:          "400",
+		Upper:          "499",
+		UpperInclusive: true,
+	}, status.Value.Range)
+
+	assert.Equal(t, `"timed out"`, *and.Right[2].Operand.Term.Phrase)
+}
+
+func Test_SearchQueryInspect(t *testing.T) {
+	q, err := NewSearchQueryParser().Parse("(service:web OR service:api) -env:dev @duration:>100 error")
+	require.NoError(t, err)
+
+	keys := []string{}
+	Inspect(q, func(n Node) bool {
+		if attr, ok := n.(*SearchAttribute); ok {
+			keys = append(keys, attr.Key)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"service", "service", "env", "@duration"}, keys)
+
+	// rewrite every env tag and print the result
+	Inspect(q, func(n Node) bool {
+		if attr, ok := n.(*SearchAttribute); ok && attr.Key == "env" {
+			prod := "prod"
+			attr.Value = &SearchValue{Word: &prod}
+		}
+		return true
+	})
+	assert.Equal(t, "(service:web OR service:api) -env:prod @duration:>100 error", q.String())
+}
+
+func Test_SearchQueryParseError(t *testing.T) {
+	query := "service:web\nstatus:(error"
+	_, err := NewSearchQueryParser().Parse(query)
+	require.Error(t, err)
+
+	var pe *ParseError
+	require.True(t, errors.As(err, &pe))
+	assert.Equal(t, 2, pe.Pos.Line)
+	assert.Equal(t, 14, pe.Pos.Column)
+	assert.Equal(t, len(query), pe.Pos.Offset)
+}
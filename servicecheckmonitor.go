@@ -0,0 +1,135 @@
+package ddqp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// ServiceCheckMonitor is a service check monitor query such as
+//
+//	"http.can_connect".over("env:prod","role:web").exclude("host:web-1").by("host","port").last(4).count_by_status()
+//
+// String arguments are stored without their quotes. Scope tags are parsed as
+// metric filters, the same way as those of a ProcessMonitor.
+type ServiceCheckMonitor struct {
+	Pos lexer.Position
+
+	// Check is the service check name, e.g. "http.can_connect".
+	Check string
+	// Over lists the tags that scope the check, e.g. "env:prod", "*" or a bare
+	// tag such as "production".
+	Over []*MetricFilter
+	// Exclude lists the tags whose sources are left out.
+	Exclude []*MetricFilter
+	// GroupBy lists the tag keys alerts are grouped by.
+	GroupBy []string
+	// Last is the number of consecutive check runs that are evaluated.
+	Last int
+	// CountMethod is the status counting function, e.g. "count_by_status".
+	CountMethod string
+}
+
+// serviceCheckMonitorGrammar is what the parser reads; the scope strings are
+// then parsed as filters.
+type serviceCheckMonitorGrammar struct {
+	Pos lexer.Position
+
+	Check       string   `parser:"@String"`
+	Over        []string `parser:"( '.' 'over' '(' @String ( ',' @String )* ')' )?"`
+	Exclude     []string `parser:"( '.' 'exclude' '(' @String ( ',' @String )* ')' )?"`
+	GroupBy     []string `parser:"( '.' 'by' '(' @String ( ',' @String )* ')' )?"`
+	Last        int      `parser:"'.' 'last' '(' @Ident ')'"`
+	CountMethod string   `parser:"'.' @Ident '(' ')'"`
+}
+
+// String returns the string representation of the service check monitor.
+func (sc *ServiceCheckMonitor) String() string {
+	// service checks are conventionally written without spaces
+	var sb strings.Builder
+	sb.WriteString(strconv.Quote(sc.Check))
+	if len(sc.Over) > 0 {
+		fmt.Fprintf(&sb, ".over(%s)", quoteAll(filterStrings(sc.Over), ","))
+	}
+	if len(sc.Exclude) > 0 {
+		fmt.Fprintf(&sb, ".exclude(%s)", quoteAll(filterStrings(sc.Exclude), ","))
+	}
+	if len(sc.GroupBy) > 0 {
+		fmt.Fprintf(&sb, ".by(%s)", quoteAll(sc.GroupBy, ","))
+	}
+	fmt.Fprintf(&sb, ".last(%d).%s()", sc.Last, sc.CountMethod)
+	return sb.String()
+}
+
+func filterStrings(filters []*MetricFilter) []string {
+	out := []string{}
+	for _, f := range filters {
+		out = append(out, f.String())
+	}
+	return out
+}
+
+func (sc *ServiceCheckMonitor) Position() lexer.Position { return sc.Pos }
+func (sc *ServiceCheckMonitor) Kind() NodeKind           { return KindServiceCheckMonitor }
+
+func (sc *ServiceCheckMonitor) Children() []Node {
+	nodes := []Node{}
+	for _, f := range sc.Over {
+		nodes = append(nodes, f)
+	}
+	for _, f := range sc.Exclude {
+		nodes = append(nodes, f)
+	}
+	return nodes
+}
+
+// NewServiceCheckMonitorParser returns a Parser which is capable of
+// interpretting a service check monitor query.
+func NewServiceCheckMonitorParser() *ServiceCheckMonitorParser {
+	scp := &ServiceCheckMonitorParser{
+		parser: participle.MustBuild[serviceCheckMonitorGrammar](
+			participle.Lexer(lex),
+			participle.Unquote("String"),
+		),
+	}
+
+	return scp
+}
+
+var serviceCheckMonitorParser = NewServiceCheckMonitorParser()
+
+// ServiceCheckMonitorParser is parser returned when calling
+// NewServiceCheckMonitorParser.
+type ServiceCheckMonitorParser struct {
+	parser *participle.Parser[serviceCheckMonitorGrammar]
+}
+
+// Parse sanitizes the query string and returns the AST. Invalid input,
+// including scope tags that are not valid filters, is reported as a
+// *ParseError.
+func (scp *ServiceCheckMonitorParser) Parse(query string) (*ServiceCheckMonitor, error) {
+	// the parser doesn't handle queries that are split up across multiple lines
+	sanitized := strings.ReplaceAll(query, "\n", "")
+	g, err := scp.parser.ParseString("", sanitized)
+	if err != nil {
+		return nil, newParseError(query, err)
+	}
+
+	sc := &ServiceCheckMonitor{
+		Pos:         g.Pos,
+		Check:       g.Check,
+		GroupBy:     g.GroupBy,
+		Last:        g.Last,
+		CountMethod: g.CountMethod,
+	}
+	if sc.Over, err = scopeFilters(query, sanitized, g.Over); err != nil {
+		return nil, err
+	}
+	if sc.Exclude, err = scopeFilters(query, sanitized, g.Exclude); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
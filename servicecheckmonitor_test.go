@@ -0,0 +1,91 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ServiceCheckMonitor(t *testing.T) {
+	parser := NewServiceCheckMonitorParser()
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{
+			name:  "scoped and grouped",
+			query: `"http.can_connect".over("env:prod","role:web").by("host","port").last(4).count_by_status()`,
+		},
+		{
+			name:  "all sources",
+			query: `"datadog.agent.up".over("*").last(2).count_by_status()`,
+		},
+		{
+			name:  "excluded tags",
+			query: `"datadog.agent.up".over("*").exclude("host:web-1","env:dev").by("host").last(2).count_by_status()`,
+		},
+		{
+			name:  "bare tag",
+			query: `"ntp.in_sync".over("production").last(3).count_by_status()`,
+		},
+		{
+			name:    "invalid scope tag",
+			query:   `"http.can_connect".over("env:prod OR").last(4).count_by_status()`,
+			wantErr: true,
+		},
+		{
+			name:    "missing last",
+			query:   `"http.can_connect".over("*").count_by_status()`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.IsType(t, &ParseError{}, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, ast.String())
+		})
+	}
+}
+
+func Test_ServiceCheckMonitorFields(t *testing.T) {
+	m, err := NewServiceCheckMonitorParser().Parse(`"http.can_connect".over("env:prod","role:web").exclude("host:web-*").by("host","port").last(4).count_by_status()`)
+	require.NoError(t, err)
+
+	assert.Equal(t, "http.can_connect", m.Check)
+	require.Len(t, m.Over, 2)
+	assert.Equal(t, "env:prod", m.Over[0].String())
+	assert.Equal(t, "role:web", m.Over[1].String())
+	require.Len(t, m.Exclude, 1)
+	assert.Equal(t, "host:web-*", m.Exclude[0].String())
+	assert.Equal(t, []string{"host", "port"}, m.GroupBy)
+	assert.Equal(t, 4, m.Last)
+	assert.Equal(t, "count_by_status", m.CountMethod)
+
+	keys := []string{}
+	Inspect(m, func(n Node) bool {
+		if sf, ok := n.(*SimpleFilter); ok {
+			keys = append(keys, sf.FilterKey)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"env", "role", "host"}, keys)
+
+	exclude, err := m.Exclude[0].Tree()
+	require.NoError(t, err)
+	assert.Equal(t, &TagMatch{Key: "host", Value: "web-*"}, exclude)
+
+	bare, err := NewServiceCheckMonitorParser().Parse(`"ntp.in_sync".over("production").last(3).count_by_status()`)
+	require.NoError(t, err)
+	match, err := bare.Over[0].MatchesTags([]string{"production", "host:a"})
+	require.NoError(t, err)
+	assert.True(t, match)
+}
@@ -0,0 +1,390 @@
+package ddqp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SimplifyOptions controls the rewrites Simplify makes on top of the ones it
+// always makes.
+type SimplifyOptions struct {
+	// DivisionToMultiplication rewrites division by a constant as
+	// multiplication by its reciprocal when the reciprocal is a short
+	// decimal, so "x / 1000" becomes "x * 0.001".
+	DivisionToMultiplication bool
+}
+
+// Simplify returns a simplified copy of me using the default options. See
+// SimplifyOptions.Simplify.
+func Simplify(me *MetricExpression) (*MetricExpression, error) {
+	return SimplifyOptions{}.Simplify(me)
+}
+
+// Simplify returns a copy of me that computes the same values with less
+// text. It folds constant sub-expressions, so "x / (1000 * 1000)" becomes
+// "x / 1000000" and "x * 100 / 100" becomes "x"; drops "* 1", "/ 1", "+ 0"
+// and "- 0"; removes unary "+" and double negation; and removes parentheses
+// that operator precedence makes redundant. Constants in a product or sum
+// are gathered where the first of them was written, or at the end. Products
+// with zero are left alone, since the other operand may have no value. me
+// itself is not modified.
+func (o SimplifyOptions) Simplify(me *MetricExpression) (*MetricExpression, error) {
+	// work on a copy so that me is left as written
+	simplified, err := metricExpressionParser.Parse(me.String())
+	if err != nil {
+		return nil, err
+	}
+	o.group(simplified.GroupedExpression)
+	return simplified, nil
+}
+
+// sumTerm is a term of a sum with its sign.
+type sumTerm struct {
+	sub  bool
+	term *Term
+}
+
+// productFactor is a factor of a product with its operator.
+type productFactor struct {
+	div    bool
+	factor *Factor
+}
+
+func (o SimplifyOptions) group(ge *GroupedExpression) {
+	if ge == nil || ge.Left == nil {
+		return
+	}
+	terms := []sumTerm{}
+	add := func(sub bool, t *Term) {
+		o.term(t)
+		// "a - (-b)" is "a + b"
+		if operand := negation(t); operand != nil && len(terms) > 0 {
+			sub, t = !sub, &Term{Left: &Factor{Base: operand}}
+		}
+		// "a + (b - c)" is "a + b - c", and "(a * b)" on its own is "a * b"
+		if inner := soleGroup(t); inner != nil && !sub && (len(terms) == 0 || !signed(inner.Left)) {
+			terms = append(terms, sumTerm{term: inner.Left})
+			for _, r := range inner.Right {
+				terms = append(terms, sumTerm{sub: r.Operator == OpSub, term: r.Term})
+			}
+			return
+		}
+		terms = append(terms, sumTerm{sub: sub, term: t})
+	}
+	add(false, ge.Left)
+	for _, r := range ge.Right {
+		add(r.Operator == OpSub, r.Term)
+	}
+
+	terms = foldSum(terms)
+	ge.Left, ge.Right = terms[0].term, nil
+	for _, t := range terms[1:] {
+		op := OpAdd
+		if t.sub {
+			op = OpSub
+		}
+		ge.Right = append(ge.Right, &OpTerm{Operator: op, Term: t.term})
+	}
+}
+
+// foldSum adds up the constant terms of a sum.
+func foldSum(terms []sumTerm) []sumTerm {
+	sum, count := 0.0, 0
+	rest := []sumTerm{}
+	for _, t := range terms {
+		c, ok := termConstant(t.term)
+		if !ok {
+			rest = append(rest, t)
+			continue
+		}
+		if t.sub {
+			c = -c
+		}
+		sum += c
+		count++
+	}
+	if count == 0 || (count == 1 && sum != 0) {
+		return terms
+	}
+	if len(rest) == 0 {
+		return numberTerms(terms, sum)
+	}
+
+	_, leading := termConstant(terms[0].term)
+	switch {
+	case leading && (sum > 0 || rest[0].sub):
+		// "0 - x" keeps its zero, as there is no other way to write it, and
+		// "-1 + x" is written "x - 1"
+		lead, ok := numberTerm(sum)
+		if !ok {
+			return terms
+		}
+		return append([]sumTerm{{term: lead}}, rest...)
+	case sum != 0:
+		lead, ok := numberTerm(math.Abs(sum))
+		if !ok {
+			return terms
+		}
+		return append(rest, sumTerm{sub: sum < 0, term: lead})
+	}
+	return rest
+}
+
+func numberTerms(terms []sumTerm, v float64) []sumTerm {
+	t, ok := numberTerm(v)
+	if !ok {
+		return terms
+	}
+	return []sumTerm{{term: t}}
+}
+
+func (o SimplifyOptions) term(t *Term) {
+	factors := []productFactor{}
+	add := func(div bool, f *Factor) {
+		o.value(f.Base)
+		// "a * (b / c)" is "a * b / c"
+		if inner := factorGroup(f); inner != nil && len(inner.Right) == 0 && !div && !signed(inner.Left) {
+			factors = append(factors, productFactor{factor: inner.Left.Left})
+			for _, r := range inner.Left.Right {
+				factors = append(factors, productFactor{div: r.Operator == OpDiv, factor: r.Factor})
+			}
+			return
+		}
+		factors = append(factors, productFactor{div: div, factor: f})
+	}
+	add(false, t.Left)
+	for _, r := range t.Right {
+		add(r.Operator == OpDiv, r.Factor)
+	}
+
+	factors = o.foldProduct(factors)
+	t.Left, t.Right = factors[0].factor, nil
+	for _, f := range factors[1:] {
+		op := OpMul
+		if f.div {
+			op = OpDiv
+		}
+		t.Right = append(t.Right, &OpFactor{Operator: op, Factor: f.factor})
+	}
+}
+
+// foldProduct multiplies out the constant factors of a product, keeping what
+// is multiplied and what is divided apart unless one divides the other.
+func (o SimplifyOptions) foldProduct(factors []productFactor) []productFactor {
+	num, den, count := 1.0, 1.0, 0
+	var only productFactor
+	rest := []productFactor{}
+	for _, f := range factors {
+		c, ok := constant(f.factor.Base)
+		if !ok {
+			rest = append(rest, f)
+			continue
+		}
+		if f.div {
+			den *= c
+		} else {
+			num *= c
+		}
+		count++
+		only = f
+	}
+	if count == 0 || den == 0 {
+		return factors
+	}
+	switch {
+	case o.DivisionToMultiplication && den != 1 && shortDecimal(num/den):
+		num, den = num/den, 1
+	case isInteger(num / den):
+		num, den = num/den, 1
+	case num != 0 && isInteger(den/num):
+		num, den = 1, den/num
+	}
+	if c, _ := constant(only.factor.Base); count == 1 && c != 1 && ((!only.div && num == c && den == 1) || (only.div && num == 1 && den == c)) {
+		// a single constant has nothing to fold with
+		return factors
+	}
+
+	coefficient := []productFactor{}
+	lead := len(rest) == 0 || rest[0].div
+	if _, ok := constant(factors[0].factor.Base); ok && num != 1 {
+		lead = true
+	}
+	if lead {
+		f, ok := numberFactor(num)
+		if !ok {
+			return factors
+		}
+		coefficient = append(coefficient, productFactor{factor: f})
+	} else if num != 1 {
+		f, ok := numberFactor(num)
+		if !ok {
+			return factors
+		}
+		rest = append(rest, productFactor{factor: f})
+	}
+	if den != 1 {
+		f, ok := numberFactor(den)
+		if !ok {
+			return factors
+		}
+		rest = append(rest, productFactor{div: true, factor: f})
+	}
+	return append(coefficient, rest...)
+}
+
+func (o SimplifyOptions) value(ev *ExprValue) {
+	if ev == nil {
+		return
+	}
+	switch {
+	case ev.Subexpression != nil:
+		o.group(ev.Subexpression.GroupedExpression)
+		if inner := soleValue(ev.Subexpression.GroupedExpression); inner != nil && !signedValue(inner) {
+			*ev = *inner
+		}
+	case ev.Unary != nil:
+		operand := ev.Unary.Operand
+		o.value(operand)
+		if ev.Unary.Operator == OpAdd {
+			*ev = *operand
+			return
+		}
+		if c, ok := constant(operand); ok {
+			if n, ok := numberFactor(-c); ok {
+				*ev = *n.Base
+			}
+			return
+		}
+		// "-(-x)" is "x"
+		if inner := soleValue(subexpression(operand)); inner != nil {
+			operand = inner
+		}
+		if operand.Unary != nil && operand.Unary.Operator == OpSub {
+			*ev = *operand.Unary.Operand
+		}
+	case ev.ExprAggregatorFuction != nil:
+		o.group(ev.ExprAggregatorFuction.Body)
+	case ev.monitorFunction() != nil:
+		o.group(ev.monitorFunction().call().body)
+	}
+}
+
+// constant returns the value of a number, which may be in parentheses.
+func constant(ev *ExprValue) (float64, bool) {
+	if ev == nil {
+		return 0, false
+	}
+	if ev.Subexpression != nil {
+		return constant(soleValue(ev.Subexpression.GroupedExpression))
+	}
+	if ev.Number != nil {
+		return *ev.Number, true
+	}
+	return 0, false
+}
+
+func termConstant(t *Term) (float64, bool) {
+	if len(t.Right) != 0 {
+		return 0, false
+	}
+	return constant(t.Left.Base)
+}
+
+func subexpression(ev *ExprValue) *GroupedExpression {
+	if ev.Subexpression == nil {
+		return nil
+	}
+	return ev.Subexpression.GroupedExpression
+}
+
+// soleValue returns the only value of ge, if it has just one.
+func soleValue(ge *GroupedExpression) *ExprValue {
+	if ge == nil || len(ge.Right) != 0 || ge.Left == nil || len(ge.Left.Right) != 0 {
+		return nil
+	}
+	return ge.Left.Left.Base
+}
+
+// factorGroup returns the expression in f's parentheses, if f is one.
+func factorGroup(f *Factor) *GroupedExpression {
+	return subexpression(f.Base)
+}
+
+// negation returns x if t is "-x" or "(-x)".
+func negation(t *Term) *ExprValue {
+	if len(t.Right) != 0 {
+		return nil
+	}
+	ev := t.Left.Base
+	if inner := soleValue(subexpression(ev)); inner != nil {
+		ev = inner
+	}
+	if ev.Unary == nil || ev.Unary.Operator != OpSub {
+		return nil
+	}
+	return ev.Unary.Operand
+}
+
+// soleGroup returns the expression in t's parentheses, if t is nothing else.
+func soleGroup(t *Term) *GroupedExpression {
+	if len(t.Right) != 0 {
+		return nil
+	}
+	return factorGroup(t.Left)
+}
+
+// signed reports whether t starts with a sign, which keeps the parentheses
+// in "a + (-b)" and "a * (-b * c)".
+func signed(t *Term) bool {
+	return signedValue(t.Left.Base)
+}
+
+func signedValue(ev *ExprValue) bool {
+	if ev.Unary != nil {
+		return true
+	}
+	if ev.Number != nil {
+		return math.Signbit(*ev.Number)
+	}
+	return ev.Literal != nil && strings.HasPrefix(string(*ev.Literal), "-")
+}
+
+// numberFactor returns a factor holding v, unless v cannot be written
+// without losing precision.
+func numberFactor(v float64) (*Factor, bool) {
+	text := formatFloatNoExp(v)
+	if parsed, err := strconv.ParseFloat(text, 64); err != nil || parsed != v || math.IsInf(v, 0) {
+		return nil, false
+	}
+	if v == 0 {
+		// no "-0"
+		v = 0
+	}
+	return &Factor{Base: &ExprValue{Number: &v}}, true
+}
+
+func numberTerm(v float64) (*Term, bool) {
+	f, ok := numberFactor(v)
+	if !ok {
+		return nil, false
+	}
+	return &Term{Left: f}, true
+}
+
+// maxIntegerFold keeps folded integers within the range float64 holds
+// exactly.
+const maxIntegerFold = 1 << 53
+
+func isInteger(v float64) bool {
+	return v == math.Trunc(v) && math.Abs(v) <= maxIntegerFold
+}
+
+// maxShortDecimalDigits is the most significant digits a reciprocal may have
+// for DivisionToMultiplication to use it.
+const maxShortDecimalDigits = 6
+
+func shortDecimal(v float64) bool {
+	digits := strings.Trim(strings.NewReplacer("-", "", ".", "").Replace(strconv.FormatFloat(v, 'f', -1, 64)), "0")
+	return len(digits) <= maxShortDecimalDigits
+}
@@ -0,0 +1,124 @@
+package ddqp
+
+import (
+	"hash/fnv"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Simplify(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+		// wantDivision is the result with DivisionToMultiplication, when it
+		// differs from want.
+		wantDivision string
+	}{
+		{name: "constant divisor", query: "sum:a{*} / (1000 * 1000 * 10)", want: "sum:a{*} / 10000000", wantDivision: "sum:a{*} * 0.0000001"},
+		{name: "cancelling constants", query: "sum:a{*} * 100 / 100", want: "sum:a{*}"},
+		{name: "constants across queries", query: "sum:a{*} * 2 * sum:b{*} * 3", want: "sum:a{*} * sum:b{*} * 6"},
+		{name: "leading constant", query: "2 / sum:a{*} * 5", want: "10 / sum:a{*}"},
+		{name: "divisor left over", query: "sum:a{*} * 1000 / 100 / 100", want: "sum:a{*} / 10", wantDivision: "sum:a{*} * 0.1"},
+		{name: "times one", query: "sum:a{*} * 1 / 1", want: "sum:a{*}"},
+		{name: "plus zero", query: "0 + sum:a{*} - 0", want: "sum:a{*}"},
+		{name: "zero minuend", query: "0 - sum:a{*}", want: "0 - sum:a{*}"},
+		{name: "constant terms", query: "1 + 2 + sum:a{*} - 4", want: "sum:a{*} - 1"},
+		{name: "constant expression", query: "(1 + 2) * 3", want: "9"},
+		{name: "inexact quotient", query: "sum:a{*} / 3", want: "sum:a{*} / 3"},
+		{name: "single constant keeps its literal", query: "1e6 * sum:a{*}", want: "1e6 * sum:a{*}"},
+		{name: "times zero", query: "sum:a{*} * 0", want: "sum:a{*} * 0"},
+		{name: "redundant sum parentheses", query: "(sum:a{*} + sum:b{*}) + (sum:c{*})", want: "sum:a{*} + sum:b{*} + sum:c{*}"},
+		{name: "needed sum parentheses", query: "sum:a{*} - (sum:b{*} + sum:c{*})", want: "sum:a{*} - (sum:b{*} + sum:c{*})"},
+		{name: "redundant product parentheses", query: "sum:a{*} - (sum:b{*} * sum:c{*})", want: "sum:a{*} - sum:b{*} * sum:c{*}"},
+		{name: "needed product parentheses", query: "sum:a{*} / (sum:b{*} / 2)", want: "sum:a{*} / (sum:b{*} / 2)", wantDivision: "sum:a{*} / (sum:b{*} * 0.5)"},
+		{name: "nested parentheses", query: "((sum:a{*}))", want: "sum:a{*}"},
+		{name: "double negation", query: "-(-sum:a{*})", want: "sum:a{*}"},
+		{name: "unary plus", query: "+sum:a{*}", want: "sum:a{*}"},
+		{name: "negated constant", query: "sum:a{*} * -(2)", want: "sum:a{*} * -2"},
+		{name: "added negation", query: "sum:a{*} + (-sum:b{*})", want: "sum:a{*} - sum:b{*}"},
+		{name: "subtracted negation", query: "sum:a{*} - -sum:b{*}", want: "sum:a{*} + sum:b{*}"},
+		{name: "function bodies", query: "abs((sum:a{*} * 1)) / (2 * 3)", want: "abs(sum:a{*}) / 6"},
+		{name: "monitor function bodies", query: "anomalies(sum:a{*} * 1, 'basic', 2)", want: "anomalies(sum:a{*}, 'basic', 2)"},
+	}
+	parser := NewMetricExpressionParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+
+			got, err := Simplify(me)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+			assert.Equal(t, tt.query, me.String())
+
+			if tt.wantDivision == "" {
+				tt.wantDivision = tt.want
+			}
+			division, err := SimplifyOptions{DivisionToMultiplication: true}.Simplify(me)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantDivision, division.String())
+
+			for _, simplified := range []*MetricExpression{got, division} {
+				// the result is a valid query that computes the same values
+				reparsed, err := parser.Parse(simplified.String())
+				require.NoError(t, err)
+				assert.Equal(t, simplified.String(), reparsed.String())
+				assert.InDelta(t, evaluate(me.GroupedExpression), evaluate(reparsed.GroupedExpression), 1e-9)
+			}
+		})
+	}
+}
+
+// evaluate computes ge with every query replaced by a value derived from its
+// text. Functions are ignored, as Simplify does not change them.
+func evaluate(ge *GroupedExpression) float64 {
+	sum := evaluateTerm(ge.Left)
+	for _, r := range ge.Right {
+		if r.Operator == OpSub {
+			sum -= evaluateTerm(r.Term)
+		} else {
+			sum += evaluateTerm(r.Term)
+		}
+	}
+	return sum
+}
+
+func evaluateTerm(t *Term) float64 {
+	product := evaluateValue(t.Left.Base)
+	for _, r := range t.Right {
+		if r.Operator == OpDiv {
+			product /= evaluateValue(r.Factor.Base)
+		} else {
+			product *= evaluateValue(r.Factor.Base)
+		}
+	}
+	return product
+}
+
+func evaluateValue(ev *ExprValue) float64 {
+	switch {
+	case ev.Number != nil:
+		return *ev.Number
+	case ev.Subexpression != nil:
+		return evaluate(ev.Subexpression.GroupedExpression)
+	case ev.Unary != nil:
+		v := evaluateValue(ev.Unary.Operand)
+		if ev.Unary.Operator == OpSub {
+			return -v
+		}
+		return v
+	case ev.ExprAggregatorFuction != nil:
+		return evaluate(ev.ExprAggregatorFuction.Body)
+	case ev.monitorFunction() != nil:
+		return evaluate(ev.monitorFunction().call().body)
+	case ev.MetricQuery != nil:
+		h := fnv.New32a()
+		h.Write([]byte(ev.MetricQuery.String()))
+		return float64(h.Sum32()%97) + 0.5
+	}
+	return math.NaN()
+}
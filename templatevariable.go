@@ -0,0 +1,432 @@
+package ddqp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// TemplateVariable is a dashboard template variable such as "$env" or
+// "$host.value". It can appear as a whole filter ("{$env}"), as a filter value
+// ("{env:$env.value}"), as a function argument, or as a group-by key.
+type TemplateVariable struct {
+	Pos lexer.Position
+
+	// Name is the variable name without the leading "$".
+	Name string
+	// Accessor is the optional suffix after the dot, e.g. "value".
+	Accessor string
+}
+
+var templateVariableToken = lex.Symbols()["TemplateVariable"]
+
+// Parse implements participle.Parseable so that "$name.accessor" is read from
+// a single token.
+func (tv *TemplateVariable) Parse(pl *lexer.PeekingLexer) error {
+	tok := pl.Peek()
+	if tok.Type != templateVariableToken {
+		return participle.NextMatch
+	}
+	pl.Next()
+	*tv = *newTemplateVariable(tok.Value)
+	tv.Pos = tok.Pos
+	return nil
+}
+
+func newTemplateVariable(raw string) *TemplateVariable {
+	name, accessor, _ := strings.Cut(strings.TrimPrefix(raw, "$"), ".")
+	return &TemplateVariable{Name: name, Accessor: accessor}
+}
+
+func isTemplateVariable(s string) bool {
+	return strings.HasPrefix(s, "$") && tokenType(s) == "TemplateVariable"
+}
+
+func (tv *TemplateVariable) String() string {
+	if tv.Accessor != "" {
+		return fmt.Sprintf("$%s.%s", tv.Name, tv.Accessor)
+	}
+	return "$" + tv.Name
+}
+
+func (tv *TemplateVariable) Position() lexer.Position { return tv.Pos }
+func (tv *TemplateVariable) Kind() NodeKind           { return KindTemplateVariable }
+func (tv *TemplateVariable) Children() []Node         { return nil }
+
+// TemplateVariables returns the names (without "$") of the template variables
+// referenced anywhere under node, in order of first appearance.
+func TemplateVariables(node Node) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	Inspect(node, func(n Node) bool {
+		switch v := n.(type) {
+		case *TemplateVariable:
+			add(v.Name)
+		case *Query:
+			for _, g := range v.Grouping {
+				if isTemplateVariable(g) {
+					add(newTemplateVariable(g).Name)
+				}
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// Substitute returns a copy of the query with every template variable replaced
+// by its selected values. vars is keyed by variable name without "$".
+//
+// A variable used as a whole filter ("{$env}") expands to "name:value"; values
+// that already contain a colon are used as complete tags. Selecting several
+// values expands to an OR group ("{(env:a OR env:b)}") or, in value position, to
+// an IN list ("{env IN (a, b)}"). Selecting "*" matches any value: a
+// whole-filter variable joined to other filters by AND or a comma is removed,
+// together with a negation in front of it, while one joined by OR turns the
+// enclosing filter or group into "*". In value position "*" is used as the
+// value.
+func (mq *MetricQuery) Substitute(vars map[string][]string) (*MetricQuery, error) {
+	return substitute(mq, vars, metricQueryParser.Parse)
+}
+
+// Substitute returns a copy of the expression with every template variable
+// replaced. See MetricQuery.Substitute for the expansion rules.
+func (me *MetricExpression) Substitute(vars map[string][]string) (*MetricExpression, error) {
+	return substitute(me, vars, metricExpressionParser.Parse)
+}
+
+// Substitute returns a copy of the query with every template variable
+// replaced. See MetricQuery.Substitute for the expansion rules.
+func (gq *GenericQuery) Substitute(vars map[string][]string) (*GenericQuery, error) {
+	return substitute(gq, vars, genericParser.Parse)
+}
+
+func substitute[T Node](node T, vars map[string][]string, parse func(string) (T, error)) (T, error) {
+	var zero T
+	clone, err := parse(node.String())
+	if err != nil {
+		return zero, err
+	}
+	s := &substituter{vars: vars}
+	Inspect(clone, s.visit)
+	if s.err != nil {
+		return zero, s.err
+	}
+	out, err := parse(clone.String())
+	if err != nil {
+		return zero, fmt.Errorf("substituted query %q does not parse: %w", clone.String(), err)
+	}
+	return out, nil
+}
+
+type substituter struct {
+	vars map[string][]string
+	err  error
+}
+
+func (s *substituter) values(tv *TemplateVariable) ([]string, error) {
+	values, ok := s.vars[tv.Name]
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("no value for template variable %s", tv)
+	}
+	for _, v := range values {
+		if v == "*" {
+			return []string{"*"}, nil
+		}
+	}
+	return values, nil
+}
+
+func (s *substituter) visit(n Node) bool {
+	if s.err != nil || n == nil {
+		return false
+	}
+	switch node := n.(type) {
+	case *MetricFilter:
+		params := append([]*Param{node.Left}, node.Parameters...)
+		params, s.err = s.params(params)
+		if len(params) == 0 {
+			params = []*Param{{Asterisk: true}}
+		}
+		node.Left, node.Parameters = params[0], params[1:]
+		// filters are fully handled by params
+		return false
+	case *Query:
+		grouping := []string{}
+		for _, g := range node.Grouping {
+			if !isTemplateVariable(g) {
+				grouping = append(grouping, g)
+				continue
+			}
+			values, err := s.values(newTemplateVariable(g))
+			if err != nil {
+				s.err = err
+				return false
+			}
+			grouping = append(grouping, values...)
+		}
+		node.Grouping = grouping
+	case *Value:
+		if node.TemplateVariable != nil {
+			s.err = s.replaceValue(node)
+		}
+	}
+	return true
+}
+
+func (s *substituter) replaceValue(v *Value) error {
+	values, err := s.values(v.TemplateVariable)
+	if err != nil {
+		return err
+	}
+	if len(values) > 1 {
+		return fmt.Errorf("template variable %s has %d values but is used where only one is allowed", v.TemplateVariable, len(values))
+	}
+	nv, err := valueFromString(values[0])
+	if err != nil {
+		return fmt.Errorf("template variable %s: %w", v.TemplateVariable, err)
+	}
+	nv.Pos = v.Pos
+	*v = *nv
+	return nil
+}
+
+// filterItem is an operand of a filter parameter list together with the
+// separators in front of it.
+type filterItem struct {
+	seps    []*Param
+	operand *Param
+	// all is set when the operand matched everything and was removed: a
+	// whole-filter variable set to "*", or a group of them.
+	all bool
+}
+
+func (it *filterItem) has(match func(*FilterValueSeparator) bool) bool {
+	for _, p := range it.seps {
+		if match(p.Separator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *filterItem) or() bool {
+	return it.has(func(sep *FilterValueSeparator) bool { return sep.Or || sep.OrNot })
+}
+
+func (it *filterItem) negated() bool {
+	return it.has(func(sep *FilterValueSeparator) bool { return sep.AndNot || sep.OrNot || sep.Not })
+}
+
+// params substitutes variables in a filter parameter list. A whole-filter
+// variable set to "*" matches everything, so it is dropped where it is joined
+// to other filters by AND or a comma, while an OR it is an operand of matches
+// everything and empties the list. A negated variable set to "*" is dropped
+// along with its negation. An empty result matches everything.
+func (s *substituter) params(params []*Param) ([]*Param, error) {
+	items := []*filterItem{}
+	seps := []*Param{}
+	for _, p := range params {
+		if p.Separator != nil {
+			seps = append(seps, p)
+			continue
+		}
+		it := &filterItem{seps: seps}
+		seps = nil
+		switch {
+		case p.TemplateVariable != nil:
+			replacement, err := s.filterParam(p.TemplateVariable)
+			if err != nil {
+				return nil, err
+			}
+			it.operand, it.all = replacement, replacement == nil
+		case p.GroupedFilter != nil:
+			inner, err := s.params(p.GroupedFilter.Parameters)
+			if err != nil {
+				return nil, err
+			}
+			p.GroupedFilter.Parameters = inner
+			it.operand, it.all = p, len(inner) == 0
+		case p.SimpleFilter != nil:
+			if err := s.simpleFilter(p.SimpleFilter); err != nil {
+				return nil, err
+			}
+			it.operand = p
+		default:
+			it.operand = p
+		}
+		items = append(items, it)
+	}
+
+	// AND and commas bind tighter than OR, so split the operands into the
+	// runs that OR joins
+	runs := [][]*filterItem{}
+	for i, it := range items {
+		if i == 0 || it.or() {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], it)
+	}
+
+	out := []*Param{}
+	for _, run := range runs {
+		kept := []*filterItem{}
+		matchesAll := false
+		for _, it := range run {
+			switch {
+			case !it.all:
+				kept = append(kept, it)
+			case !it.negated():
+				matchesAll = true
+			}
+		}
+		if len(kept) == 0 {
+			if matchesAll {
+				return nil, nil
+			}
+			continue
+		}
+		for i, it := range kept {
+			switch {
+			case it == items[0]:
+				out = append(out, it.seps...)
+			case len(out) == 0:
+				// the operand is now first, so it loses its separator but
+				// keeps the negation of "AND NOT" or "OR NOT"
+				out = append(out, negatedParams(it)...)
+				continue
+			case i == 0 && it != run[0]:
+				// the operand now starts its run, so OR joins it
+				sep := &FilterValueSeparator{Pos: it.operand.Pos, Or: !it.negated(), OrNot: it.negated()}
+				out = append(out, &Param{Pos: it.operand.Pos, Separator: sep})
+			default:
+				out = append(out, it.seps...)
+			}
+			out = append(out, it.operand)
+		}
+	}
+	return out, nil
+}
+
+// negatedParams returns the operand of it without its separators, negated
+// when they were.
+func negatedParams(it *filterItem) []*Param {
+	if !it.negated() {
+		return []*Param{it.operand}
+	}
+	if sf := it.operand.SimpleFilter; sf != nil {
+		sf.Negative = !sf.Negative
+		return []*Param{it.operand}
+	}
+	sep := &FilterValueSeparator{Pos: it.operand.Pos, Not: true}
+	return []*Param{{Pos: it.operand.Pos, Separator: sep}, it.operand}
+}
+
+func (s *substituter) filterParam(tv *TemplateVariable) (*Param, error) {
+	values, err := s.values(tv)
+	if err != nil {
+		return nil, err
+	}
+	if values[0] == "*" {
+		return nil, nil
+	}
+
+	params := []*Param{}
+	for i, v := range values {
+		key, value, found := strings.Cut(v, ":")
+		if !found {
+			key, value = tv.Name, v
+		}
+		fv, err := valueFromString(value)
+		if err != nil {
+			return nil, fmt.Errorf("template variable %s: %w", tv, err)
+		}
+		if i > 0 {
+			params = append(params, &Param{Separator: &FilterValueSeparator{Or: true}})
+		}
+		params = append(params, &Param{SimpleFilter: &SimpleFilter{
+			FilterKey:       key,
+			FilterSeparator: &FilterSeparator{Colon: true},
+			FilterValue:     &FilterValue{SimpleValue: fv},
+		}})
+	}
+	if len(params) == 1 {
+		return params[0], nil
+	}
+	return &Param{GroupedFilter: &GroupedFilter{Parameters: params}}, nil
+}
+
+func (s *substituter) simpleFilter(sf *SimpleFilter) error {
+	fv := sf.FilterValue
+	if fv == nil {
+		return nil
+	}
+
+	if len(fv.ListValue) > 0 {
+		list := []*Value{}
+		for _, v := range fv.ListValue {
+			if v.TemplateVariable == nil {
+				list = append(list, v)
+				continue
+			}
+			values, err := s.values(v.TemplateVariable)
+			if err != nil {
+				return err
+			}
+			for i, value := range values {
+				nv, err := valueFromString(value)
+				if err != nil {
+					return fmt.Errorf("template variable %s: %w", v.TemplateVariable, err)
+				}
+				if i > 0 {
+					list = append(list, &Value{Separator: &FilterValueSeparator{Comma: true}})
+				}
+				list = append(list, nv)
+			}
+		}
+		fv.ListValue = list
+		return nil
+	}
+
+	if fv.SimpleValue == nil || fv.SimpleValue.TemplateVariable == nil {
+		return nil
+	}
+	values, err := s.values(fv.SimpleValue.TemplateVariable)
+	if err != nil {
+		return err
+	}
+	if len(values) == 1 {
+		return s.replaceValue(fv.SimpleValue)
+	}
+	if !sf.FilterSeparator.Colon {
+		return fmt.Errorf("template variable %s has %d values but is used in %q", fv.SimpleValue.TemplateVariable, len(values), sf.String())
+	}
+
+	list := []*Value{}
+	for i, value := range values {
+		nv, err := valueFromString(value)
+		if err != nil {
+			return fmt.Errorf("template variable %s: %w", fv.SimpleValue.TemplateVariable, err)
+		}
+		if i > 0 {
+			list = append(list, &Value{Separator: &FilterValueSeparator{Comma: true}})
+		}
+		list = append(list, nv)
+	}
+	if sf.Negative {
+		sf.Negative = false
+		sf.FilterSeparator = &FilterSeparator{NotIn: true}
+	} else {
+		sf.FilterSeparator = &FilterSeparator{In: true}
+	}
+	sf.FilterValue = &FilterValue{ListValue: list}
+	return nil
+}
@@ -0,0 +1,279 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TemplateVariableParsing(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "whole filter variables",
+			query: "sum:metric.name{$env, $service}",
+			want:  []string{"env", "service"},
+		},
+		{
+			name:  "value with accessor",
+			query: "sum:metric.name{host:$host.value}",
+			want:  []string{"host"},
+		},
+		{
+			name:  "mixed with literals",
+			query: "sum:metric.name{$env, $service, host:$host.value} by {host}",
+			want:  []string{"env", "service", "host"},
+		},
+		{
+			name:  "grouping",
+			query: "sum:metric.name{*} by {$group}",
+			want:  []string{"group"},
+		},
+		{
+			name:  "in list",
+			query: "sum:metric.name{env IN ($env, staging)}",
+			want:  []string{"env"},
+		},
+		{
+			name:  "duplicates are reported once",
+			query: "sum:a{$env} / sum:b{env:$env.value}",
+			want:  []string{"env"},
+		},
+		{
+			name:  "literal dollar free query",
+			query: "sum:metric.name{env:prod}",
+			want:  []string{},
+		},
+	}
+	parser := NewGenericParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.query, ast.String())
+			assert.Equal(t, tt.want, TemplateVariables(ast))
+		})
+	}
+}
+
+func Test_TemplateVariableNode(t *testing.T) {
+	ast, err := NewMetricQueryParser().Parse("sum:metric.name{$env, host:$host.value}")
+	require.NoError(t, err)
+
+	vars := []*TemplateVariable{}
+	Inspect(ast, func(n Node) bool {
+		if tv, ok := n.(*TemplateVariable); ok {
+			vars = append(vars, tv)
+		}
+		return true
+	})
+	require.Len(t, vars, 2)
+	assert.Equal(t, "env", vars[0].Name)
+	assert.Equal(t, "", vars[0].Accessor)
+	assert.Equal(t, 17, vars[0].Position().Column)
+	assert.Equal(t, "host", vars[1].Name)
+	assert.Equal(t, "value", vars[1].Accessor)
+	assert.Same(t, vars[0], ast.Query.Filters.Left.TemplateVariable)
+}
+
+func Test_Substitute(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		vars    map[string][]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "whole filter variable",
+			query: "sum:metric.name{$env, $service}",
+			vars:  map[string][]string{"env": {"prod"}, "service": {"web"}},
+			want:  "sum:metric.name{env:prod, service:web}",
+		},
+		{
+			name:  "whole filter variable with explicit tag",
+			query: "sum:metric.name{$env}",
+			vars:  map[string][]string{"env": {"environment:prod"}},
+			want:  "sum:metric.name{environment:prod}",
+		},
+		{
+			name:  "multi value whole filter variable",
+			query: "sum:metric.name{$env, host:a}",
+			vars:  map[string][]string{"env": {"prod", "staging"}},
+			want:  "sum:metric.name{(env:prod OR env:staging), host:a}",
+		},
+		{
+			name:  "asterisk removes whole filter variable",
+			query: "sum:metric.name{$env, $service, host:a}",
+			vars:  map[string][]string{"env": {"*"}, "service": {"web"}},
+			want:  "sum:metric.name{service:web, host:a}",
+		},
+		{
+			name:  "asterisk removes last variable",
+			query: "sum:metric.name{host:a AND $env}",
+			vars:  map[string][]string{"env": {"*"}},
+			want:  "sum:metric.name{host:a}",
+		},
+		{
+			name:  "asterisk in an OR matches everything",
+			query: "sum:metric.name{host:a OR $env}",
+			vars:  map[string][]string{"env": {"*"}},
+			want:  "sum:metric.name{*}",
+		},
+		{
+			name:  "asterisk in an OR group matches everything",
+			query: "sum:metric.name{service:web, (host:a OR $env)}",
+			vars:  map[string][]string{"env": {"*"}},
+			want:  "sum:metric.name{service:web}",
+		},
+		{
+			name:  "asterisk joined by AND inside an OR",
+			query: "sum:metric.name{host:a OR $env AND service:web}",
+			vars:  map[string][]string{"env": {"*"}},
+			want:  "sum:metric.name{host:a OR service:web}",
+		},
+		{
+			name:  "asterisk at the start of an OR",
+			query: "sum:metric.name{$env AND host:a OR service:web}",
+			vars:  map[string][]string{"env": {"*"}},
+			want:  "sum:metric.name{host:a OR service:web}",
+		},
+		{
+			name:  "asterisk removes a negated variable",
+			query: "sum:metric.name{env:prod AND NOT $host}",
+			vars:  map[string][]string{"host": {"*"}},
+			want:  "sum:metric.name{env:prod}",
+		},
+		{
+			name:  "asterisk removes a negated variable between filters",
+			query: "sum:metric.name{env:prod AND NOT $host, service:web}",
+			vars:  map[string][]string{"host": {"*"}},
+			want:  "sum:metric.name{env:prod, service:web}",
+		},
+		{
+			name:  "asterisk keeps the negation of the next filter",
+			query: "sum:metric.name{$host AND NOT env:prod}",
+			vars:  map[string][]string{"host": {"*"}},
+			want:  "sum:metric.name{!env:prod}",
+		},
+		{
+			name:  "asterisk keeps the negation of the next group",
+			query: "sum:metric.name{$host AND NOT (env:prod OR env:dev)}",
+			vars:  map[string][]string{"host": {"*"}},
+			want:  "sum:metric.name{ NOT (env:prod OR env:dev)}",
+		},
+		{
+			name:  "asterisk removes every filter",
+			query: "sum:metric.name{$env}",
+			vars:  map[string][]string{"env": {"*"}},
+			want:  "sum:metric.name{*}",
+		},
+		{
+			name:  "asterisk removes grouped variables",
+			query: "sum:metric.name{host:a, ($env OR $service)}",
+			vars:  map[string][]string{"env": {"*"}, "service": {"*"}},
+			want:  "sum:metric.name{host:a}",
+		},
+		{
+			name:  "value position",
+			query: "sum:metric.name{host:$host.value} by {host}",
+			vars:  map[string][]string{"host": {"web-1"}},
+			want:  "sum:metric.name{host:web-1} by {host}",
+		},
+		{
+			name:  "value position multi value",
+			query: "sum:metric.name{host:$host.value}",
+			vars:  map[string][]string{"host": {"web-1", "web-2"}},
+			want:  "sum:metric.name{host IN (web-1, web-2)}",
+		},
+		{
+			name:  "negated value position multi value",
+			query: "sum:metric.name{!host:$host.value}",
+			vars:  map[string][]string{"host": {"web-1", "web-2"}},
+			want:  "sum:metric.name{host NOT IN (web-1, web-2)}",
+		},
+		{
+			name:  "value position negative value",
+			query: "sum:metric.name{host:$host.value}",
+			vars:  map[string][]string{"host": {"-neg"}},
+			want:  "sum:metric.name{host:-neg}",
+		},
+		{
+			name:  "value position asterisk",
+			query: "sum:metric.name{host:$host}",
+			vars:  map[string][]string{"host": {"web-1", "*"}},
+			want:  "sum:metric.name{host:*}",
+		},
+		{
+			name:  "in list",
+			query: "sum:metric.name{env IN ($env, dev)}",
+			vars:  map[string][]string{"env": {"prod", "staging"}},
+			want:  "sum:metric.name{env IN (prod, staging, dev)}",
+		},
+		{
+			name:  "grouping",
+			query: "sum:metric.name{*} by {$group,host}",
+			vars:  map[string][]string{"group": {"service", "env"}},
+			want:  "sum:metric.name{*} by {service,env,host}",
+		},
+		{
+			name:  "expression",
+			query: "sum:a{$env} / sum:b{$env}",
+			vars:  map[string][]string{"env": {"prod"}},
+			want:  "sum:a{env:prod} / sum:b{env:prod}",
+		},
+		{
+			name:    "missing variable",
+			query:   "sum:metric.name{$env}",
+			vars:    map[string][]string{},
+			wantErr: true,
+		},
+		{
+			name:    "multiple values in comparison",
+			query:   "sum:metric.name{cpu:>$min}",
+			vars:    map[string][]string{"min": {"1", "2"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			query:   "sum:metric.name{env:$env}",
+			vars:    map[string][]string{"env": {"two words"}},
+			wantErr: true,
+		},
+	}
+	parser := NewGenericParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ast, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+
+			got, err := ast.Substitute(tt.vars)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+			assert.Empty(t, TemplateVariables(got))
+			// the original is left untouched
+			assert.Equal(t, tt.query, ast.String())
+		})
+	}
+}
+
+func Test_TemplateVariableMatches(t *testing.T) {
+	q, err := NewMetricQueryParser().Parse("sum:metric.name{env:$env.value}")
+	require.NoError(t, err)
+	_, err = q.Query.Filters.MatchesTags([]string{"env:prod"})
+	require.Error(t, err)
+
+	resolved, err := q.Substitute(map[string][]string{"env": {"prod"}})
+	require.NoError(t, err)
+	ok, err := resolved.Query.Filters.MatchesTags([]string{"env:prod"})
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
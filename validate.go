@@ -0,0 +1,151 @@
+package ddqp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// ValidationError is a problem Validate found in a parsed query.
+type ValidationError struct {
+	// Pos is the position of the offending function or argument as recorded
+	// by the parser. The metric parsers remove newlines before parsing, so
+	// Offset and Column count from the start of the query without them.
+	Pos lexer.Position
+	// Function is the name of the function at fault.
+	Function string
+	// Deprecated is set when the function is valid but deprecated.
+	Deprecated bool
+	Message    string
+}
+
+func (ve *ValidationError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", ve.Pos.Line, ve.Pos.Column, ve.Message)
+}
+
+var defaultFunctionCatalog = NewFunctionCatalog()
+
+// Validate checks every function call below node against the built-in
+// function catalog. See FunctionCatalog.Validate.
+func Validate(node Node) []*ValidationError {
+	return defaultFunctionCatalog.Validate(node)
+}
+
+// Validate checks every function call below node: that the function is known,
+// written in the right place, and given the right number and kind of
+// arguments. Deprecated functions are reported with Deprecated set. The
+// problems are returned in the order they appear in the query.
+func (c *FunctionCatalog) Validate(node Node) []*ValidationError {
+	problems := []*ValidationError{}
+	Inspect(node, func(n Node) bool {
+		switch fn := n.(type) {
+		case *Function:
+			problems = append(problems, c.validateCall(fn.Pos, fn.Name, MethodFunction, fn.Args)...)
+		case *AggregatorFuction:
+			problems = append(problems, c.validateCall(fn.Pos, fn.Name, WrapperFunction, fn.Args)...)
+		case *ExpressionAggregatorFuction:
+			problems = append(problems, c.validateCall(fn.Pos, fn.Name, WrapperFunction, fn.Args)...)
+		}
+		return true
+	})
+	return problems
+}
+
+func (c *FunctionCatalog) validateCall(pos lexer.Position, name string, placement FunctionPlacement, args []*Value) []*ValidationError {
+	problem := func(pos lexer.Position, format string, a ...interface{}) []*ValidationError {
+		return []*ValidationError{{Pos: pos, Function: name, Message: fmt.Sprintf(format, a...)}}
+	}
+
+	spec, ok := c.Lookup(name)
+	if !ok {
+		return problem(pos, "unknown function %s()", name)
+	}
+	if spec.Placement != placement {
+		if spec.Placement == MethodFunction {
+			return problem(pos, "%s() is chained onto a query, e.g. q.%s()", name, name)
+		}
+		return problem(pos, "%s() wraps a query, e.g. %s(q)", name, name)
+	}
+
+	required := 0
+	for _, arg := range spec.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+	if len(args) < required || len(args) > len(spec.Args) {
+		return problem(pos, "%s() takes %s, got %d", name, arityString(required, len(spec.Args)), len(args))
+	}
+
+	problems := []*ValidationError{}
+	for i, v := range args {
+		if msg := checkArg(spec.Args[i], v); msg != "" {
+			problems = append(problems, problem(v.Pos, "argument %s of %s() %s", spec.Args[i].Name, name, msg)...)
+		}
+	}
+	if spec.Deprecated {
+		msg := fmt.Sprintf("%s() is deprecated", name)
+		if spec.Replacement != "" {
+			msg += fmt.Sprintf("; use %s() instead", spec.Replacement)
+		}
+		problems = append(problems, &ValidationError{Pos: pos, Function: name, Deprecated: true, Message: msg})
+	}
+	return problems
+}
+
+func arityString(required, max int) string {
+	plural := func(n int) string {
+		if n == 1 {
+			return "1 argument"
+		}
+		return fmt.Sprintf("%d arguments", n)
+	}
+	if required == max {
+		return plural(max)
+	}
+	return fmt.Sprintf("%d to %s", required, plural(max))
+}
+
+// checkArg returns why v is not acceptable for arg, or "" if it is.
+func checkArg(arg FunctionArg, v *Value) string {
+	// template variables are only known once the query runs
+	if v.TemplateVariable != nil {
+		return ""
+	}
+	kind, text := argValue(v)
+	if kind != arg.Kind {
+		return fmt.Sprintf("must be a %s, got %s", arg.Kind, v.String())
+	}
+	if len(arg.Values) == 0 {
+		return ""
+	}
+	for _, allowed := range arg.Values {
+		if text == allowed {
+			return ""
+		}
+	}
+	return fmt.Sprintf("must be one of %s, got %s", strings.Join(arg.Values, ", "), v.String())
+}
+
+// argValue classifies a function argument and returns its text without
+// quotes.
+func argValue(v *Value) (ArgKind, string) {
+	switch {
+	case v.Number != nil:
+		return ArgNumber, formatFloatNoExp(*v.Number)
+	case v.Str != nil:
+		s := *v.Str
+		if len(s) >= 2 {
+			s = s[1 : len(s)-1]
+		}
+		return ArgString, s
+	case v.Identifier != nil:
+		// the lexer reads numbers as identifiers
+		if _, err := strconv.ParseFloat(*v.Identifier, 64); err == nil {
+			return ArgNumber, *v.Identifier
+		}
+	}
+	return ArgWord, v.String()
+}
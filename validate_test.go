@@ -0,0 +1,101 @@
+package ddqp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{name: "method chain", query: "sum:a{*}.as_rate().rollup(avg, 60).fill(last, 30)"},
+		{name: "rollup without interval", query: "sum:a{*}.rollup(max)"},
+		{name: "wrapper", query: "moving_rollup(default_zero(sum:a{*}.as_rate()), 60, 'avg')"},
+		{name: "top", query: "top(sum:a{*} by {host}, 10, 'mean', 'desc')"},
+		{name: "expression wrapper", query: "abs(sum:a{*} - sum:b{*}) / clamp_min(sum:c{*}, 1)"},
+		{name: "template variable argument", query: "sum:a{*}.rollup($method)"},
+		{
+			name:  "bad rollup method",
+			query: "sum:a{*}.rollup(sideways)",
+			want:  []string{"1:17: argument method of rollup() must be one of avg, sum, min, max, count, got sideways"},
+		},
+		{
+			name:  "missing argument",
+			query: "moving_rollup(sum:a{*})",
+			want:  []string{"1:1: moving_rollup() takes 1 to 2 arguments, got 0"},
+		},
+		{
+			name:  "too many arguments",
+			query: "sum:a{*}.as_count(1)",
+			want:  []string{"1:10: as_count() takes 0 arguments, got 1"},
+		},
+		{
+			name:  "wrong kind",
+			query: "top(sum:a{*}, mean, 'mean', 'desc')",
+			want:  []string{"1:15: argument limit of top() must be a number, got mean"},
+		},
+		{
+			name:  "unknown function",
+			query: "sum:a{*}.smooth() + unknown(sum:b{*})",
+			want:  []string{"1:10: unknown function smooth()", "1:21: unknown function unknown()"},
+		},
+		{
+			name:  "wrong placement",
+			query: "as_rate(sum:a{*}.abs())",
+			want:  []string{"1:1: as_rate() is chained onto a query, e.g. q.as_rate()", "1:18: abs() wraps a query, e.g. abs(q)"},
+		},
+		{
+			name:  "deprecated",
+			query: "top10_max(sum:a{*} by {host})",
+			want:  []string{"1:1: top10_max() is deprecated; use top() instead"},
+		},
+	}
+	parser := NewMetricExpressionParser()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			me, err := parser.Parse(tt.query)
+			require.NoError(t, err)
+
+			got := []string{}
+			for _, problem := range Validate(me) {
+				got = append(got, problem.Error())
+			}
+			if tt.want == nil {
+				tt.want = []string{}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_FunctionCatalogRegister(t *testing.T) {
+	mq, err := NewMetricQueryParser().Parse("sum:a{*}.rollup(p99, 60).smooth_outliers('strong')")
+	require.NoError(t, err)
+
+	catalog := NewFunctionCatalog()
+	assert.Len(t, catalog.Validate(mq), 2)
+
+	rollup, ok := catalog.Lookup("rollup")
+	require.True(t, ok)
+	extended := *rollup
+	extended.Args = append([]FunctionArg{}, rollup.Args...)
+	extended.Args[0].Values = append(append([]string{}, rollup.Args[0].Values...), "p99")
+	catalog.Register(&extended)
+	catalog.Register(&FunctionSpec{
+		Name:      "smooth_outliers",
+		Placement: MethodFunction,
+		Args:      []FunctionArg{{Name: "level", Kind: ArgString, Values: []string{"weak", "strong"}}},
+	})
+	assert.Empty(t, catalog.Validate(mq))
+
+	// the built-in catalog is unchanged
+	assert.Len(t, Validate(mq), 2)
+	problems := Validate(mq)
+	assert.Equal(t, "rollup", problems[0].Function)
+	assert.False(t, problems[0].Deprecated)
+}